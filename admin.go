@@ -0,0 +1,276 @@
+package fhirhose
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// adminReadHeaderTimeout time a client of the admin API may take to send the request headers
+	adminReadHeaderTimeout = time.Second * 10
+	// adminShutdownTimeout time the admin API waits for running requests on shutdown
+	adminShutdownTimeout = time.Second * 5
+	// maxAdminBodySize maximum size of admin API request bodies
+	maxAdminBodySize = 1 << 20
+)
+
+// ErrUnknownStream err returned when a stream isn't registered on the client
+var ErrUnknownStream = errors.New("unknown stream")
+
+// customLoadRequest body of the custom load endpoint
+type customLoadRequest struct {
+	Identifiers []string `json:"identifiers"`
+}
+
+// statusRequest body of the status endpoint, the identifier is kept out of the url so it isn't logged by proxies
+type statusRequest struct {
+	Identifier string `json:"identifier"`
+}
+
+// AdminHandler returns the http handler of the admin API
+//
+//	GET  /streams                 list all streams and their state
+//	GET  /streams/{name}          state of a stream
+//	POST /streams/{name}/pause    pause the action given in the action query parameter, default polled
+//	POST /streams/{name}/resume   resume the action given in the action query parameter, default polled
+//	POST /streams/{name}/poll     trigger an immediate poll
+//	POST /streams/{name}/load     publish {"identifiers": [...]} onto the custom load lane, at most 1 MiB
+//	POST /streams/{name}/status   processing status of {"identifier": "..."}
+//
+// every request requires the Authorization: Bearer <AdminToken> header
+func (c *Client) AdminHandler() http.Handler {
+	control := c.getController()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 0 || parts[0] != "streams" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			states := make([]StreamState, 0, len(c.Streams))
+			for _, stream := range c.Streams {
+				state, _ := control.state(stream.GetStreamName())
+				states = append(states, state)
+			}
+			writeJSON(w, http.StatusOK, states)
+			return
+		}
+
+		stream := c.getStream(StreamName(parts[1]))
+		if stream == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrUnknownStream.Error()})
+			return
+		}
+		name := stream.GetStreamName()
+
+		if len(parts) == 2 {
+			if r.Method != http.MethodGet {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			state, _ := control.state(name)
+			writeJSON(w, http.StatusOK, state)
+			return
+		}
+
+		if len(parts) != 3 || r.Method != http.MethodPost {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+
+		action := ActionName(r.URL.Query().Get("action"))
+		if action == "" {
+			action = PollAction
+		}
+
+		switch parts[2] {
+		case "pause", "resume":
+			if !isPausableAction(action) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("action %s can't be paused", action)})
+				return
+			}
+			control.setPaused(name, action, parts[2] == "pause")
+			c.Config.logger().WithFields(Fields{"resource": name, "action": action}).Info(parts[2] + "d stream")
+			state, _ := control.state(name)
+			writeJSON(w, http.StatusOK, state)
+		case "poll":
+			if control.isPaused(name, PollAction) {
+				writeJSON(w, http.StatusConflict, map[string]string{"error": "polling is paused"})
+				return
+			}
+			control.triggerPoll(name)
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "poll triggered"})
+		case "load":
+			var request customLoadRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize)).Decode(&request); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := validateIdentifiers(request.Identifiers); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			published, err := publishCustomLoad(*c.Config, name, request.Identifiers)
+			if err != nil {
+				// The identifiers after the published ones can be loaded again
+				writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": err.Error(), "published": published})
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]int{"published": published})
+		case "status":
+			var request statusRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize)).Decode(&request); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			c.writeStatus(w, name, request.Identifier)
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	})
+}
+
+// serveAdmin starts the admin API on the configured address, the server stops on Shutdown
+func (c *Client) serveAdmin() error {
+	listener, err := net.Listen("tcp", c.Config.AdminAddr)
+	if err != nil {
+		return fmt.Errorf("listening on admin address failed: %w", err)
+	}
+
+	server := &http.Server{Handler: c.AdminHandler(), ReadHeaderTimeout: adminReadHeaderTimeout}
+	c.adminServer = server
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.Config.logger().WithError(err).Error("admin api stopped")
+		}
+	}()
+	return nil
+}
+
+// shutdownAdmin stops the admin API, running requests get the admin shutdown timeout to finish
+func (c *Client) shutdownAdmin() {
+	if c.adminServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := c.adminServer.Shutdown(ctx); err != nil {
+		c.Config.logger().WithError(err).Warn("can't shut down admin api")
+	}
+}
+
+// writeStatus writes the processing status of the identifier
+func (c *Client) writeStatus(w http.ResponseWriter, stream StreamName, identifier string) {
+	if c.Config.StatusStore == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "processing status isn't recorded"})
+		return
+	}
+	if err := ValidateIdentifier(identifier); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status, err := GetStatus(c.Config.StatusStore, stream, identifier)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(status.Stages) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no processing status of identifier"})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// authorized checks the bearer token of the request against the admin token, tokens without the Bearer scheme are refused
+func (c *Client) authorized(r *http.Request) bool {
+	if c.Config.AdminToken == "" {
+		return false
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.Config.AdminToken)) == 1
+}
+
+// getStream returns the registered stream with the name
+func (c *Client) getStream(name StreamName) IStream {
+	for _, stream := range c.Streams {
+		if stream.GetStreamName() == name {
+			return stream
+		}
+	}
+	return nil
+}
+
+// getController returns the controller of the client and creates it when needed
+func (c *Client) getController() *controller {
+	if c.Config.control == nil {
+		c.Config.control = newController(c.Streams)
+	}
+	return c.Config.control
+}
+
+// isPausableAction checks if the action is handled by a stage which can be paused
+func isPausableAction(action ActionName) bool {
+	switch action {
+	case PollAction, DebounceAction, RetrieveAction, TransformAction, UploadAction:
+		return true
+	}
+	return false
+}
+
+// validateIdentifiers validates all identifiers of a custom load before any is published
+func validateIdentifiers(identifiers []string) error {
+	for _, identifier := range identifiers {
+		if err := ValidateIdentifier(identifier); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishCustomLoad publishes the identifiers onto the custom load lane of the stream
+// returns the amount of published identifiers, the identifiers are published in order
+func publishCustomLoad(conf Config, stream StreamName, identifiers []string) (int, error) {
+	for published, identifier := range identifiers {
+		actionString := GetPublishAction(identifier, stream, conf.GetCustomLoadPrefix(), PollAction)
+		msg, err := newStreamMsg(conf, stream, actionString, StreamMessage{Identifier: identifier})
+		if err != nil {
+			return published, err
+		}
+		if err := conf.PubSub.PublishMsg(msg); err != nil {
+			return published, fmt.Errorf("publishing custom load failed: %w", err)
+		}
+	}
+
+	conf.logger().WithFields(Fields{"resource": stream, "changes": len(identifiers)}).Info("published custom load")
+	return len(identifiers), nil
+}
+
+// writeJSON writes the value as json response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,106 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidBackpressure err returned when the backpressure water marks are misconfigured
+var ErrInvalidBackpressure = errors.New("invalid backpressure")
+
+// Backpressure high and low water marks of the messages pending on the downstream consumers of a stream
+// polling is skipped once the high water mark is reached and resumes below the low water mark
+type Backpressure struct {
+	// HighWaterMark pending messages at which polling is skipped
+	// Default 0 disables backpressure
+	HighWaterMark uint64
+	// LowWaterMark pending messages at which polling resumes, can't exceed the high water mark
+	LowWaterMark uint64
+}
+
+// Validate validates if the low water mark doesn't exceed the high water mark of enabled backpressure
+func (b Backpressure) Validate() error {
+	if b.enabled() && b.LowWaterMark > b.HighWaterMark {
+		return fmt.Errorf("%w: low water mark %d exceeds high water mark %d", ErrInvalidBackpressure, b.LowWaterMark, b.HighWaterMark)
+	}
+	return nil
+}
+
+// enabled reports if a high water mark is configured
+func (b Backpressure) enabled() bool {
+	return b.HighWaterMark > 0
+}
+
+// IPollLimiter optional interface of streams which can limit the amount of messages returned by the next poll
+// streams implementing it get shrunk polls when the pending messages approach the high water mark
+type IPollLimiter interface {
+	SetPollLimit(limit int)
+}
+
+// getDownstreamConsumers returns the consumers of the regular lane downstream of the poller of the stream
+func getDownstreamConsumers(conf Config, stream StreamName) []string {
+	prefix := conf.GetConsumerPrefix()
+	consumers := []string{
+		conf.GetConsumerName(stream, prefix, PollAction),
+		conf.GetConsumerName(stream, prefix, RetrieveAction),
+		conf.GetConsumerName(stream, prefix, TransformAction),
+	}
+	if conf.DebounceQuietPeriod > 0 {
+		consumers = append(consumers, conf.GetConsumerName(stream, prefix, DebounceAction))
+	}
+	return consumers
+}
+
+// getPending returns the sum of the pending messages of the downstream consumers of the stream
+func getPending(conf Config, stream StreamName) (uint64, error) {
+	var pending uint64
+	for _, consumer := range getDownstreamConsumers(conf, stream) {
+		consumerPending, err := conf.PubSub.Pending(consumer, string(conf.GetStreamName()))
+		if err != nil {
+			return 0, err
+		}
+		pending += consumerPending
+	}
+	return pending, nil
+}
+
+// checkBackpressure decides if the poll of the stream should run
+// streams implementing IPollLimiter are limited to the headroom below the high water mark
+func checkBackpressure(conf Config, stream IStream) bool {
+	if conf.Backpressure == nil || !conf.Backpressure.enabled() {
+		return true
+	}
+
+	name := stream.GetStreamName()
+	logger := conf.logger().WithField("resource", name)
+	pending, err := getPending(conf, name)
+	if err != nil {
+		// Poll as usual, consumers can't be inspected
+		logger.WithError(err).Error("can't get pending messages")
+		return true
+	}
+
+	throttled := conf.control.isThrottled(name)
+	switch {
+	case !throttled && pending >= conf.Backpressure.HighWaterMark:
+		throttled = true
+		logger.WithFields(Fields{"pending": pending, "highWaterMark": conf.Backpressure.HighWaterMark}).Warn("pausing poll for backpressure")
+	case throttled && pending <= conf.Backpressure.LowWaterMark:
+		throttled = false
+		logger.WithFields(Fields{"pending": pending, "lowWaterMark": conf.Backpressure.LowWaterMark}).Info("resuming poll after backpressure")
+	}
+	conf.control.setBackpressure(name, throttled, pending)
+
+	if throttled {
+		logger.WithField("pending", pending).Info("skipping poll for backpressure")
+		count(conf, name, PollAction, "backpressure_skipped", 1)
+		return false
+	}
+
+	limit := int(conf.Backpressure.HighWaterMark - pending)
+	if limiter, ok := stream.(IPollLimiter); ok {
+		logger.WithFields(Fields{"pending": pending, "limit": limit}).Debug("limiting poll for backpressure")
+		limiter.SetPollLimit(limit)
+	}
+	return true
+}
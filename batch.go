@@ -0,0 +1,355 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DefaultUploadMaxAttempts default amount of times failed items of an upload batch are handled before they are requeued
+	DefaultUploadMaxAttempts = 3
+	// DefaultUploadRetryBackoff default wait before failed items of an upload batch are retried, doubled on every next retry
+	DefaultUploadRetryBackoff = time.Second
+	// DefaultMaxUploadRetryBackoff default maximum wait between retries of an upload batch
+	DefaultMaxUploadRetryBackoff = time.Second * 30
+	// batchMaxWait time the oldest item of a partial batch waits before the batch is handled
+	batchMaxWait = time.Second
+	// batchFlushInterval interval in which partial batches are checked for items waiting too long
+	batchFlushInterval = time.Millisecond * 100
+)
+
+// ErrBatchResults err returned when the batch handler returns a result slice not matching the uploads
+var ErrBatchResults = errors.New("invalid batch results")
+
+// BatchHandlerFunc func used in callback for uploads handling with a result per upload
+// results contain the error of every upload in the order of the uploads, nil for uploaded items
+// errors wrapped by Permanent are dead lettered, errors wrapped by Skip are filtered and other errors are retried
+// an error fails every upload of the batch, nil results without error means every upload succeeded
+type BatchHandlerFunc func(uploads []StreamMessage) (results []error, err error)
+
+// getBatchHandler returns the batch callback, or the upload callback adapted to a batch handler failing every upload on error
+// unclassified errors of the upload callback are retried, its uploads are dead lettered after the max deliveries
+func (c *Client) getBatchHandler() BatchHandlerFunc {
+	if c.BatchCallback != nil {
+		return *c.BatchCallback
+	}
+	if c.UploadCallback != nil {
+		uploadFunc := *c.UploadCallback
+		return func(uploads []StreamMessage) ([]error, error) {
+			return nil, uploadFunc(uploads)
+		}
+	}
+	return nil
+}
+
+// pendingBatch items of a stream collected for the handler
+type pendingBatch struct {
+	items  []StreamMessage
+	oldest time.Time
+}
+
+// batchUploads collects uploaded items into a batch per stream for the handler
+// a batch is handled when the batch size is exceeded or the oldest item waits for a second, also on a quiet stream
+// items are kept in progress from the moment they are collected until they are settled
+func batchUploads(conf Config, handler BatchHandlerFunc, uploadChan *chan StreamMessage, errChan *chan Error) {
+	uploadCircuit := conf.control.circuit(conf, UploadHandlerCircuit)
+	inProgress := newBatchInProgress(conf)
+	defer inProgress.stop()
+	ticker := time.NewTicker(batchFlushInterval)
+	defer ticker.Stop()
+
+	batches := make(map[StreamName]*pendingBatch)
+	for {
+		select {
+		case uploadItem, ok := <-*uploadChan:
+			if !ok {
+				// Items of the partial batches are handed back to be redelivered
+				for _, batch := range batches {
+					requeueBatch(conf, inProgress, batch.items)
+				}
+				return
+			}
+			batch, found := batches[uploadItem.stream]
+			if !found {
+				batch = &pendingBatch{oldest: time.Now()}
+				batches[uploadItem.stream] = batch
+			}
+			inProgress.add(uploadItem.consumed)
+			batch.items = append(batch.items, uploadItem)
+			if len(batch.items) > conf.UploadBatchSize {
+				delete(batches, uploadItem.stream)
+				uploadBatch(conf, uploadItem.stream, handler, batch.items, uploadCircuit, inProgress, errChan)
+			}
+		case <-ticker.C:
+			for stream, batch := range batches {
+				if time.Since(batch.oldest) < batchMaxWait {
+					continue
+				}
+				delete(batches, stream)
+				uploadBatch(conf, stream, handler, batch.items, uploadCircuit, inProgress, errChan)
+			}
+		}
+	}
+}
+
+// uploadBatch hands the batch to the handler and retries the failed items with exponential backoff
+// uploaded items are acknowledged, permanently failed items dead lettered and
+// items still failing after the last attempt are negatively acknowledged so the upload stage handles them again
+// every item of the batch is settled in the in progress tracker on return
+// circuit changes, panics and retries are reported on the stream of the batch
+func uploadBatch(conf Config, stream StreamName, handler BatchHandlerFunc, batch []StreamMessage, uploadCircuit *circuit, inProgress *batchInProgress, errChan *chan Error) {
+	batchID := newBatchID()
+	logger := conf.logger().WithFields(Fields{"batch": batchID})
+	defer func() {
+		for _, message := range batch {
+			inProgress.settled(message.consumed)
+		}
+	}()
+
+	pending := batch
+	backoff := conf.getUploadRetryBackoff()
+	for attempt := 1; ; attempt++ {
+		// Batches wait while the upload handler circuit is open, upload workers block on the channel meanwhile
+		if !waitForCircuit(conf, stream, UploadAction, uploadCircuit, nil, errChan) {
+			requeueBatch(conf, inProgress, pending)
+			return
+		}
+
+		results, err := handleBatch(handler, pending, batchID)
+		reportPanic(conf, stream, UploadAction, err)
+
+		var retry []StreamMessage
+		var failures []error
+		var systemFailure error
+		for i, message := range pending {
+			itemErr := err
+			if itemErr == nil && results != nil {
+				itemErr = results[i]
+			}
+			message.batchID = batchID
+
+			switch class := classify(itemErr); {
+			case itemErr == nil:
+				inProgress.settled(message.consumed)
+				settleUploaded(conf, message)
+			case class == ErrSkip || class == ErrPermanent:
+				inProgress.settled(message.consumed)
+				settleUpload(conf, message, itemErr, errChan)
+			default:
+				if class == nil {
+					itemErr = Transient(itemErr)
+				}
+				if systemFailure == nil {
+					systemFailure = itemErr
+				}
+				retry = append(retry, message)
+				failures = append(failures, itemErr)
+			}
+		}
+		recordCircuit(conf, stream, UploadAction, uploadCircuit, systemFailure, errChan)
+
+		if len(retry) == 0 {
+			return
+		}
+		if attempt >= conf.getUploadMaxAttempts() {
+			// The items are requeued and handled again by the upload stage
+			for i, message := range retry {
+				settleUpload(conf, message, failures[i], errChan)
+			}
+			return
+		}
+		for i, message := range retry {
+			recordFailed(conf, message.stream, UploadAction, message.identifier, batchID, failures[i])
+		}
+
+		logger.WithError(systemFailure).WithFields(Fields{"failed": len(retry), "attempt": attempt, "backoff": backoff}).Warn("retrying failed uploads")
+		count(conf, stream, UploadAction, "batch_retried", int64(len(retry)))
+		select {
+		case <-time.After(backoff):
+		case <-conf.control.context().Done():
+			requeueBatch(conf, inProgress, retry)
+			return
+		}
+		backoff *= 2
+		if backoff > conf.getMaxUploadRetryBackoff() {
+			backoff = conf.getMaxUploadRetryBackoff()
+		}
+		pending = retry
+	}
+}
+
+// handleBatch calls the handler with the uploads of the batch and validates its results
+// a panic of the handler is recovered so it doesn't stop the batcher
+func handleBatch(handler BatchHandlerFunc, uploads []StreamMessage, batchID string) ([]error, error) {
+	batch := make([]StreamMessage, len(uploads))
+	for i, upload := range uploads {
+		upload.batchID = batchID
+		batch[i] = upload
+	}
+
+	var results []error
+	err := recovered(func() (err error) {
+		results, err = handler(batch)
+		return err
+	})
+	if err == nil && results != nil && len(results) != len(uploads) {
+		err = fmt.Errorf("%w: %d results for %d uploads", ErrBatchResults, len(results), len(uploads))
+	}
+	return results, err
+}
+
+// settleUploaded acknowledges the consumed message of an uploaded item and records the upload
+func settleUploaded(conf Config, message StreamMessage) {
+	if message.consumed != nil {
+		acknowledge(conf, message.consumed)
+	}
+	storeUploaded(conf, message)
+	recordSucceeded(conf, message.stream, UploadAction, message.identifier, message.batchID)
+	publishUploaded(conf, message.stream, message.identifier)
+
+	// Data has been uploaded so the claim check can be garbage collected
+	if err := releaseClaimCheck(conf, message.consumedClaimCheck); err != nil {
+		conf.logger().WithError(err).Error("can't release claim check")
+	}
+}
+
+// settleUpload settles the consumed message of a failed item by the class of its error, see settleFailure
+func settleUpload(conf Config, message StreamMessage, err error, errChan *chan Error) {
+	if message.consumed == nil {
+		// Items without consumed message can't be requeued or dead lettered
+		recordFailed(conf, message.stream, UploadAction, message.identifier, message.batchID, err)
+		if errChan != nil {
+			*errChan <- Error{
+				Event:         message.stream,
+				Action:        UploadAction,
+				StreamMessage: &message,
+				Err:           err,
+			}
+		}
+		return
+	}
+
+	if !settleFailure(conf, message.stream, UploadAction, message.consumed, &message, err, errChan) {
+		// Requeued or dead lettered message still needs its data
+		return
+	}
+	if err := releaseClaimCheck(conf, message.consumedClaimCheck); err != nil {
+		conf.logger().WithError(err).Error("can't release claim check")
+	}
+}
+
+// requeueBatch negatively acknowledges the consumed messages of the items so they are handled again
+func requeueBatch(conf Config, inProgress *batchInProgress, batch []StreamMessage) {
+	for _, message := range batch {
+		if message.consumed == nil {
+			continue
+		}
+		inProgress.settled(message.consumed)
+		negativeAcknowledge(conf, message.consumed)
+	}
+}
+
+// sendUpload puts the item into the upload channel and keeps its consumed message in progress while the channel is full
+// the consumed message is settled by the batcher once the item is sent
+func sendUpload(conf Config, uploadChan *chan StreamMessage, message StreamMessage) {
+	ticker := time.NewTicker(conf.getInProgressInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case *uploadChan <- message:
+			markSettled(message.consumed)
+			return
+		case <-ticker.C:
+			if err := pubsub.InProgress(conf.PubSub, message.consumed); err != nil {
+				conf.logger().WithError(err).Warn("can't keep message in progress")
+			}
+		}
+	}
+}
+
+// batchInProgress keeps the consumed messages of a batch in progress until they are settled
+type batchInProgress struct {
+	mu      sync.Mutex
+	pending map[*nats.Msg]bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newBatchInProgress keeps the added consumed messages in progress every in progress interval until they are settled
+func newBatchInProgress(conf Config) *batchInProgress {
+	b := &batchInProgress{pending: make(map[*nats.Msg]bool), done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(b.stopped)
+		ticker := time.NewTicker(conf.getInProgressInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+				b.mu.Lock()
+				for msg := range b.pending {
+					if err := pubsub.InProgress(conf.PubSub, msg); err != nil {
+						conf.logger().WithError(err).Warn("can't keep message in progress")
+					}
+				}
+				b.mu.Unlock()
+			}
+		}
+	}()
+	return b
+}
+
+// add keeps the consumed message in progress, items without consumed message are ignored
+func (b *batchInProgress) add(msg *nats.Msg) {
+	if msg == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[msg] = true
+}
+
+// settled stops keeping the consumed message in progress
+func (b *batchInProgress) settled(msg *nats.Msg) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, msg)
+}
+
+// stop stops keeping the messages in progress and waits until the last in progress acknowledgement is sent
+func (b *batchInProgress) stop() {
+	close(b.done)
+	<-b.stopped
+}
+
+// getUploadMaxAttempts returns the configured max attempts or the default
+func (c Config) getUploadMaxAttempts() int {
+	if c.UploadMaxAttempts > 0 {
+		return c.UploadMaxAttempts
+	}
+	return DefaultUploadMaxAttempts
+}
+
+// getUploadRetryBackoff returns the configured upload retry backoff or the default
+func (c Config) getUploadRetryBackoff() time.Duration {
+	if c.UploadRetryBackoff > 0 {
+		return c.UploadRetryBackoff
+	}
+	return DefaultUploadRetryBackoff
+}
+
+// getMaxUploadRetryBackoff returns the configured maximum upload retry backoff or the default
+func (c Config) getMaxUploadRetryBackoff() time.Duration {
+	if c.MaxUploadRetryBackoff > 0 {
+		return c.MaxUploadRetryBackoff
+	}
+	return DefaultMaxUploadRetryBackoff
+}
@@ -0,0 +1,349 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DefaultCircuitErrorRate default failed fraction of the requests in a window which opens a circuit breaker
+	DefaultCircuitErrorRate = 0.5
+	// DefaultCircuitWindow default window in which the error rate of a circuit breaker is measured
+	DefaultCircuitWindow = time.Minute
+	// DefaultCircuitMinRequests default amount of requests in a window before a circuit breaker can open
+	DefaultCircuitMinRequests = 10
+	// DefaultCircuitOpenDuration default time a circuit breaker stays open before probing
+	DefaultCircuitOpenDuration = time.Second * 30
+	// DefaultCircuitHalfOpenRequests default amount of successful probes which close a circuit breaker
+	DefaultCircuitHalfOpenRequests = 1
+	// UploadHandlerCircuit name of the circuit breaker around the upload callback
+	UploadHandlerCircuit = "upload-handler"
+)
+
+// CircuitState state of a circuit breaker
+type CircuitState string
+
+const (
+	// CircuitClosed requests pass
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen requests are held back until the open duration passed
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen a limited amount of probe requests pass
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+var (
+	// ErrCircuitStateChanged err wrapped by CircuitError
+	ErrCircuitStateChanged = errors.New("circuit breaker state changed")
+	// ErrInvalidCircuitBreaker err returned when a circuit breaker is misconfigured
+	ErrInvalidCircuitBreaker = errors.New("invalid circuit breaker")
+)
+
+// CircuitError error reported on the error channel when a circuit breaker changes state
+type CircuitError struct {
+	Circuit string
+	State   CircuitState
+}
+
+// Error returns the circuit and its new state
+func (c *CircuitError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrCircuitStateChanged, c.Circuit, c.State)
+}
+
+// Unwrap returns ErrCircuitStateChanged so state changes can be checked with errors.Is
+func (c *CircuitError) Unwrap() error {
+	return ErrCircuitStateChanged
+}
+
+// CircuitBreaker configures a circuit breaker which holds back a stage while its error rate is too high
+type CircuitBreaker struct {
+	// ErrorRate failed fraction of the requests in a window which opens the circuit, between 0 and 1
+	// Default DefaultCircuitErrorRate
+	ErrorRate float64
+	// MinRequests amount of requests in a window before the circuit can open
+	// Default DefaultCircuitMinRequests
+	MinRequests int
+	// Window window in which the error rate is measured
+	// Default DefaultCircuitWindow
+	Window time.Duration
+	// OpenDuration time the circuit stays open before probe requests pass
+	// Default DefaultCircuitOpenDuration
+	OpenDuration time.Duration
+	// HalfOpenRequests amount of probe requests which have to succeed to close the circuit
+	// Default DefaultCircuitHalfOpenRequests
+	HalfOpenRequests int
+}
+
+// Validate validates if the error rate is a fraction, an unset error rate uses the default
+func (b CircuitBreaker) Validate() error {
+	if _, err := b.getErrorRate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getErrorRate returns the configured error rate or the default, error rates outside (0, 1] are rejected
+func (b CircuitBreaker) getErrorRate() (float64, error) {
+	if b.ErrorRate == 0 {
+		return DefaultCircuitErrorRate, nil
+	}
+	if !(b.ErrorRate > 0 && b.ErrorRate <= 1) {
+		return 0, fmt.Errorf("%w: error rate %v isn't within (0, 1]", ErrInvalidCircuitBreaker, b.ErrorRate)
+	}
+	return b.ErrorRate, nil
+}
+
+// IEndpointStream optional interface of streams sharing circuit breakers by endpoint
+// e.g. all streams uploading to the same FHIR server return the same endpoint for UploadAction
+type IEndpointStream interface {
+	// GetEndpoint returns the endpoint called by the stage, empty uses the circuit of the stream and stage
+	GetEndpoint(action ActionName) string
+}
+
+// GetCircuitName create circuit breaker name based on stream and action
+func GetCircuitName(stream StreamName, action ActionName) string {
+	return fmt.Sprintf("%s.%s", stream, action)
+}
+
+// circuit runtime state of a circuit breaker
+type circuit struct {
+	name       string
+	breaker    CircuitBreaker
+	mu         sync.Mutex
+	state      CircuitState
+	windowEnd  time.Time
+	requests   int
+	failures   int
+	openedAt   time.Time
+	probes     int
+	successful int
+}
+
+// allow reports if a request may pass and the new state when the circuit changed to half open
+func (c *circuit) allow(now time.Time) (bool, CircuitState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := false
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= c.getOpenDuration() {
+		c.state = CircuitHalfOpen
+		c.probes = 0
+		c.successful = 0
+		changed = true
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		return false, c.state, changed
+	case CircuitHalfOpen:
+		if c.probes >= c.getHalfOpenRequests() {
+			return false, c.state, changed
+		}
+		c.probes++
+	}
+	return true, c.state, changed
+}
+
+// record records the outcome of an allowed request and returns the new state when the circuit changed
+func (c *circuit) record(now time.Time, failed bool) (CircuitState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitHalfOpen:
+		if failed {
+			c.open(now)
+			return c.state, true
+		}
+		c.successful++
+		if c.successful >= c.getHalfOpenRequests() {
+			c.state = CircuitClosed
+			c.windowEnd = time.Time{}
+			return c.state, true
+		}
+	case CircuitClosed:
+		if now.After(c.windowEnd) {
+			c.windowEnd = now.Add(c.getWindow())
+			c.requests = 0
+			c.failures = 0
+		}
+		c.requests++
+		if failed {
+			c.failures++
+		}
+		if c.requests >= c.getMinRequests() && float64(c.failures)/float64(c.requests) >= c.getErrorRate() {
+			c.open(now)
+			return c.state, true
+		}
+	}
+	return c.state, false
+}
+
+// release releases an allowed request without outcome, e.g. a probe cancelled by the shutdown
+func (c *circuit) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CircuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// retryIn returns the time until probe requests pass
+func (c *circuit) retryIn(now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != CircuitOpen {
+		return 0
+	}
+	return c.openedAt.Add(c.getOpenDuration()).Sub(now)
+}
+
+// open opens the circuit, the caller holds the lock
+func (c *circuit) open(now time.Time) {
+	c.state = CircuitOpen
+	c.openedAt = now
+	c.requests = 0
+	c.failures = 0
+}
+
+// getErrorRate returns the configured error rate or the default, invalid error rates are rejected when the client runs
+func (c *circuit) getErrorRate() float64 {
+	rate, err := c.breaker.getErrorRate()
+	if err != nil {
+		return DefaultCircuitErrorRate
+	}
+	return rate
+}
+
+// getWindow returns the configured window or the default
+func (c *circuit) getWindow() time.Duration {
+	if c.breaker.Window > 0 {
+		return c.breaker.Window
+	}
+	return DefaultCircuitWindow
+}
+
+// getMinRequests returns the configured minimum requests or the default
+func (c *circuit) getMinRequests() int {
+	if c.breaker.MinRequests > 0 {
+		return c.breaker.MinRequests
+	}
+	return DefaultCircuitMinRequests
+}
+
+// getOpenDuration returns the configured open duration or the default
+func (c *circuit) getOpenDuration() time.Duration {
+	if c.breaker.OpenDuration > 0 {
+		return c.breaker.OpenDuration
+	}
+	return DefaultCircuitOpenDuration
+}
+
+// getHalfOpenRequests returns the configured half open requests or the default
+func (c *circuit) getHalfOpenRequests() int {
+	if c.breaker.HalfOpenRequests > 0 {
+		return c.breaker.HalfOpenRequests
+	}
+	return DefaultCircuitHalfOpenRequests
+}
+
+// getCircuit returns the circuit breaker of the stage of the stream, nil when none is configured
+// streams implementing IEndpointStream share the circuit breaker of their endpoint
+func getCircuit(conf Config, stream IStream, action ActionName) *circuit {
+	name := GetCircuitName(stream.GetStreamName(), action)
+	if endpointStream, ok := stream.(IEndpointStream); ok {
+		if endpoint := endpointStream.GetEndpoint(action); endpoint != "" {
+			name = endpoint
+		}
+	}
+	return conf.control.circuit(conf, name)
+}
+
+// allowCircuit reports if the stage may call its system, state changes to half open are reported
+func allowCircuit(conf Config, stream StreamName, action ActionName, c *circuit, errChan *chan Error) bool {
+	if c == nil {
+		return true
+	}
+
+	allowed, state, changed := c.allow(conf.getClock().Now())
+	if changed {
+		reportCircuit(conf, stream, action, c.name, state, errChan)
+	}
+	return allowed
+}
+
+// waitForCircuit blocks the stage while its circuit is open, the message stays in progress while waiting
+// returns false when the client shuts down while waiting
+func waitForCircuit(conf Config, stream StreamName, action ActionName, c *circuit, msg *nats.Msg, errChan *chan Error) bool {
+	if c == nil {
+		return true
+	}
+
+	clock := conf.getClock()
+	for {
+		if allowCircuit(conf, stream, action, c, errChan) {
+			return true
+		}
+
+		// Half open circuits are checked again soon, their probes finish or open the circuit again
+		wait := c.retryIn(clock.Now())
+		if wait <= 0 {
+			wait = time.Millisecond * 100
+		} else if wait > pausedCheckInterval {
+			wait = pausedCheckInterval
+		}
+		select {
+		case <-conf.control.context().Done():
+			return false
+		case <-clock.After(wait):
+			if msg != nil {
+				_ = pubsub.InProgress(conf.PubSub, msg)
+			}
+		}
+	}
+}
+
+// recordCircuit records the outcome of the stage on its circuit
+// stages cancelled by the shutdown or their caller aren't an outcome of the called system, see isSystemFailure for failures
+func recordCircuit(conf Config, stream StreamName, action ActionName, c *circuit, err error, errChan *chan Error) {
+	if c == nil {
+		return
+	}
+	if errors.Is(err, ErrShutdown) || errors.Is(err, ErrCancelled) {
+		c.release()
+		return
+	}
+
+	if state, changed := c.record(conf.getClock().Now(), isSystemFailure(err)); changed {
+		reportCircuit(conf, stream, action, c.name, state, errChan)
+	}
+}
+
+// reportCircuit logs, counts and escalates the state change of the circuit to the error channel
+func reportCircuit(conf Config, stream StreamName, action ActionName, name string, state CircuitState, errChan *chan Error) {
+	logger := conf.logger().WithFields(Fields{"resource": stream, "action": action, "circuit": name, "state": state})
+	if state == CircuitOpen {
+		logger.Warn("opened circuit breaker")
+	} else {
+		logger.Info("circuit breaker changed state")
+	}
+	count(conf, stream, action, "circuit_"+strings.ReplaceAll(string(state), "-", "_"), 1)
+
+	if errChan != nil {
+		*errChan <- Error{
+			Event:         stream,
+			Action:        action,
+			StreamMessage: nil,
+			Err:           &CircuitError{Circuit: name, State: state},
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package fhirhose
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IObjectStore interface containing functions to store message data outside of the message bus
+type IObjectStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// FileObjectStore object store which keeps every object as a file in a directory
+// objects are only visible to the replicas sharing the directory, deployments with multiple replicas need a
+// directory on a shared volume or another IObjectStore, otherwise other replicas fail permanently on missing claim checks
+type FileObjectStore struct {
+	Dir string
+}
+
+// NewFileObjectStore creates a new file object store and the directory when it doesn't exist
+func NewFileObjectStore(dir string) (*FileObjectStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating object store directory failed: %w", err)
+	}
+	return &FileObjectStore{Dir: dir}, nil
+}
+
+// Put writes the data to the file of the key
+func (s *FileObjectStore) Put(key string, data []byte) error {
+	return ioutil.WriteFile(s.path(key), data, 0600)
+}
+
+// Get reads the data from the file of the key
+func (s *FileObjectStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+// Delete removes the file of the key
+func (s *FileObjectStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// path returns the file path of the key
+func (s *FileObjectStore) path(key string) string {
+	return filepath.Join(s.Dir, EncodeIdentifier(filepath.Base(key)))
+}
+
+// checkMessage moves the data into the claim check store when it exceeds the claim check threshold
+func checkMessage(conf Config, stream StreamName, message StreamMessage) (StreamMessage, error) {
+	if conf.ClaimCheckStore == nil || conf.ClaimCheckThreshold <= 0 || len(message.Data) <= conf.ClaimCheckThreshold {
+		return message, nil
+	}
+
+	key, err := newClaimCheckKey(stream)
+	if err != nil {
+		return message, err
+	}
+	if err := conf.ClaimCheckStore.Put(key, message.Data); err != nil {
+		return message, fmt.Errorf("storing claim check %s failed: %w", key, err)
+	}
+	message.ClaimCheck = key
+	message.Data = nil
+
+	return message, nil
+}
+
+// resolveMessage resolves the data from the claim check store
+// missing claim checks are permanent failures, other failures of the store are transient unless classified by the store
+func resolveMessage(conf Config, message StreamMessage) (StreamMessage, error) {
+	if conf.ClaimCheckStore == nil {
+		return message, Permanent(fmt.Errorf("resolving claim check %s failed: no claim check store configured", message.ClaimCheck))
+	}
+
+	data, err := conf.ClaimCheckStore.Get(message.ClaimCheck)
+	if err != nil {
+		err = fmt.Errorf("resolving claim check %s failed: %w", message.ClaimCheck, err)
+		switch {
+		case classify(err) != nil:
+		case errors.Is(err, os.ErrNotExist):
+			err = Permanent(err)
+		default:
+			err = Transient(err)
+		}
+		return message, err
+	}
+	message.Data = data
+	message.ClaimCheck = ""
+
+	return message, nil
+}
+
+// releaseClaimCheck removes the claim check data from the store
+func releaseClaimCheck(conf Config, claimCheck string) error {
+	if claimCheck == "" || conf.ClaimCheckStore == nil {
+		return nil
+	}
+	if err := conf.ClaimCheckStore.Delete(claimCheck); err != nil {
+		return fmt.Errorf("deleting claim check %s failed: %w", claimCheck, err)
+	}
+	return nil
+}
+
+// newClaimCheckKey creates a random claim check key for the stream
+func newClaimCheckKey(stream StreamName) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("creating claim check key failed: %w", err)
+	}
+	return fmt.Sprintf("%s-%s", stream, hex.EncodeToString(random)), nil
+}
@@ -0,0 +1,106 @@
+// Command fhirhose-status prints the processing status of an identifier recorded in the status stream
+// the status stream is only read, it has to be created by fhirhose
+//
+//	fhirhose-status [-server nats://localhost:4222] [-stream fhirhose_status] [-creds file] [-nkey file]
+//		[-tlscert file -tlskey file] [-tlsca file] <stream> <identifier>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose"
+)
+
+// connectFlags flags of the options used to connect to the NATS server
+type connectFlags struct {
+	creds   string
+	nkey    string
+	tlsCert string
+	tlsKey  string
+	tlsCA   string
+}
+
+func main() {
+	server := flag.String("server", nats.DefaultURL, "NATS server url")
+	statusStream := flag.String("stream", fhirhose.DefaultStatusStream, "JetStream stream containing the processing status records")
+	var connect connectFlags
+	flag.StringVar(&connect.creds, "creds", "", "user credentials file")
+	flag.StringVar(&connect.nkey, "nkey", "", "nkey seed file")
+	flag.StringVar(&connect.tlsCert, "tlscert", "", "TLS client certificate file")
+	flag.StringVar(&connect.tlsKey, "tlskey", "", "TLS client key file")
+	flag.StringVar(&connect.tlsCA, "tlsca", "", "TLS certificate authority file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <stream> <identifier>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	options, err := connect.options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := printStatus(*server, options, *statusStream, fhirhose.StreamName(flag.Arg(0)), flag.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// options creates the NATS connect options of the flags
+func (f connectFlags) options() ([]nats.Option, error) {
+	options := []nats.Option{nats.Name("fhirhose-status")}
+	if f.creds != "" {
+		options = append(options, nats.UserCredentials(f.creds))
+	}
+	if f.nkey != "" {
+		option, err := nats.NkeyOptionFromSeed(f.nkey)
+		if err != nil {
+			return nil, fmt.Errorf("loading nkey seed %s failed: %w", f.nkey, err)
+		}
+		options = append(options, option)
+	}
+	if (f.tlsCert == "") != (f.tlsKey == "") {
+		return nil, fmt.Errorf("-tlscert and -tlskey must be given together")
+	}
+	if f.tlsCert != "" {
+		options = append(options, nats.ClientCert(f.tlsCert, f.tlsKey))
+	}
+	if f.tlsCA != "" {
+		options = append(options, nats.RootCAs(f.tlsCA))
+	}
+	return options, nil
+}
+
+// printStatus prints the processing status of the identifier as json
+func printStatus(server string, options []nats.Option, statusStream string, stream fhirhose.StreamName, identifier string) error {
+	conn, err := nats.Connect(server, options...)
+	if err != nil {
+		return fmt.Errorf("connecting to %s failed: %w", server, err)
+	}
+	defer conn.Close()
+
+	store, err := fhirhose.LoadJetStreamStatusStore(conn, statusStream)
+	if err != nil {
+		return err
+	}
+	status, err := fhirhose.GetStatus(store, stream, identifier)
+	if err != nil {
+		return err
+	}
+	if len(status.Stages) == 0 {
+		return fmt.Errorf("no processing status of %s in stream %s", identifier, stream)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(status)
+}
@@ -0,0 +1,331 @@
+package fhirhose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DefaultInProgressInterval default interval in which consumed messages are kept in progress while a stage runs
+	DefaultInProgressInterval = time.Second * 10
+	// DefaultMaxAbandonedRuns default amount of adapted stream functions per stage which may keep running after their deadline
+	DefaultMaxAbandonedRuns = 10
+)
+
+var (
+	// ErrStageTimeout err returned when a stage didn't finish within the stage timeout
+	ErrStageTimeout = errors.New("stage timed out")
+	// ErrShutdown err returned when a stage is cancelled by the shutdown of the client
+	ErrShutdown = errors.New("client shut down")
+	// ErrCancelled err returned when a stage is cancelled by its caller, e.g. a poll after the poll lease is lost
+	ErrCancelled = errors.New("stage cancelled")
+	// ErrAbandonedRuns err returned when too many adapted stream functions of a stage still run after their deadline
+	ErrAbandonedRuns = errors.New("too many abandoned runs")
+)
+
+// IContextStream interface containing context aware stream functions
+// the context is cancelled when the stage timeout passed or the client shuts down
+type IContextStream interface {
+	GetStreamName() (streamName StreamName)
+	PollContext(ctx context.Context) (inputMessages []StreamMessage, customLoad bool, outputError error)
+	RetrieveContext(ctx context.Context, inputMessage StreamMessage) (outputMessage StreamMessage, error error)
+	TransformContext(ctx context.Context, inputMessage StreamMessage) (outputMessage StreamMessage, error error)
+	UploadContext(ctx context.Context, inputMessage StreamMessage) (outputMessage StreamMessage, shouldUpload bool, error error)
+}
+
+// ContextAdapter adapts an IStream to IContextStream
+// only IContextStream implementations can be cancelled, an adapted stream function keeps running in the background
+// when the context is cancelled while the stage returns immediately
+// at most MaxAbandonedRuns of these abandoned runs exist per stage, further runs fail transiently until they return
+// the message of an abandoned run isn't redelivered before the run returned
+type ContextAdapter struct {
+	IStream
+}
+
+// WithContext returns the context aware functions of the stream, streams without them are adapted
+func WithContext(stream IStream) IContextStream {
+	if contextStream, ok := stream.(IContextStream); ok {
+		return contextStream
+	}
+	return ContextAdapter{IStream: stream}
+}
+
+// PollContext polls the stream until the context is cancelled
+func (a ContextAdapter) PollContext(ctx context.Context) ([]StreamMessage, bool, error) {
+	type pollResult struct {
+		messages   []StreamMessage
+		customLoad bool
+	}
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		messages, customLoad, err := a.Poll()
+		return pollResult{messages: messages, customLoad: customLoad}, err
+	})
+	polled, _ := result.(pollResult)
+	return polled.messages, polled.customLoad, err
+}
+
+// RetrieveContext retrieves the message until the context is cancelled
+func (a ContextAdapter) RetrieveContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return a.Retrieve(message)
+	})
+	updated, _ := result.(StreamMessage)
+	return updated, err
+}
+
+// TransformContext transforms the message until the context is cancelled
+func (a ContextAdapter) TransformContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		return a.Transform(message)
+	})
+	updated, _ := result.(StreamMessage)
+	return updated, err
+}
+
+// UploadContext uploads the message until the context is cancelled
+func (a ContextAdapter) UploadContext(ctx context.Context, message StreamMessage) (StreamMessage, bool, error) {
+	type uploadResult struct {
+		updated      StreamMessage
+		shouldUpload bool
+	}
+	result, err := runWithContext(ctx, func() (interface{}, error) {
+		updated, shouldUpload, err := a.Upload(message)
+		return uploadResult{updated: updated, shouldUpload: shouldUpload}, err
+	})
+	uploaded, _ := result.(uploadResult)
+	return uploaded.updated, uploaded.shouldUpload, err
+}
+
+// StreamAdapter adapts an IContextStream to IStream so it can be registered as stream of the client
+// the client calls the context aware functions, the IStream functions run without deadline
+type StreamAdapter struct {
+	IContextStream
+}
+
+// Poll polls the stream without deadline
+func (a StreamAdapter) Poll() ([]StreamMessage, bool, error) {
+	return a.PollContext(context.Background())
+}
+
+// Retrieve retrieves the message without deadline
+func (a StreamAdapter) Retrieve(message StreamMessage) (StreamMessage, error) {
+	return a.RetrieveContext(context.Background(), message)
+}
+
+// Transform transforms the message without deadline
+func (a StreamAdapter) Transform(message StreamMessage) (StreamMessage, error) {
+	return a.TransformContext(context.Background(), message)
+}
+
+// Upload uploads the message without deadline
+func (a StreamAdapter) Upload(message StreamMessage) (StreamMessage, bool, error) {
+	return a.UploadContext(context.Background(), message)
+}
+
+// abandonedRunsKey context key of the abandoned runs of the stage
+type abandonedRunsKey struct{}
+
+// abandonedRuns adapted stream functions of a stage which kept running after their context was cancelled
+type abandonedRuns struct {
+	mu      sync.Mutex
+	running int
+	limit   int
+}
+
+// full reports if no more runs may be abandoned, nil runs are never full
+func (a *abandonedRuns) full() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.running >= a.limit
+}
+
+// abandon counts the run as abandoned until it returned
+func (a *abandonedRuns) abandon(returned <-chan struct{}) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.running++
+	a.mu.Unlock()
+
+	go func() {
+		<-returned
+		a.mu.Lock()
+		a.running--
+		a.mu.Unlock()
+	}()
+}
+
+// abandonedError error of a stage of which the stream function kept running after its context was cancelled
+type abandonedError struct {
+	err error
+	// returned is closed once the stream function returned
+	returned <-chan struct{}
+}
+
+// Error returns the error of the stage
+func (e *abandonedError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the stage
+func (e *abandonedError) Unwrap() error {
+	return e.err
+}
+
+// runResult result of a function run by runWithContext
+type runResult struct {
+	value interface{}
+	err   error
+}
+
+// runWithContext runs the function in the background and returns its result, or early when the context is cancelled
+// the result is only passed through the done channel so an abandoned function never writes values of the caller
+// the abandoned function is tracked in the abandoned runs of the stage, see ContextAdapter
+func runWithContext(ctx context.Context, run func() (interface{}, error)) (interface{}, error) {
+	runs, _ := ctx.Value(abandonedRunsKey{}).(*abandonedRuns)
+	if runs.full() {
+		return nil, Transient(fmt.Errorf("%w: %d runs still running after their deadline", ErrAbandonedRuns, runs.limit))
+	}
+
+	done := make(chan runResult, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		// A panic of the background goroutine can't be recovered by the stage
+		var value interface{}
+		err := recovered(func() (err error) {
+			value, err = run()
+			return err
+		})
+		done <- runResult{value: value, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		runs.abandon(returned)
+		return nil, &abandonedError{err: ctx.Err(), returned: returned}
+	}
+}
+
+// runStage runs the stage of the stream with the stage timeout and cancels it when the client shuts down
+// a panic of the stage is recovered and returned as PanicError
+// the consumed message is kept in progress while the stage runs so it isn't redelivered to another worker
+func runStage(conf Config, stream StreamName, action ActionName, msg *nats.Msg, run func(ctx context.Context) error) error {
+	return runStageContext(conf.control.context(), conf, stream, action, msg, run)
+}
+
+// runStageContext runs the stage like runStage and cancels it when the parent context is done
+// the parent has to be derived from the context of the controller
+func runStageContext(parent context.Context, conf Config, stream StreamName, action ActionName, msg *nats.Msg, run func(ctx context.Context) error) error {
+	ctx := context.WithValue(parent, abandonedRunsKey{}, conf.control.abandonedRuns(conf, stream, action))
+	timeout := conf.getStageTimeout(action)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if msg != nil {
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			keepInProgress(conf, msg, done)
+		}()
+		// The message is acknowledged after the stage, never in progress afterwards
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+	}
+
+	err := recovered(func() error { return run(ctx) })
+	if err == nil {
+		return nil
+	}
+	var abandoned *abandonedError
+	if errors.As(err, &abandoned) {
+		conf.logger().WithFields(Fields{"resource": stream, "action": action}).Warn("abandoned stream function still running after its deadline")
+		count(conf, stream, action, "abandoned", 1)
+	}
+	switch {
+	case errors.Is(err, ErrPanic):
+		reportPanic(conf, stream, action, err)
+		return err
+	case conf.control.context().Err() != nil:
+		return fmt.Errorf("%w: %s of %s cancelled", ErrShutdown, action, stream)
+	case parent.Err() != nil:
+		return fmt.Errorf("%w: %s of %s", ErrCancelled, action, stream)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		count(conf, stream, action, "timeouts", 1)
+		err = fmt.Errorf("%w: %s of %s after %s", ErrStageTimeout, action, stream, timeout)
+		if abandoned != nil {
+			// The message is redelivered once the abandoned run returned
+			return &abandonedError{err: err, returned: abandoned.returned}
+		}
+		return err
+	}
+	return err
+}
+
+// keepInProgress acknowledges the message as in progress every in progress interval until done is closed
+func keepInProgress(conf Config, msg *nats.Msg, done <-chan struct{}) {
+	ticker := time.NewTicker(conf.getInProgressInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := pubsub.InProgress(conf.PubSub, msg); err != nil {
+				conf.logger().WithError(err).Warn("can't keep message in progress")
+			}
+		}
+	}
+}
+
+// redeliverOnShutdown negatively acknowledges the message when the client shuts down so another instance handles it
+// returns true when the message is handed back
+func redeliverOnShutdown(conf Config, msg *nats.Msg) bool {
+	if conf.control.context().Err() == nil {
+		return false
+	}
+
+	negativeAcknowledge(conf, msg)
+	return true
+}
+
+// getStageTimeout returns the configured timeout of the stage, 0 runs the stage without timeout
+func (c Config) getStageTimeout(action ActionName) time.Duration {
+	return c.StageTimeouts[action]
+}
+
+// getMaxAbandonedRuns returns the configured max abandoned runs or the default
+func (c Config) getMaxAbandonedRuns() int {
+	if c.MaxAbandonedRuns > 0 {
+		return c.MaxAbandonedRuns
+	}
+	return DefaultMaxAbandonedRuns
+}
+
+// getInProgressInterval returns the configured in progress interval or the default
+func (c Config) getInProgressInterval() time.Duration {
+	if c.InProgressInterval > 0 {
+		return c.InProgressInterval
+	}
+	return DefaultInProgressInterval
+}
@@ -0,0 +1,337 @@
+package fhirhose
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// pausedCheckInterval interval in which paused stages check if they are resumed
+const pausedCheckInterval = time.Second * 5
+
+// StreamState runtime state of a stream
+type StreamState struct {
+	Name StreamName `json:"name"`
+	// Paused actions of the stream, PollAction pauses polling
+	Paused []ActionName `json:"paused"`
+	// LastPoll time of the last finished poll
+	LastPoll *time.Time `json:"lastPoll,omitempty"`
+	// LastPollChanges amount of messages returned by the last poll
+	LastPollChanges int `json:"lastPollChanges"`
+	// Backpressure polling is skipped because the downstream consumers lag
+	Backpressure bool `json:"backpressure"`
+	// Pending messages of the downstream consumers at the last backpressure check
+	Pending uint64 `json:"pending"`
+	// Consumers supervised consumers of the stream
+	Consumers []ConsumerState `json:"consumers"`
+}
+
+// ConsumerState runtime state of a supervised consumer
+type ConsumerState struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	// Restarts amount of times the consumer failed and was restarted
+	Restarts int `json:"restarts"`
+	// LastError error of the last failure
+	LastError string `json:"lastError,omitempty"`
+	// LastFailure time of the last failure
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+}
+
+// streamControl runtime control of a single stream
+type streamControl struct {
+	mu              sync.Mutex
+	paused          map[ActionName]bool
+	resumed         chan struct{}
+	trigger         chan struct{}
+	lastPoll        time.Time
+	lastPollChanges int
+	throttled       bool
+	pending         uint64
+	consumers       map[string]*ConsumerState
+}
+
+// controller runtime control of all streams of a client
+// a nil controller never pauses, never triggers and never shuts down
+type controller struct {
+	streams   map[StreamName]*streamControl
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	circuits  map[string]*circuit
+	abandoned map[string]*abandonedRuns
+}
+
+// newController creates a controller for the streams
+func newController(streams []IStream) *controller {
+	c := &controller{streams: make(map[StreamName]*streamControl), circuits: make(map[string]*circuit), abandoned: make(map[string]*abandonedRuns)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for _, stream := range streams {
+		c.streams[stream.GetStreamName()] = &streamControl{
+			paused:    make(map[ActionName]bool),
+			resumed:   make(chan struct{}),
+			trigger:   make(chan struct{}, 1),
+			consumers: make(map[string]*ConsumerState),
+		}
+	}
+	return c
+}
+
+// get returns the control of the stream
+func (c *controller) get(stream StreamName) *streamControl {
+	if c == nil {
+		return nil
+	}
+	return c.streams[stream]
+}
+
+// context returns the context of the client which is cancelled on shutdown
+func (c *controller) context() context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// shutdown cancels the context of the client
+func (c *controller) shutdown() {
+	if c != nil {
+		c.cancel()
+	}
+}
+
+// circuit returns the circuit breaker shared by all workers, nil when the circuit isn't configured
+func (c *controller) circuit(conf Config, name string) *circuit {
+	breaker, ok := conf.CircuitBreakers[name]
+	if c == nil || !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.circuits[name]; !ok {
+		c.circuits[name] = &circuit{name: name, breaker: breaker, state: CircuitClosed}
+	}
+	return c.circuits[name]
+}
+
+// abandonedRuns returns the abandoned runs of the stage of the stream, nil without controller
+func (c *controller) abandonedRuns(conf Config, stream StreamName, action ActionName) *abandonedRuns {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := GetCircuitName(stream, action)
+	if _, ok := c.abandoned[name]; !ok {
+		c.abandoned[name] = &abandonedRuns{limit: conf.getMaxAbandonedRuns()}
+	}
+	return c.abandoned[name]
+}
+
+// setPaused pauses or resumes the action of the stream
+func (c *controller) setPaused(stream StreamName, action ActionName, paused bool) bool {
+	s := c.get(stream)
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if paused {
+		s.paused[action] = true
+	} else if s.paused[action] {
+		delete(s.paused, action)
+		close(s.resumed)
+		s.resumed = make(chan struct{})
+	}
+	return true
+}
+
+// isPaused reports if the action of the stream is paused
+func (c *controller) isPaused(stream StreamName, action ActionName) bool {
+	s := c.get(stream)
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paused[action]
+}
+
+// waitWhilePaused blocks while the action of the stream is paused
+// the message gets in progress acknowledgements so it isn't redelivered while waiting
+func (c *controller) waitWhilePaused(stream StreamName, action ActionName, client pubsub.IPubSubClient, msg *nats.Msg) {
+	s := c.get(stream)
+	if s == nil {
+		return
+	}
+
+	for {
+		s.mu.Lock()
+		paused := s.paused[action]
+		resumed := s.resumed
+		s.mu.Unlock()
+		if !paused {
+			return
+		}
+
+		select {
+		case <-resumed:
+		case <-time.After(pausedCheckInterval):
+			if msg != nil {
+				_ = pubsub.InProgress(client, msg)
+			}
+		}
+	}
+}
+
+// triggerPoll requests an immediate poll of the stream
+func (c *controller) triggerPoll(stream StreamName) bool {
+	s := c.get(stream)
+	if s == nil {
+		return false
+	}
+
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// A poll is already requested
+	}
+	return true
+}
+
+// triggered returns the channel receiving poll requests of the stream
+func (c *controller) triggered(stream StreamName) <-chan struct{} {
+	s := c.get(stream)
+	if s == nil {
+		return nil
+	}
+	return s.trigger
+}
+
+// polled records the result of a poll of the stream
+func (c *controller) polled(stream StreamName, changes int) {
+	s := c.get(stream)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastPoll = time.Now()
+	s.lastPollChanges = changes
+}
+
+// isThrottled reports if polling of the stream is skipped for backpressure
+func (c *controller) isThrottled(stream StreamName) bool {
+	s := c.get(stream)
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.throttled
+}
+
+// setBackpressure records the result of a backpressure check of the stream
+func (c *controller) setBackpressure(stream StreamName, throttled bool, pending uint64) {
+	s := c.get(stream)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled = throttled
+	s.pending = pending
+}
+
+// consumerStarted records the (re)start of a consumer of the stream
+func (c *controller) consumerStarted(stream StreamName, consumer string) {
+	s := c.get(stream)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, found := s.consumers[consumer]
+	if !found {
+		state = &ConsumerState{Name: consumer}
+		s.consumers[consumer] = state
+	}
+	state.Running = true
+}
+
+// consumerStopped records the stop of a consumer of the stream and returns the amount of restarts
+// a consumer stopping with an error is counted as a restart
+func (c *controller) consumerStopped(stream StreamName, consumer string, err error) int {
+	s := c.get(stream)
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, found := s.consumers[consumer]
+	if !found {
+		state = &ConsumerState{Name: consumer}
+		s.consumers[consumer] = state
+	}
+	state.Running = false
+	if err != nil {
+		now := time.Now()
+		state.Restarts++
+		state.LastError = err.Error()
+		state.LastFailure = &now
+	}
+	return state.Restarts
+}
+
+// state returns the runtime state of the stream
+func (c *controller) state(stream StreamName) (StreamState, bool) {
+	s := c.get(stream)
+	if s == nil {
+		return StreamState{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := StreamState{Name: stream, Paused: []ActionName{}, LastPollChanges: s.lastPollChanges, Backpressure: s.throttled, Pending: s.pending}
+	for _, action := range []ActionName{PollAction, DebounceAction, RetrieveAction, TransformAction, UploadAction} {
+		if s.paused[action] {
+			state.Paused = append(state.Paused, action)
+		}
+	}
+	if !s.lastPoll.IsZero() {
+		lastPoll := s.lastPoll
+		state.LastPoll = &lastPoll
+	}
+	state.Consumers = make([]ConsumerState, 0, len(s.consumers))
+	for _, consumer := range s.consumers {
+		state.Consumers = append(state.Consumers, *consumer)
+	}
+	sort.Slice(state.Consumers, func(i, j int) bool {
+		return state.Consumers[i].Name < state.Consumers[j].Name
+	})
+	return state, true
+}
@@ -0,0 +1,202 @@
+package fhirhose
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// Debouncers creates a debouncer with WorkerAmount subscribers for each stream
+// polled messages are held until no newer version arrived within the quiet period
+// the subscribers of a stream share its debouncer so every update of an identifier is coalesced
+func (c *Register) Debouncers(conf Config, streams []IStream, errChan *chan Error) {
+	for _, stream := range streams {
+		d := newDebouncer(conf, stream)
+		go d.flushOnInterval()
+		for i := 0; i < conf.WorkerAmount || i == 0; i++ {
+			go handleDebounce(d, stream, conf, errChan)
+		}
+	}
+}
+
+// debouncedMessage message held by the debouncer
+type debouncedMessage struct {
+	msg       *nats.Msg
+	message   StreamMessage
+	lastSeen  time.Time
+	coalesced int
+}
+
+// debouncer holds the latest polled message per identifier
+// held messages stay unacknowledged in JetStream so the hold survives restarts
+type debouncer struct {
+	conf    Config
+	stream  IStream
+	mu      sync.Mutex
+	pending map[string]*debouncedMessage
+}
+
+// newDebouncer creates a new debouncer for a stream
+func newDebouncer(conf Config, stream IStream) *debouncer {
+	return &debouncer{
+		conf:    conf,
+		stream:  stream,
+		pending: make(map[string]*debouncedMessage),
+	}
+}
+
+// add holds the message, an older held message with the same identifier is acknowledged and dropped
+func (d *debouncer) add(msg *nats.Msg, message StreamMessage, now time.Time) {
+	d.hold(&debouncedMessage{msg: msg, message: message, lastSeen: now})
+}
+
+// hold holds the message unless a newer message with the same identifier is held
+// the older of both messages is acknowledged and dropped
+func (d *debouncer) hold(held *debouncedMessage) {
+	d.mu.Lock()
+	older := d.pending[held.message.Identifier]
+	if older != nil {
+		newer := held
+		if held.lastSeen.Before(older.lastSeen) {
+			older, newer = held, older
+		}
+		newer.coalesced += older.coalesced + 1
+		held = newer
+	}
+	d.pending[held.message.Identifier] = held
+	d.mu.Unlock()
+
+	if older != nil {
+		acknowledge(d.conf, older.msg)
+		if err := releaseClaimCheck(d.conf, older.message.ClaimCheck); err != nil {
+			d.conf.logger().WithError(err).Error("can't release claim check")
+		}
+	}
+}
+
+// take removes the held messages which have been quiet for the quiet period and returns them with the messages still held
+func (d *debouncer) take(now time.Time) (quiet []*debouncedMessage, held []*debouncedMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for identifier, message := range d.pending {
+		if now.Sub(message.lastSeen) < d.conf.DebounceQuietPeriod {
+			held = append(held, message)
+			continue
+		}
+		quiet = append(quiet, message)
+		delete(d.pending, identifier)
+	}
+	return quiet, held
+}
+
+// flush publishes all held messages which have been quiet for the quiet period
+// messages which are still held get an in progress acknowledgement
+// publishing happens outside the lock so consumers can keep adding messages
+func (d *debouncer) flush(now time.Time) {
+	quiet, held := d.take(now)
+	for _, message := range held {
+		if err := pubsub.InProgress(d.conf.PubSub, message.msg); err != nil {
+			d.conf.logger().WithError(err).Debug("can't extend acknowledgement of held message")
+		}
+	}
+
+	for _, message := range quiet {
+		if err := d.publish(message); err != nil {
+			// Keep holding the message and retry on the next flush
+			d.conf.logger().WithError(err).Error("can't publish new event")
+			d.hold(message)
+			continue
+		}
+
+		acknowledge(d.conf, message.msg)
+
+		d.conf.logger().WithFields(Fields{
+			"id":        message.message.Identifier,
+			"coalesced": message.coalesced,
+		}).Info("debounced item")
+		count(d.conf, d.stream.GetStreamName(), DebounceAction, "forwarded", 1)
+		count(d.conf, d.stream.GetStreamName(), DebounceAction, "coalesced", int64(message.coalesced))
+	}
+}
+
+// publish publishes the held message onto the debounced subject
+func (d *debouncer) publish(held *debouncedMessage) error {
+	messageBytes, err := json.Marshal(&held.message)
+	if err != nil {
+		return err
+	}
+
+	// The message id header of the polled message isn't copied, JetStream would drop the message as duplicate
+	actionString := GetPublishAction(held.message.Identifier, d.stream.GetStreamName(), d.conf.GetConsumerPrefix(), DebounceAction)
+	publishMsg := nats.NewMsg(actionString)
+	publishMsg.Data = messageBytes
+	for _, header := range []string{IdentifierHeader, EncryptionKeyIDHeader} {
+		if value := held.msg.Header.Get(header); value != "" {
+			publishMsg.Header.Set(header, value)
+		}
+	}
+	return d.conf.PubSub.PublishMsg(publishMsg)
+}
+
+// flushOnInterval flushes the debouncer until shutdown, see getDebounceFlushInterval
+func (d *debouncer) flushOnInterval() {
+	ticker := time.NewTicker(d.conf.getDebounceFlushInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.flush(now)
+		case <-d.conf.control.context().Done():
+			return
+		}
+	}
+}
+
+// handleDebounce handles the debounce action, adding consumed messages to the debouncer of the stream
+func handleDebounce(d *debouncer, stream IStream, conf Config, errChan *chan Error) {
+	// Consume from polled consumer, custom loads skip the debouncer
+	consumerString := conf.GetConsumerName(stream.GetStreamName(), conf.GetConsumerPrefix(), PollAction)
+	consume(conf, stream.GetStreamName(), DebounceAction, consumerString, errChan, func(msg *nats.Msg) {
+		conf.control.waitWhilePaused(stream.GetStreamName(), DebounceAction, conf.PubSub, msg)
+
+		var message StreamMessage
+		if err := json.Unmarshal(msg.Data, &message); err != nil {
+			// Messages which can't be read never succeed, dead letter them instead of holding them without identifier
+			settleFailure(conf, stream.GetStreamName(), DebounceAction, msg, nil, Permanent(fmt.Errorf("can't unmarshal message: %w", err)), errChan)
+			return
+		}
+
+		d.add(msg, message, time.Now())
+	})
+}
+
+// getDebounceFlushInterval returns the interval in which the debouncer flushes
+// flushes twice per quiet period so held messages are forwarded at most half a period late
+// and at least every in progress interval so held messages aren't redelivered while they are held
+func (c Config) getDebounceFlushInterval() time.Duration {
+	interval := c.DebounceQuietPeriod / 2
+	if interval <= 0 {
+		interval = c.DebounceQuietPeriod
+	}
+	if inProgress := c.getInProgressInterval(); inProgress < interval {
+		interval = inProgress
+	}
+	return interval
+}
+
+// getRetrieveSourceAction returns the action retrievers consume from
+// regular polls go through the debouncer when a quiet period is configured
+func getRetrieveSourceAction(conf Config, prefix ConsumerPrefix) ActionName {
+	if conf.DebounceQuietPeriod > 0 && prefix == conf.GetConsumerPrefix() {
+		return DebounceAction
+	}
+
+	return PollAction
+}
@@ -0,0 +1,83 @@
+package fhirhose
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IDeduplicationCache interface containing functions to remember published message ids
+// used to deduplicate messages across polls for windows longer than the JetStream duplicate window
+type IDeduplicationCache interface {
+	Exists(messageID string) bool
+	Add(messageID string)
+}
+
+// MemoryDeduplicationCache in memory deduplication cache which forgets message ids after the window
+type MemoryDeduplicationCache struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]*list.Element
+	// added message ids ordered by the time they were added, oldest first
+	added *list.List
+}
+
+// addedMessageID message id added to the deduplication cache
+type addedMessageID struct {
+	messageID string
+	added     time.Time
+}
+
+// NewMemoryDeduplicationCache creates a new in memory deduplication cache
+func NewMemoryDeduplicationCache(window time.Duration) *MemoryDeduplicationCache {
+	return &MemoryDeduplicationCache{
+		window: window,
+		seen:   make(map[string]*list.Element),
+		added:  list.New(),
+	}
+}
+
+// Exists checks if the message id has been added within the window
+func (c *MemoryDeduplicationCache) Exists(messageID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(time.Now())
+	_, found := c.seen[messageID]
+	return found
+}
+
+// Add adds the message id to the cache and removes expired message ids
+func (c *MemoryDeduplicationCache) Add(messageID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	if element, found := c.seen[messageID]; found {
+		c.added.Remove(element)
+	}
+	c.seen[messageID] = c.added.PushBack(addedMessageID{messageID: messageID, added: now})
+}
+
+// expire removes the message ids added before the window, only the expired ids are visited
+func (c *MemoryDeduplicationCache) expire(now time.Time) {
+	for element := c.added.Front(); element != nil; element = c.added.Front() {
+		added := element.Value.(addedMessageID)
+		if now.Sub(added.added) <= c.window {
+			return
+		}
+		c.added.Remove(element)
+		delete(c.seen, added.messageID)
+	}
+}
+
+// GetMessageID creates the message id used for deduplication based on the identifier and version
+// or a hash of the data when the version is empty, so a change of the data is never dropped as duplicate
+func GetMessageID(stream StreamName, message StreamMessage) string {
+	if message.Version != "" {
+		return fmt.Sprintf("%s.%s.%s", stream, message.Identifier, message.Version)
+	}
+	return fmt.Sprintf("%s.%s.%s", stream, message.Identifier, getContentHash(message.Data))
+}
@@ -0,0 +1,221 @@
+package fhirhose
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptionKeyIDHeader header containing the id of the key used to encrypt the message
+const EncryptionKeyIDHeader = "Fhirhose-Key-Id"
+
+var (
+	// ErrEncrypt err returned when encrypting a message failed
+	ErrEncrypt = errors.New("encrypting message failed")
+	// ErrDecrypt err returned when decrypting a message failed
+	ErrDecrypt = errors.New("decrypting message failed")
+	// ErrUnknownKey err returned when the key provider doesn't know the key id
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// IKeyProvider interface containing functions to get key encryption keys
+type IKeyProvider interface {
+	// CurrentKey returns the key used to encrypt new messages
+	CurrentKey() (keyID string, key []byte, err error)
+	// Key returns the key with the given id, used to decrypt messages
+	Key(keyID string) (key []byte, err error)
+}
+
+// Encryption envelope of an encrypted message
+type Encryption struct {
+	// KeyID id of the key encryption key
+	KeyID string
+	// EncryptedKey data encryption key encrypted with the key encryption key
+	EncryptedKey []byte
+	// Description is set when the description is encrypted
+	Description bool `json:",omitempty"`
+}
+
+// EnvKeyProvider key provider reading base64 encoded 256 bit keys from environment variables
+// the current key id is read from <Prefix>ID and every key from <Prefix><key id>
+type EnvKeyProvider struct {
+	Prefix string
+}
+
+// NewEnvKeyProvider creates a new environment key provider with the default FHIRHOSE_KEY_ prefix
+func NewEnvKeyProvider() *EnvKeyProvider {
+	return &EnvKeyProvider{Prefix: "FHIRHOSE_KEY_"}
+}
+
+// CurrentKey returns the key of the id in <Prefix>ID
+func (p *EnvKeyProvider) CurrentKey() (string, []byte, error) {
+	keyID := os.Getenv(p.Prefix + "ID")
+	if keyID == "" {
+		return "", nil, fmt.Errorf("%w: %sID is not set", ErrUnknownKey, p.Prefix)
+	}
+	key, err := p.Key(keyID)
+	return keyID, key, err
+}
+
+// Key returns the key in <Prefix><key id>
+func (p *EnvKeyProvider) Key(keyID string) ([]byte, error) {
+	encoded, found := os.LookupEnv(p.Prefix + keyID)
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return decodeKey(encoded)
+}
+
+// FileKeyProvider key provider reading base64 encoded 256 bit keys from files in a directory
+// every file name is a key id, the current key id is read from the file named current
+type FileKeyProvider struct {
+	Dir string
+}
+
+// CurrentKey returns the key of the id in the current file
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	keyID, err := ioutil.ReadFile(filepath.Join(p.Dir, "current"))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: reading current key id failed: %v", ErrUnknownKey, err)
+	}
+	key, err := p.Key(strings.TrimSpace(string(keyID)))
+	return strings.TrimSpace(string(keyID)), key, err
+}
+
+// Key returns the key in the file named after the key id
+func (p *FileKeyProvider) Key(keyID string) ([]byte, error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(p.Dir, filepath.Base(keyID)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnknownKey, keyID, err)
+	}
+	return decodeKey(strings.TrimSpace(string(encoded)))
+}
+
+// decodeKey decodes a base64 encoded 256 bit key
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key failed: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// encryptMessage encrypts the data and optionally the description with a new data encryption key
+func encryptMessage(conf Config, message StreamMessage) (StreamMessage, error) {
+	keyID, kek, err := conf.KeyProvider.CurrentKey()
+	if err != nil {
+		return message, fmt.Errorf("%w: %v", ErrEncrypt, err)
+	}
+
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return message, fmt.Errorf("%w: creating data key failed: %v", ErrEncrypt, err)
+	}
+
+	encryptedKey, err := seal(kek, dek)
+	if err != nil {
+		return message, fmt.Errorf("%w: %v", ErrEncrypt, err)
+	}
+	message.Data, err = seal(dek, message.Data)
+	if err != nil {
+		return message, fmt.Errorf("%w: %v", ErrEncrypt, err)
+	}
+
+	message.Encryption = &Encryption{KeyID: keyID, EncryptedKey: encryptedKey}
+	if conf.EncryptDescription {
+		description, err := seal(dek, []byte(message.Description))
+		if err != nil {
+			return message, fmt.Errorf("%w: %v", ErrEncrypt, err)
+		}
+		message.Description = base64.StdEncoding.EncodeToString(description)
+		message.Encryption.Description = true
+	}
+
+	return message, nil
+}
+
+// decryptMessage reverses encryptMessage
+// key provider failures are transient, messages which fail authentication or are malformed permanent
+func decryptMessage(conf Config, message StreamMessage) (StreamMessage, error) {
+	if conf.KeyProvider == nil {
+		return message, Permanent(fmt.Errorf("%w: no key provider configured", ErrDecrypt))
+	}
+
+	kek, err := conf.KeyProvider.Key(message.Encryption.KeyID)
+	if err != nil {
+		// The key provider may be unavailable or not know a rotated key yet
+		err = fmt.Errorf("%w: %v", ErrDecrypt, err)
+		if classify(err) == nil {
+			err = Transient(err)
+		}
+		return message, err
+	}
+	dek, err := open(kek, message.Encryption.EncryptedKey)
+	if err != nil {
+		return message, Permanent(fmt.Errorf("%w: opening data key with key %s failed: %v", ErrDecrypt, message.Encryption.KeyID, err))
+	}
+	message.Data, err = open(dek, message.Data)
+	if err != nil {
+		return message, Permanent(fmt.Errorf("%w: %v", ErrDecrypt, err))
+	}
+
+	if message.Encryption.Description {
+		encrypted, err := base64.StdEncoding.DecodeString(message.Description)
+		if err != nil {
+			return message, Permanent(fmt.Errorf("%w: %v", ErrDecrypt, err))
+		}
+		description, err := open(dek, encrypted)
+		if err != nil {
+			return message, Permanent(fmt.Errorf("%w: %v", ErrDecrypt, err))
+		}
+		message.Description = string(description)
+	}
+
+	message.Encryption = nil
+	return message, nil
+}
+
+// seal encrypts the plaintext with AES-GCM, the nonce is prepended to the ciphertext
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a ciphertext created by seal
+func open(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+// newGCM creates an AES-GCM cipher for the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
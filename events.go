@@ -0,0 +1,101 @@
+package fhirhose
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// EventSchemaVersion version of the PipelineEvent schema, see schema/event.v1.json
+	// incremented on every incompatible change of the schema
+	EventSchemaVersion = 1
+	// FailedAction event use as base failed streaming subject
+	FailedAction ActionName = "failed"
+	// FilteredAction event use as base filtered streaming subject
+	FilteredAction ActionName = "filtered"
+)
+
+// PipelineEvent event published on prefix.stream.type.identifier when a message leaves the pipeline
+// UploadAction once uploaded, FailedAction once dropped or dead lettered and FilteredAction once skipped
+// messages redelivered after a transient failure don't publish an event
+type PipelineEvent struct {
+	Version    int        `json:"version"`
+	Type       ActionName `json:"type"`
+	Stream     StreamName `json:"stream"`
+	Identifier string     `json:"identifier"`
+	// Action stage which failed or filtered the message
+	Action ActionName `json:"action,omitempty"`
+	// Error error of a failed message
+	Error string `json:"error,omitempty"`
+	// Class class of the failure, empty for unclassified failures
+	Class string `json:"class,omitempty"`
+	// DeadLettered the failed message is published on the dead letter subject of the stream
+	DeadLettered bool `json:"deadLettered,omitempty"`
+	// Reason reason a message is filtered
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// publishEvent publishes the event of a message when events are enabled
+// events are best effort, a failed publish is logged and doesn't affect the message
+func publishEvent(conf Config, event PipelineEvent) {
+	if !conf.EventsEnabled {
+		return
+	}
+
+	event.Version = EventSchemaVersion
+	event.Time = time.Now().UTC()
+	logger := conf.logger().WithFields(Fields{"resource": event.Stream, "id": event.Identifier, "event": event.Type})
+	if err := ValidateIdentifier(event.Identifier); err != nil {
+		logger.WithError(err).Warn("can't publish event")
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Warn("can't publish event")
+		return
+	}
+	if err := conf.PubSub.Publish(GetPublishAction(event.Identifier, event.Stream, conf.GetConsumerPrefix(), event.Type), data); err != nil {
+		logger.WithError(err).Warn("can't publish event")
+	}
+}
+
+// publishFailed publishes the failed event of a message which is dropped or dead lettered
+func publishFailed(conf Config, stream StreamName, action ActionName, identifier string, err error, deadLettered bool) {
+	event := PipelineEvent{
+		Type:         FailedAction,
+		Stream:       stream,
+		Identifier:   identifier,
+		Action:       action,
+		Error:        err.Error(),
+		DeadLettered: deadLettered,
+	}
+	switch classify(err) {
+	case ErrPermanent:
+		event.Class = "permanent"
+	case ErrTransient:
+		event.Class = "transient"
+	}
+	publishEvent(conf, event)
+}
+
+// publishFiltered publishes the filtered event of a message which is skipped
+func publishFiltered(conf Config, stream StreamName, action ActionName, identifier string, reason string) {
+	publishEvent(conf, PipelineEvent{
+		Type:       FilteredAction,
+		Stream:     stream,
+		Identifier: identifier,
+		Action:     action,
+		Reason:     reason,
+	})
+}
+
+// publishUploaded publishes the uploaded event of a message
+func publishUploaded(conf Config, stream StreamName, identifier string) {
+	publishEvent(conf, PipelineEvent{
+		Type:       UploadAction,
+		Stream:     stream,
+		Identifier: identifier,
+	})
+}
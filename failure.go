@@ -0,0 +1,288 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DeadLetterAction event use as base dead letter streaming subject, the stream has to contain these subjects
+	DeadLetterAction ActionName = "deadletter"
+	// FailedActionHeader header of a dead letter containing the action which failed
+	FailedActionHeader = "Fhirhose-Failed-Action"
+	// FailureHeader header of a dead letter containing the error
+	FailureHeader = "Fhirhose-Failure"
+	// DefaultRedeliveryBackoff default wait before a message is redelivered after a transient failure, doubled on every next delivery
+	DefaultRedeliveryBackoff = time.Second
+	// DefaultMaxRedeliveryBackoff default maximum wait before a message is redelivered
+	DefaultMaxRedeliveryBackoff = time.Minute
+	// DefaultMaxDeliveries default amount of deliveries after which a transiently failing message is dead lettered
+	DefaultMaxDeliveries = 10
+)
+
+var (
+	// ErrTransient err of failures which may succeed later, e.g. an unavailable FHIR server, the message is redelivered
+	ErrTransient = errors.New("transient failure")
+	// ErrPermanent err of failures which never succeed, e.g. an invalid source record, the message is dead lettered
+	ErrPermanent = errors.New("permanent failure")
+	// ErrSkip err of intentionally filtered messages, the message is acknowledged and counted as filtered
+	ErrSkip = errors.New("skipped")
+)
+
+// TransientError wraps an error as transient failure
+type TransientError struct {
+	Err error
+}
+
+// Transient wraps the error as transient failure, the message is redelivered
+func Transient(err error) error {
+	return &TransientError{Err: err}
+}
+
+// Error returns the wrapped error
+func (e *TransientError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTransient, e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports if the target is ErrTransient
+func (e *TransientError) Is(target error) bool {
+	return target == ErrTransient
+}
+
+// PermanentError wraps an error as permanent failure
+type PermanentError struct {
+	Err error
+}
+
+// Permanent wraps the error as permanent failure, the message is dead lettered at once
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Error returns the wrapped error
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPermanent, e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports if the target is ErrPermanent
+func (e *PermanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// SkipError wraps the reason a message is intentionally filtered
+type SkipError struct {
+	Err error
+}
+
+// Skip wraps the reason as skip, the message is acknowledged silently and counted as filtered
+func Skip(reason error) error {
+	return &SkipError{Err: reason}
+}
+
+// Error returns the wrapped reason
+func (e *SkipError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrSkip, e.Err)
+}
+
+// Unwrap returns the wrapped reason
+func (e *SkipError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports if the target is ErrSkip
+func (e *SkipError) Is(target error) bool {
+	return target == ErrSkip
+}
+
+// classify returns ErrSkip, ErrPermanent or ErrTransient for classified errors and nil otherwise
+// panics are permanent and stage timeouts transient
+func classify(err error) error {
+	switch {
+	case errors.Is(err, ErrSkip):
+		return ErrSkip
+	case errors.Is(err, ErrPermanent), errors.Is(err, ErrPanic):
+		return ErrPermanent
+	case errors.Is(err, ErrTransient), errors.Is(err, ErrStageTimeout):
+		return ErrTransient
+	}
+	return nil
+}
+
+// isSystemFailure reports if the error counts as failure of the called system for circuit breakers
+// skipped messages and permanent failures of a single record don't
+func isSystemFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	class := classify(err)
+	return class != ErrSkip && class != ErrPermanent
+}
+
+// settleFailure settles the consumed message of a failed stage by the class of the error
+// skipped messages are acknowledged and counted as filtered, transient failures are redelivered with backoff
+// until the max deliveries, permanent failures are dead lettered and unclassified failures are acknowledged
+// every failure except a skip is escalated to the error channel
+// a filtered or failed event is published unless the message is redelivered
+// the failure is recorded in the processing status of the identifier
+// returns true when the data of the message is no longer needed
+func settleFailure(conf Config, stream StreamName, action ActionName, msg *nats.Msg, message *StreamMessage, err error, errChan *chan Error) bool {
+	identifier := GetIdentifier(msg, StreamMessage{})
+	var batchID string
+	if message != nil {
+		identifier = GetIdentifier(msg, *message)
+		batchID = message.batchID
+	}
+	logger := conf.logger().WithFields(Fields{"resource": stream, "action": action, "id": identifier})
+
+	// Messages failing transiently on every delivery are dead lettered instead of redelivered forever
+	delivered := pubsub.Delivered(msg)
+	if classify(err) == ErrTransient && conf.getMaxDeliveries() > 0 && delivered >= uint64(conf.getMaxDeliveries()) {
+		err = Permanent(fmt.Errorf("failed %d deliveries: %w", delivered, err))
+	}
+	class := classify(err)
+
+	if class == ErrSkip {
+		logger.WithError(err).Debug("skipping filtered item")
+		count(conf, stream, action, "filtered", 1)
+		acknowledge(conf, msg)
+		reason := err
+		var skipErr *SkipError
+		if errors.As(err, &skipErr) && skipErr.Err != nil {
+			reason = skipErr.Err
+		}
+		recordFiltered(conf, stream, action, identifier, reason.Error())
+		publishFiltered(conf, stream, action, identifier, reason.Error())
+		return true
+	}
+
+	recordFailed(conf, stream, action, identifier, batchID, err)
+	if errChan != nil {
+		*errChan <- Error{
+			Event:         stream,
+			Action:        action,
+			StreamMessage: message,
+			Err:           err,
+		}
+	}
+
+	switch class {
+	case ErrTransient:
+		backoff := conf.getRedeliveryBackoff(delivered)
+		logger.WithError(err).WithFields(Fields{"delivered": delivered, "backoff": backoff}).Warn("redelivering item after transient failure")
+		count(conf, stream, action, "retried", 1)
+		var abandoned *abandonedError
+		var returned <-chan struct{}
+		if errors.As(err, &abandoned) {
+			returned = abandoned.returned
+		}
+		redeliverAfter(conf, msg, backoff, returned)
+		return false
+	case ErrPermanent:
+		if err := deadLetter(conf, stream, action, msg, err); err != nil {
+			// Dead lettering is retried with the redelivered message
+			logger.WithError(err).Error("can't dead letter item")
+			negativeAcknowledge(conf, msg)
+			return false
+		}
+		logger.WithError(err).Warn("dead lettered item after permanent failure")
+		count(conf, stream, action, "dead_lettered", 1)
+		acknowledge(conf, msg)
+		publishFailed(conf, stream, action, identifier, err, true)
+		// The dead letter still refers to the claim check
+		return false
+	}
+
+	acknowledge(conf, msg)
+	publishFailed(conf, stream, action, identifier, err, false)
+	return true
+}
+
+// redeliverAfter negatively acknowledges the consumed message once the backoff passed and the stream function
+// of an abandoned run returned, or at once on shutdown, returned is nil for stages without abandoned run
+// the server redelivers negatively acknowledged messages immediately, so the message is kept in progress meanwhile
+func redeliverAfter(conf Config, msg *nats.Msg, backoff time.Duration, returned <-chan struct{}) {
+	markSettled(msg)
+	go func() {
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		ticker := time.NewTicker(conf.getInProgressInterval())
+		defer ticker.Stop()
+
+		elapsed := timer.C
+		for elapsed != nil || returned != nil {
+			select {
+			case <-elapsed:
+				elapsed = nil
+			case <-returned:
+				returned = nil
+			case <-conf.control.context().Done():
+				elapsed, returned = nil, nil
+			case <-ticker.C:
+				if err := pubsub.InProgress(conf.PubSub, msg); err != nil {
+					conf.logger().WithError(err).Warn("can't keep message in progress")
+				}
+			}
+		}
+		negativeAcknowledge(conf, msg)
+	}()
+}
+
+// getRedeliveryBackoff returns the backoff before the next delivery of a message delivered the given amount of times
+func (c Config) getRedeliveryBackoff(delivered uint64) time.Duration {
+	backoff, maxBackoff := c.RedeliveryBackoff, c.MaxRedeliveryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRedeliveryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxRedeliveryBackoff
+	}
+	for i := uint64(1); i < delivered && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// getMaxDeliveries returns the configured max deliveries or the default, negative redelivers forever
+func (c Config) getMaxDeliveries() int {
+	if c.MaxDeliveries != 0 {
+		return c.MaxDeliveries
+	}
+	return DefaultMaxDeliveries
+}
+
+// deadLetter publishes the consumed message onto the dead letter subject of the stream with the failed action and error
+func deadLetter(conf Config, stream StreamName, action ActionName, msg *nats.Msg, failure error) error {
+	identifier := GetIdentifier(msg, StreamMessage{})
+	deadLetterMsg := nats.NewMsg(GetPublishAction(identifier, stream, conf.GetConsumerPrefix(), DeadLetterAction))
+	for key, values := range msg.Header {
+		// The message id of the consumed message would be dropped as duplicate
+		if key != pubsub.MsgIDHeader {
+			deadLetterMsg.Header[key] = values
+		}
+	}
+	deadLetterMsg.Header.Set(FailedActionHeader, string(action))
+	// Headers can't contain line breaks, e.g. of panic values
+	deadLetterMsg.Header.Set(FailureHeader, strings.Join(strings.Fields(failure.Error()), " "))
+	deadLetterMsg.Data = msg.Data
+
+	return conf.PubSub.PublishMsg(deadLetterMsg)
+}
@@ -3,6 +3,8 @@ package fhirhose
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -33,10 +35,12 @@ const (
 	DefaultStreamName StreamName = "fhirhose"
 	// DefaultConsumerPrefix default consumer prefix
 	DefaultConsumerPrefix ConsumerPrefix = "fhirhose"
-	// DefaultConsumerPrefix default custom load consumer prefix
+	// DefaultConsumerCustomLoadPrefix default custom load consumer prefix
 	DefaultConsumerCustomLoadPrefix ConsumerPrefix = "fhirhosecl"
 	// PollAction event use as base poll streaming subject
 	PollAction ActionName = "polled"
+	// DebounceAction event use as base debounce streaming subject
+	DebounceAction ActionName = "debounced"
 	// RetrieveAction event use as base retrieve streaming subject
 	RetrieveAction ActionName = "retrieved"
 	// TransformAction event use as base transform streaming subject
@@ -52,11 +56,15 @@ type Client struct {
 	Register       IRegister
 	ErrorCallback  *ErrHandlerFunc
 	UploadCallback *UploadHandlerFunc
-	errorChannel   *chan Error
-	uploadChannel  *chan StreamMessage
+	// BatchCallback upload callback with a result per upload, used instead of the UploadCallback when defined
+	BatchCallback *BatchHandlerFunc
+	errorChannel  *chan Error
+	uploadChannel *chan StreamMessage
+	adminServer   *http.Server
 }
 
 // UploadHandlerFunc func used in callback for uploads handling
+// an error fails every upload of the batch, see BatchHandlerFunc for results per upload
 type UploadHandlerFunc func(uploads []StreamMessage) error
 
 // ErrHandlerFunc func used in callback for error handling
@@ -67,7 +75,17 @@ type Error struct {
 	StreamMessage *StreamMessage
 	Action        ActionName
 	Event         StreamName
-	Error         error
+	Err           error
+}
+
+// Error returns the stream, action and error
+func (e Error) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Event, e.Action, e.Err)
+}
+
+// Unwrap returns the error so it can be checked with errors.Is and errors.As
+func (e Error) Unwrap() error {
+	return e.Err
 }
 
 // IRegister interface containing register functions
@@ -76,6 +94,7 @@ type IRegister interface {
 	Transformers(Config, []IStream, *chan Error)
 	Uploaders(Config, []IStream, *chan Error, *chan StreamMessage)
 	Pollers(Config, []IStream, *chan Error)
+	Debouncers(Config, []IStream, *chan Error)
 }
 
 // Register struct found on client
@@ -107,6 +126,10 @@ func NewClient(config Config, streams []IStream, errorCallback *ErrHandlerFunc,
 		config.UploadBatchSize = 50
 	}
 
+	if config.DeduplicationWindow > 0 && config.DeduplicationCache == nil {
+		config.DeduplicationCache = NewMemoryDeduplicationCache(config.DeduplicationWindow)
+	}
+
 	return c
 }
 
@@ -126,6 +149,53 @@ func (c *Client) Run() error {
 		registered[stream.GetStreamName()] = true
 	}
 
+	// Validate poll schedules
+	if c.Config.PollEnabled {
+		for _, stream := range c.Streams {
+			if err := c.Config.getSchedule(stream.GetStreamName()).Validate(); err != nil {
+				return fmt.Errorf("stream %s: %w", stream.GetStreamName(), err)
+			}
+		}
+	}
+
+	// Validate circuit breakers
+	for name, breaker := range c.Config.CircuitBreakers {
+		if err := breaker.Validate(); err != nil {
+			return fmt.Errorf("circuit %s: %w", name, err)
+		}
+	}
+
+	// Validate backpressure
+	if c.Config.Backpressure != nil {
+		if err := c.Config.Backpressure.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Fail fast when the consumers of the stages can't be established
+	if err := c.createConsumers(); err != nil {
+		return err
+	}
+	if err := c.checkConsumers(); err != nil {
+		return err
+	}
+
+	// Create runtime control before the config is passed to the registered stages
+	c.getController()
+
+	// Set upload channel when only the batch callback is defined
+	if c.getBatchHandler() != nil && c.uploadChannel == nil {
+		uploadChan := make(chan StreamMessage)
+		c.uploadChannel = &uploadChan
+	}
+
+	// Serve admin API when an address is configured
+	if c.Config.AdminAddr != "" {
+		if err := c.serveAdmin(); err != nil {
+			return err
+		}
+	}
+
 	// Run streams
 	// Register subscribers when poll is disabled in config
 	// Register subscribers for transformers
@@ -138,12 +208,22 @@ func (c *Client) Run() error {
 		c.Register.Uploaders(*c.Config, c.Streams, c.errorChannel, c.uploadChannel)
 	}
 
+	// Register subscribers for debouncers when a quiet period is configured
+	if c.Config.DebounceQuietPeriod > 0 {
+		c.Register.Debouncers(*c.Config, c.Streams, c.errorChannel)
+	}
+
 	for i := 0; i < c.Config.WorkerAmount; i++ {
 		go c.Register.Retrievers(*c.Config, c.Streams, c.errorChannel)
 	}
 
 	// Run pollers when enabled in config
-	c.Register.Pollers(*c.Config, c.Streams, c.errorChannel)
+	if c.Config.PollEnabled {
+		if c.Config.Spool != nil {
+			go replaySpoolOnInterval(*c.Config)
+		}
+		c.Register.Pollers(*c.Config, c.Streams, c.errorChannel)
+	}
 
 	// Push error channels into error callback when defined
 	if c.ErrorCallback != nil {
@@ -160,49 +240,158 @@ func (c *Client) Run() error {
 	}
 
 	// Push uploads to uploads handler when batch size is reached
-	if c.UploadCallback != nil {
-		uploadFunc := *c.UploadCallback
-		go func() {
-			var uploadBatch []StreamMessage
-			lastUpload := time.Now()
-			for {
-				uploadItem, ok := <-*c.uploadChannel
-				if ok {
-					uploadBatch = append(uploadBatch, uploadItem)
-					batchSize := len(uploadBatch)
-					if batchSize > c.Config.UploadBatchSize || batchSize > 0 && time.Now().Sub(lastUpload) > time.Second*1 {
-						payload := uploadBatch
-						if err := uploadFunc(payload); err != nil && c.errorChannel != nil {
-							*c.errorChannel <- Error{
-								Event:         "upload handler func",
-								Action:        UploadAction,
-								StreamMessage: nil,
-								Error:         err,
-							}
-						}
-						uploadBatch = []StreamMessage{}
-						lastUpload = time.Now()
-					}
-				}
-			}
-		}()
+	if handler := c.getBatchHandler(); handler != nil {
+		go batchUploads(*c.Config, handler, c.uploadChannel, c.errorChannel)
 	}
 
 	return nil
 }
 
+// Shutdown cancels the running stages, stops polling and stops the admin API
+// messages consumed after the shutdown are negatively acknowledged so they are redelivered
+func (c *Client) Shutdown() {
+	c.getController().shutdown()
+	c.shutdownAdmin()
+}
+
 // Config type is the base config struct for the fhirhose package
 type Config struct {
-	PubSub               pubsub.IPubSubClient
-	Nats                 *nats.Conn
-	PollInterval         time.Duration
+	PubSub pubsub.IPubSubClient
+	Nats   *nats.Conn
+	// StreamName JetStream stream containing all subjects of the client
+	// Default DefaultStreamName
+	StreamName StreamName
+	// ConsumerPrefix subject and consumer prefix of the regular lane
+	// Default DefaultConsumerPrefix
+	ConsumerPrefix ConsumerPrefix
+	// CustomLoadPrefix subject and consumer prefix of the custom load lane
+	// Default DefaultConsumerCustomLoadPrefix
+	CustomLoadPrefix ConsumerPrefix
+	// ConsumerTemplate template of consumer names with {prefix}, {stream}, {action} and {tenant} placeholders
+	// Default DefaultConsumerTemplate
+	ConsumerTemplate string
+	// Tenant isolates the client in its own stream and prefixes when these aren't set explicitly
+	// use a PubSub connected to the tenant account for isolation by NATS accounts
+	Tenant       string
+	PollInterval time.Duration
+	// Schedules poll schedules by stream, streams without schedule poll every PollInterval
+	Schedules map[StreamName]Schedule
+	// LeaseStore elects one instance per stream to run the poller, consumers run on every instance
+	// Default nil polls on every instance
+	LeaseStore ILeaseStore
+	// LeaseTTL time a poll lease is valid without renewal, leases are renewed every third of the ttl
+	// Default DefaultLeaseTTL
+	LeaseTTL time.Duration
+	// InstanceID identifies this instance as lease holder
+	// Default generated from hostname and process id
+	InstanceID string
+	// Clock clock used by the poll schedules
+	// Default real clock
+	Clock IClock
+	// PollEnabled runs the pollers of all streams
+	PollEnabled bool
+	// DeduplicationEnabled removes duplicate identifiers within a poll
+	// and sets the Nats-Msg-Id header so JetStream drops duplicates within its duplicate window
 	DeduplicationEnabled bool
+	// DeduplicationWindow window in which polled messages with the same message id are skipped
+	// messages are compared by identifier and version or data, see GetMessageID
+	// only needed for windows longer than the JetStream duplicate window
+	// Default 0
+	DeduplicationWindow time.Duration
+	// DeduplicationCache cache used to skip polled messages across polls
+	// Default in memory cache when DeduplicationWindow is set
+	DeduplicationCache IDeduplicationCache
+	// DebounceQuietPeriod period an identifier has to be quiet before the latest polled version is retrieved
+	// held messages are kept in the memory of the consuming instance, so updates are only coalesced per instance
+	// with multiple instances an identifier is retrieved once by every instance which consumed one of its updates
+	// requires a debounced consumer for every stream, default 0 disables debouncing
+	DebounceQuietPeriod time.Duration
+	// Backpressure skips polls while the downstream consumers of a stream lag
+	// Default nil or a zero high water mark always polls
+	Backpressure *Backpressure
+	// Metrics receives pipeline counters
+	// Default nil
+	Metrics IMetrics
+	// UploadHashStore keeps the content hash of the last successful upload per stream and identifier
+	// messages with an unchanged hash are skipped, default nil uploads every message
+	UploadHashStore IStateStore
+	// ForceUpload uploads messages even when the content hash is unchanged, used for backfills
+	ForceUpload bool
+	// ClaimCheckThreshold data size in bytes above which message data is moved into the claim check store
+	// Default 0 keeps all data in the message
+	ClaimCheckThreshold int
+	// ClaimCheckStore store holding message data above the claim check threshold
+	// has to be shared by all replicas consuming the streams, see FileObjectStore
+	ClaimCheckStore IObjectStore
+	// KeyProvider provides the keys used to encrypt message data on the message bus
+	// Default nil disables encryption
+	KeyProvider IKeyProvider
+	// EncryptDescription encrypts the message description as well as the data
+	EncryptDescription bool
+	// Logging configures the logger, log levels, sampling and redaction
+	// Default logrus standard logger without redaction
+	Logging *Logging
+	// AdminAddr address the admin API listens on, e.g. ":8081"
+	// Default empty disables the admin API
+	AdminAddr string
+	// AdminToken bearer token required for every admin API request
+	AdminToken string
+	// Spool buffers polled messages while NATS is unavailable, replayed in order once NATS is available again
+	// Default nil drops polled messages which can't be published
+	Spool ISpool
+	// SpoolReplayInterval interval in which spooled messages are replayed
+	// Default DefaultSpoolReplayInterval
+	SpoolReplayInterval time.Duration
 	// WorkerAmount amount of processes run for retrieve, transform and upload
 	// Default 3
 	WorkerAmount int
+	// RestartBackoff wait before the first restart of a failed consumer, doubled on every next failure
+	// Default DefaultRestartBackoff
+	RestartBackoff time.Duration
+	// MaxRestartBackoff maximum wait between restarts of a failed consumer
+	// Default DefaultMaxRestartBackoff
+	MaxRestartBackoff time.Duration
+	// StageTimeouts timeouts of the poll, retrieve, transform and upload stages by action
+	// Default nil runs the stages without timeout
+	StageTimeouts map[ActionName]time.Duration
+	// InProgressInterval interval in which consumed messages are acknowledged as in progress while a stage runs
+	// should be shorter than the ack wait of the consumers, default DefaultInProgressInterval
+	InProgressInterval time.Duration
+	// MaxAbandonedRuns amount of adapted stream functions per stage which may keep running after their deadline
+	// Default DefaultMaxAbandonedRuns, see ContextAdapter
+	MaxAbandonedRuns int
+	// RedeliveryBackoff wait before a message is redelivered after a transient failure, doubled on every next delivery
+	// Default DefaultRedeliveryBackoff
+	RedeliveryBackoff time.Duration
+	// MaxRedeliveryBackoff maximum wait before a message is redelivered after a transient failure
+	// Default DefaultMaxRedeliveryBackoff
+	MaxRedeliveryBackoff time.Duration
+	// MaxDeliveries amount of deliveries after which a transiently failing message is dead lettered
+	// Default DefaultMaxDeliveries, negative redelivers forever
+	MaxDeliveries int
+	// CircuitBreakers circuit breakers by circuit name, see GetCircuitName, IEndpointStream and UploadHandlerCircuit
+	// an open circuit holds back its stage and leaves the messages on the stream, default nil disables circuit breakers
+	CircuitBreakers map[string]CircuitBreaker
 	// ThrottleAmount amount of items pushed per minute
 	// Default nil
 	ThrottleAmount *int64
-	// UploadBatchSize batch size for upload messages
+	// UploadBatchSize batch size for upload messages, a batch contains the messages of one stream
 	UploadBatchSize int
+	// UploadMaxAttempts amount of times failed items of an upload batch are handled before they are requeued
+	// Default DefaultUploadMaxAttempts
+	UploadMaxAttempts int
+	// UploadRetryBackoff wait before failed items of an upload batch are retried, doubled on every next retry
+	// Default DefaultUploadRetryBackoff
+	UploadRetryBackoff time.Duration
+	// MaxUploadRetryBackoff maximum wait between retries of an upload batch
+	// Default DefaultMaxUploadRetryBackoff
+	MaxUploadRetryBackoff time.Duration
+	// StatusStore keeps the processing status per stream, identifier and stage, see GetStatus
+	// use a JetStreamStatusStore to share the status between instances, default nil doesn't record the status
+	StatusStore IStatusStore
+	// EventsEnabled publishes an uploaded, failed or filtered PipelineEvent on prefix.stream.event.identifier
+	// once a message leaves the pipeline, the stream has to contain these subjects
+	EventsEnabled bool
+
+	control *controller
 }
@@ -1,14 +1,28 @@
 package fhirhose
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/lumc/fhirhose/packages/pubsub"
 	psmocks "github.com/lumc/fhirhose/packages/pubsub/mocks"
 )
 
@@ -22,8 +36,10 @@ func (s *FhirhoseTestSuite) SetupTest() {
 	mockedPubSub := &psmocks.IPubSubClient{}
 
 	mockedPubSub.On("Publish", mock.Anything, mock.Anything).Return(nil)
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
 	mockedPubSub.On("Subscribe", mock.Anything, mock.Anything).Return(&nats.Subscription{}, nil)
 	mockedPubSub.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockedPubSub.On("Pending", mock.Anything, mock.Anything).Return(uint64(0), nil)
 
 	client := &Client{
 		Config: &Config{
@@ -86,7 +102,7 @@ func (s *FhirhoseTestSuite) TestRegisterStreamsPollDisabled() {
 	var wgUpdate sync.WaitGroup
 
 	// Check if Register functions get called
-	mockedRegister.On("Uploaders", mock.Anything, mock.Anything, mock.Anything).Return().Run(func(args mock.Arguments) {
+	mockedRegister.On("Uploaders", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return().Run(func(args mock.Arguments) {
 		wgUpdate.Done()
 	})
 	mockedRegister.On("Transformers", mock.Anything, mock.Anything, mock.Anything).Return().Run(func(args mock.Arguments) {
@@ -109,6 +125,7 @@ func (s *FhirhoseTestSuite) TestRegisterStreamsPollDisabled() {
 	wgUpdate.Add(1)
 
 	s.client.Config.PollEnabled = false
+	s.client.Config.WorkerAmount = 1
 	s.NoError(s.client.Run())
 
 	wgRetrieve.Wait()
@@ -156,6 +173,1996 @@ func (s *FhirhoseTestSuite) TestRegisterStreamsPollEnabled() {
 	mockedRegister.AssertNumberOfCalls(s.T(), "Pollers", 1)
 }
 
+func (s *FhirhoseTestSuite) TestGetMessageID() {
+	message := StreamMessage{Identifier: "123", Description: "lab result", Data: []byte("result")}
+	s.Equal(GetMessageID("user", message), GetMessageID("user", message), "expect equal ids for equal data")
+	s.Equal("user.123."+getContentHash([]byte("result")), GetMessageID("user", message))
+	changed := message
+	changed.Data = []byte("changed")
+	s.NotEqual(GetMessageID("user", message), GetMessageID("user", changed), "expect the data hash in the id without version")
+
+	message.Version = "2"
+	s.Equal("user.123.2", GetMessageID("user", message))
+	s.NotEqual(GetMessageID("user", message), GetMessageID("car", message), "expect stream in id")
+}
+
+func (s *FhirhoseTestSuite) TestMemoryDeduplicationCache() {
+	cache := NewMemoryDeduplicationCache(time.Millisecond * 50)
+	s.False(cache.Exists("a"))
+
+	cache.Add("a")
+	s.True(cache.Exists("a"))
+
+	time.Sleep(time.Millisecond * 30)
+	cache.Add("b")
+	cache.Add("a")
+	time.Sleep(time.Millisecond * 30)
+	s.True(cache.Exists("a"), "expect a re-added id to be remembered from the last add")
+
+	time.Sleep(time.Millisecond * 30)
+	s.False(cache.Exists("a"), "expect id to be forgotten after the window")
+	s.False(cache.Exists("b"))
+	s.Empty(cache.seen)
+	s.Equal(0, cache.added.Len())
+}
+
+func (s *FhirhoseTestSuite) TestPollDeduplicationAcrossPolls() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Poll").Return([]StreamMessage{
+		{Identifier: "1", Version: "1"},
+		{Identifier: "1", Version: "1"},
+		{Identifier: "2", Version: "1"},
+	}, false, nil)
+
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.DeduplicationCache = NewMemoryDeduplicationCache(time.Minute)
+
+	poll(context.Background(), conf, &userStream, nil)
+	poll(context.Background(), conf, &userStream, nil)
+
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 2)
+	msg := mockedPubSub.Calls[0].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.polled.1", msg.Subject)
+	s.Equal("user.1.1", msg.Header.Get(pubsub.MsgIDHeader))
+
+	// Messages without version are deduplicated by the hash of their data
+	unversioned := IStreamMock{}
+	unversioned.On("GetStreamName").Return(StreamName("user"))
+	unversioned.On("Poll").Return([]StreamMessage{{Identifier: "3", Data: []byte("a")}}, false, nil).Twice()
+	unversioned.On("Poll").Return([]StreamMessage{{Identifier: "3", Data: []byte("b")}}, false, nil)
+	poll(context.Background(), conf, &unversioned, nil)
+	poll(context.Background(), conf, &unversioned, nil)
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 3)
+	poll(context.Background(), conf, &unversioned, nil)
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 4)
+	msg = mockedPubSub.Calls[3].Arguments.Get(0).(*nats.Msg)
+	s.Equal("user.3."+getContentHash([]byte("b")), msg.Header.Get(pubsub.MsgIDHeader))
+}
+
+func (s *FhirhoseTestSuite) TestDebounceCoalescesUpdates() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.Metrics = metrics
+	conf.DebounceQuietPeriod = time.Minute
+
+	d := newDebouncer(conf, &userStream)
+	start := time.Now()
+	d.add(&nats.Msg{}, StreamMessage{Identifier: "1", Version: "1"}, start)
+	d.add(&nats.Msg{}, StreamMessage{Identifier: "1", Version: "2"}, start.Add(time.Second*10))
+	d.add(&nats.Msg{}, StreamMessage{Identifier: "2", Version: "1"}, start.Add(time.Second*50))
+
+	d.flush(start.Add(time.Second * 30))
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 0)
+
+	d.flush(start.Add(time.Second * 80))
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+	published := mockedPubSub.Calls[0].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.debounced.1", published.Subject)
+	s.Contains(string(published.Data), `"Version":"2"`)
+	s.Empty(published.Header.Get(pubsub.MsgIDHeader), "expect the polled message id not to be copied")
+
+	d.flush(start.Add(time.Second * 120))
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 2)
+
+	s.Equal(int64(2), metrics.Get("user", DebounceAction, "forwarded"))
+	s.Equal(int64(1), metrics.Get("user", DebounceAction, "coalesced"))
+}
+
+func (s *FhirhoseTestSuite) TestDebounceFlushInterval() {
+	conf := Config{DebounceQuietPeriod: time.Second * 10}
+	s.Equal(time.Second*5, conf.getDebounceFlushInterval())
+
+	conf.DebounceQuietPeriod = time.Minute
+	s.Equal(DefaultInProgressInterval, conf.getDebounceFlushInterval(), "expect held messages to be kept in progress")
+
+	conf.InProgressInterval = time.Second
+	s.Equal(time.Second, conf.getDebounceFlushInterval())
+}
+
+func (s *FhirhoseTestSuite) TestDebouncersShareDebouncer() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+
+	conf := *s.client.Config
+	conf.WorkerAmount = 2
+	conf.DebounceQuietPeriod = time.Millisecond * 200
+	conf.control = newController([]IStream{&userStream})
+	defer conf.control.shutdown()
+	first, err := newStreamMsg(conf, "user", GetPublishAction("1", "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: "1", Version: "1"})
+	s.Require().NoError(err)
+	second, err := newStreamMsg(conf, "user", GetPublishAction("1", "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: "1", Version: "2"})
+	s.Require().NoError(err)
+	invalid := nats.NewMsg(GetPublishAction("2", "user", DefaultConsumerPrefix, PollAction))
+	invalid.Data = []byte("{")
+
+	// Every subscriber receives one update of the identifier
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-polled", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(first)
+		args.Get(2).(func(msg *nats.Msg))(invalid)
+	}).Once()
+	mockedPubSub.On("Consume", "fhirhose-user-polled", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(second)
+	}).Once()
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	metrics := NewMemoryMetrics()
+	conf.PubSub = &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.Metrics = metrics
+
+	errChan := make(chan Error, 10)
+	s.client.Register.Debouncers(conf, []IStream{&userStream}, &errChan)
+
+	s.Eventually(func() bool {
+		return metrics.Get("user", DebounceAction, "forwarded") == 1
+	}, time.Second, time.Millisecond*10, "expect the updates of both subscribers to be coalesced")
+	s.Equal(int64(1), metrics.Get("user", DebounceAction, "coalesced"))
+	s.Equal(int64(1), metrics.Get("user", DebounceAction, "dead_lettered"), "expect the unreadable message to be dead lettered")
+
+	var subjects []string
+	for _, call := range mockedPubSub.Calls {
+		if call.Method == "PublishMsg" {
+			subjects = append(subjects, call.Arguments.Get(0).(*nats.Msg).Subject)
+		}
+	}
+	s.ElementsMatch([]string{"fhirhose.user.deadletter.2", "fhirhose.user.debounced.1"}, subjects)
+	s.Require().Len(errChan, 1)
+	s.True(errors.Is(<-errChan, ErrPermanent))
+}
+
+func (s *FhirhoseTestSuite) TestUploadSkipsUnchangedContent() {
+	var callback func(msg *nats.Msg)
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		callback = args.Get(2).(func(msg *nats.Msg))
+	})
+
+	message := StreamMessage{Identifier: "1", Data: []byte(`{"resourceType":"Patient"}`)}
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Upload", mock.Anything).Return(message, false, nil)
+
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.Metrics = metrics
+	conf.UploadHashStore = NewMemoryStateStore()
+
+	handleUpload(DefaultConsumerPrefix, &userStream, conf, nil, nil)
+	s.Require().NotNil(callback)
+
+	data, err := json.Marshal(&message)
+	s.Require().NoError(err)
+	callback(&nats.Msg{Subject: "fhirhose.user.transformed.1", Data: data})
+	callback(&nats.Msg{Subject: "fhirhose.user.transformed.1", Data: data})
+	userStream.AssertNumberOfCalls(s.T(), "Upload", 1)
+	s.Equal(int64(1), metrics.Get("user", UploadAction, "unchanged"))
+
+	// The claim check of an unchanged message is released
+	store, err := NewFileObjectStore(s.T().TempDir())
+	s.Require().NoError(err)
+	conf.ClaimCheckStore = store
+	conf.ClaimCheckThreshold = 1
+	handleUpload(DefaultConsumerPrefix, &userStream, conf, nil, nil)
+	checked, err := newStreamMsg(conf, "user", "fhirhose.user.transformed.1", message)
+	s.Require().NoError(err)
+	callback(checked)
+	userStream.AssertNumberOfCalls(s.T(), "Upload", 1)
+	objects, err := ioutil.ReadDir(store.Dir)
+	s.Require().NoError(err)
+	s.Empty(objects, "expect the claim check of the unchanged message to be released")
+
+	conf.ForceUpload = true
+	handleUpload(DefaultConsumerPrefix, &userStream, conf, nil, nil)
+	callback(&nats.Msg{Subject: "fhirhose.user.transformed.1", Data: data})
+	userStream.AssertNumberOfCalls(s.T(), "Upload", 2)
+}
+
+func (s *FhirhoseTestSuite) TestIdentifierEncoding() {
+	identifiers := []string{
+		"123",
+		"2.16.840.1.113883.2.4.6.3",
+		"Patient/123/_history/2",
+		"a*b>c d%e",
+		"naïve\n",
+	}
+	for _, identifier := range identifiers {
+		actionString := GetPublishAction(identifier, "user", DefaultConsumerPrefix, PollAction)
+		s.Len(strings.Split(actionString, "."), 4, "expect identifier to be a single token")
+		s.NotContains(actionString, "*")
+		s.NotContains(actionString, ">")
+		s.NotContains(actionString, " ")
+		s.Equal(identifier, GetIdentifierFromActionString(actionString))
+		s.Len(strings.Split(GetStateKey("user", identifier), "."), 2, "expect identifier to be a single state key token")
+	}
+
+	// Errors don't contain the identifier
+	s.NotContains(ValidateIdentifier("john\xff").Error(), "john")
+	_, err := DecodeIdentifier("john%zz")
+	s.NotContains(err.Error(), "john")
+
+	msg := nats.NewMsg("fhirhose.user.polled.x")
+	msg.Header.Set(IdentifierHeader, EncodeIdentifier("2.16.840"))
+	s.Equal("2.16.840", GetIdentifier(msg, StreamMessage{}))
+	s.Equal("body", GetIdentifier(msg, StreamMessage{Identifier: "body"}))
+
+	_, err = DecodeIdentifier("abc%2")
+	s.True(errors.Is(err, ErrInvalidIdentifier))
+	s.True(errors.Is(ValidateIdentifier(""), ErrInvalidIdentifier))
+	s.True(errors.Is(ValidateIdentifier("\xff"), ErrInvalidIdentifier))
+	s.NoError(ValidateIdentifier("2.16.840.1"))
+}
+
+func (s *FhirhoseTestSuite) TestClaimCheck() {
+	dir, err := ioutil.TempDir("", "fhirhose-claimcheck")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileObjectStore(dir)
+	s.Require().NoError(err)
+
+	conf := *s.client.Config
+	conf.ClaimCheckStore = store
+	conf.ClaimCheckThreshold = 8
+
+	small, err := newStreamMsg(conf, "user", "fhirhose.user.polled.1", StreamMessage{Identifier: "1", Data: []byte("small")})
+	s.Require().NoError(err)
+	s.NotContains(string(small.Data), "ClaimCheck")
+
+	largeMsg, err := newStreamMsg(conf, "user", "fhirhose.user.polled.2", StreamMessage{Identifier: "2", Data: []byte("large bundle")})
+	s.Require().NoError(err)
+	large := largeMsg.Data
+	s.Contains(string(large), "ClaimCheck")
+	s.NotContains(string(large), "large bundle")
+
+	message, claimCheck, err := unmarshalMessage(conf, large)
+	s.Require().NoError(err)
+	s.Equal("large bundle", string(message.Data))
+	s.Empty(message.ClaimCheck)
+	s.NotEmpty(claimCheck)
+
+	s.NoError(releaseClaimCheck(conf, claimCheck))
+	_, _, err = unmarshalMessage(conf, large)
+	s.True(errors.Is(err, ErrPermanent), "expect released claim check to be garbage collected")
+}
+
+func (s *FhirhoseTestSuite) TestEncryption() {
+	dir, err := ioutil.TempDir("", "fhirhose-keys")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "current"), []byte("k1\n"), 0600))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "k1"), []byte(key), 0600))
+
+	conf := *s.client.Config
+	conf.KeyProvider = &FileKeyProvider{Dir: dir}
+	conf.EncryptDescription = true
+
+	msg, err := newStreamMsg(conf, "user", "fhirhose.user.retrieved.1", StreamMessage{
+		Identifier:  "1",
+		Description: "patient john doe",
+		Data:        []byte(`{"name":"john doe"}`),
+	})
+	s.Require().NoError(err)
+	s.Equal("k1", msg.Header.Get(EncryptionKeyIDHeader))
+	s.NotContains(string(msg.Data), "john doe")
+
+	message, _, err := unmarshalMessage(conf, msg.Data)
+	s.Require().NoError(err)
+	s.Equal("patient john doe", message.Description)
+	s.Equal(`{"name":"john doe"}`, string(message.Data))
+	s.Nil(message.Encryption)
+
+	// Rotated keys can still decrypt messages encrypted with the previous key
+	os.Setenv("FHIRHOSE_TEST_KEY_ID", "k2")
+	os.Setenv("FHIRHOSE_TEST_KEY_k2", base64.StdEncoding.EncodeToString([]byte("01234567890123456789012345678901")))
+	defer os.Unsetenv("FHIRHOSE_TEST_KEY_ID")
+	defer os.Unsetenv("FHIRHOSE_TEST_KEY_k2")
+	conf.KeyProvider = &EnvKeyProvider{Prefix: "FHIRHOSE_TEST_KEY_"}
+	_, _, err = unmarshalMessage(conf, msg.Data)
+	s.True(errors.Is(err, ErrDecrypt), "expect decrypt error for unknown key")
+	s.True(errors.Is(err, ErrTransient), "expect key provider failures to be redelivered")
+
+	os.Setenv("FHIRHOSE_TEST_KEY_k1", key)
+	defer os.Unsetenv("FHIRHOSE_TEST_KEY_k1")
+	_, _, err = unmarshalMessage(conf, msg.Data)
+	s.NoError(err)
+
+	// Messages failing authentication are dead lettered instead of dropped
+	var tampered StreamMessage
+	s.Require().NoError(json.Unmarshal(msg.Data, &tampered))
+	tampered.Data[len(tampered.Data)-1] ^= 1
+	tamperedMsg := nats.NewMsg(msg.Subject)
+	tamperedMsg.Data, err = json.Marshal(tampered)
+	s.Require().NoError(err)
+	_, _, err = unmarshalMessage(conf, tamperedMsg.Data)
+	s.True(errors.Is(err, ErrPermanent), "expect authentication failures to be permanent")
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-retrieved", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(tamperedMsg)
+	})
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.PubSub = acknowledger
+	handleTransform(conf.GetConsumerPrefix(), &userStream, conf, nil)
+
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+	deadLetter := mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.deadletter.1", deadLetter.Subject)
+	s.Equal(tamperedMsg.Data, deadLetter.Data, "expect the dead letter to keep the encrypted message")
+	s.Equal(1, acknowledger.acks)
+	userStream.AssertNotCalled(s.T(), "Transform", mock.Anything)
+}
+
+func (s *FhirhoseTestSuite) TestNamespace() {
+	conf := Config{}
+	s.Equal(DefaultStreamName, conf.GetStreamName())
+	s.Equal("fhirhose-user-polled", conf.GetConsumerName("user", conf.GetConsumerPrefix(), PollAction))
+	s.Equal("fhirhosecl-user-polled", conf.GetConsumerName("user", conf.GetCustomLoadPrefix(), PollAction))
+
+	conf.Tenant = "acceptance"
+	s.Equal(StreamName("fhirhose-acceptance"), conf.GetStreamName())
+	s.Equal(ConsumerPrefix("fhirhose-acceptance"), conf.GetConsumerPrefix())
+	s.Equal(ConsumerPrefix("fhirhosecl-acceptance"), conf.GetCustomLoadPrefix())
+
+	conf.StreamName = "hospital"
+	conf.ConsumerPrefix = "hosp"
+	conf.ConsumerTemplate = "{tenant}_{stream}_{action}_{prefix}"
+	s.Equal(StreamName("hospital"), conf.GetStreamName())
+	s.Equal("acceptance_user_polled_hosp", conf.GetConsumerName("user", conf.GetConsumerPrefix(), PollAction))
+}
+
+// capturedLog log event captured by the capture logger
+type capturedLog struct {
+	level  LogLevel
+	event  string
+	fields Fields
+}
+
+// captureLogger logger which keeps all log events
+type captureLogger struct {
+	logs []capturedLog
+}
+
+func (l *captureLogger) Log(level LogLevel, event string, fields Fields) {
+	l.logs = append(l.logs, capturedLog{level: level, event: event, fields: fields})
+}
+
+func (s *FhirhoseTestSuite) TestLoggingRedactionAndSampling() {
+	logger := &captureLogger{}
+	conf := Config{Logging: &Logging{
+		Logger:      logger,
+		Levels:      map[string]LogLevel{"polled item": DebugLevel},
+		SampleRates: map[string]int{"polled item": 2},
+		Redact:      MaskRedactor(),
+	}}
+
+	for i := 0; i < 4; i++ {
+		conf.logger().WithFields(Fields{"id": "123", "desc": "john doe", "resource": "user"}).Info("polled item")
+	}
+	conf.logger().WithFields(Fields{"id": "123", "subject": "fhirhose.user.polled.123"}).Error("can't publish new event")
+
+	s.Require().Len(logger.logs, 3, "expect every second polled item and the error to be logged")
+	s.Equal(DebugLevel, logger.logs[0].level)
+	s.Equal("***", logger.logs[0].fields["id"])
+	s.Equal("***", logger.logs[0].fields["desc"])
+	s.Equal("user", logger.logs[0].fields["resource"])
+	s.Equal(ErrorLevel, logger.logs[2].level)
+	s.Equal("***", logger.logs[2].fields["subject"])
+
+	hash := HashRedactor("salt", "id")
+	s.Equal(hash("id", "123"), hash("id", "123"), "expect stable hashes")
+	s.NotEqual("123", hash("id", "123"))
+	s.Equal("john doe", hash("desc", "john doe"))
+}
+
+func (s *FhirhoseTestSuite) TestAdminAPI() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	s.client.Streams = []IStream{&userStream}
+	s.client.Config.AdminToken = "secret"
+
+	server := httptest.NewServer(s.client.AdminHandler())
+	defer server.Close()
+
+	request := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		s.Require().NoError(err)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err)
+		return res
+	}
+
+	res, err := http.Get(server.URL + "/streams")
+	s.Require().NoError(err)
+	s.Equal(http.StatusUnauthorized, res.StatusCode)
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/streams", nil)
+	s.Require().NoError(err)
+	req.Header.Set("Authorization", "secret")
+	res, err = http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	s.Equal(http.StatusUnauthorized, res.StatusCode, "expect token without the Bearer scheme to be refused")
+
+	res = request(http.MethodPost, "/streams/user/pause?action=retrieved", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	s.True(s.client.Config.control.isPaused("user", RetrieveAction))
+
+	res = request(http.MethodPost, "/streams/user/pause", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	res = request(http.MethodPost, "/streams/user/poll", "")
+	s.Equal(http.StatusConflict, res.StatusCode, "expect trigger to be refused while polling is paused")
+
+	res = request(http.MethodGet, "/streams", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	var states []StreamState
+	s.Require().NoError(json.NewDecoder(res.Body).Decode(&states))
+	s.Require().Len(states, 1)
+	s.Equal([]ActionName{PollAction, RetrieveAction}, states[0].Paused)
+
+	res = request(http.MethodPost, "/streams/user/resume", "")
+	s.Equal(http.StatusOK, res.StatusCode)
+	res = request(http.MethodPost, "/streams/user/poll", "")
+	s.Equal(http.StatusAccepted, res.StatusCode)
+	select {
+	case <-s.client.Config.control.triggered("user"):
+	default:
+		s.Fail("expect poll to be triggered")
+	}
+
+	res = request(http.MethodPost, "/streams/user/load", `{"identifiers":["1","2.16.840"]}`)
+	s.Equal(http.StatusAccepted, res.StatusCode)
+	mockedPubSub := s.client.Config.PubSub.(*psmocks.IPubSubClient)
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 2)
+	msg := mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhosecl.user.polled.2%2E16%2E840", msg.Subject)
+
+	res = request(http.MethodPost, "/streams/user/load", `{"identifiers":["`+strings.Repeat("1", maxAdminBodySize)+`"]}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode, "expect oversized bodies to be refused")
+
+	// A failed custom load returns the amount of published identifiers
+	failingPubSub := &psmocks.IPubSubClient{}
+	failingPubSub.On("PublishMsg", mock.MatchedBy(func(msg *nats.Msg) bool {
+		return strings.HasSuffix(msg.Subject, ".4")
+	})).Return(errors.New("no responders"))
+	failingPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	s.client.Config.PubSub = failingPubSub
+	res = request(http.MethodPost, "/streams/user/load", `{"identifiers":["3","4","5"]}`)
+	s.Equal(http.StatusBadGateway, res.StatusCode)
+	var failed struct {
+		Published int `json:"published"`
+	}
+	s.Require().NoError(json.NewDecoder(res.Body).Decode(&failed))
+	s.Equal(1, failed.Published)
+
+	res = request(http.MethodPost, "/streams/car/poll", "")
+	s.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (s *FhirhoseTestSuite) TestAdminAPIStopsOnShutdown() {
+	client := NewClient(Config{AdminAddr: "127.0.0.1:0", AdminToken: "secret"}, nil, nil, nil)
+	s.Require().NoError(client.serveAdmin())
+	s.Require().NotNil(client.adminServer)
+	s.Equal(adminReadHeaderTimeout, client.adminServer.ReadHeaderTimeout)
+
+	client.Shutdown()
+	s.Equal(http.ErrServerClosed, client.adminServer.ListenAndServe(), "expect the admin api to be closed")
+}
+
+// fakeClock clock which only moves when the test fires it
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waits: make(chan time.Duration, 10), fire: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fire
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.fire <- now
+}
+
+func (s *FhirhoseTestSuite) TestScheduleCron() {
+	schedule := Schedule{Cron: "*/15 8-17 * * 1-5", Location: time.UTC}
+	s.Require().NoError(schedule.Validate())
+
+	// Friday evening polls next on monday morning
+	next, err := schedule.Next(time.Date(2026, 10, 16, 17, 50, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.Equal(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC), next)
+
+	next, err = schedule.Next(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.Equal(time.Date(2026, 10, 19, 8, 15, 0, 0, time.UTC), next)
+
+	s.Error(Schedule{Cron: "* * *"}.Validate())
+	s.Error(Schedule{Cron: "61 * * * *"}.Validate())
+	s.Error(Schedule{}.Validate(), "expect schedule without interval or cron to be invalid")
+	s.Error(Schedule{Cron: "0 0 31 2 *"}.Validate(), "expect cron without existing day to be invalid")
+	s.Error(Schedule{Cron: "0 12 * * *", Windows: []TimeWindow{{Start: "20:00", End: "06:00"}}}.Validate(),
+		"expect cron outside the windows to be invalid")
+	s.NoError(Schedule{Cron: "0 22 * * *", Windows: []TimeWindow{{Start: "20:00", End: "06:00"}}}.Validate())
+}
+
+func (s *FhirhoseTestSuite) TestScheduleWindows() {
+	schedule := Schedule{
+		Interval: time.Hour,
+		Windows:  []TimeWindow{{Start: "20:00", End: "06:00"}},
+		Location: time.UTC,
+	}
+	s.Require().NoError(schedule.Validate())
+
+	next, err := schedule.Next(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.Equal(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC), next, "expect daytime polls to wait for the window")
+
+	next, err = schedule.Next(time.Date(2026, 10, 19, 23, 30, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.Equal(time.Date(2026, 10, 20, 0, 30, 0, 0, time.UTC), next, "expect window to cross midnight")
+
+	schedule.Immediate = true
+	first, err := schedule.First(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.Equal(time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC), first, "expect immediate poll to respect the window")
+
+	schedule.Jitter = time.Minute
+	next, err = schedule.Next(time.Date(2026, 10, 19, 23, 30, 0, 0, time.UTC))
+	s.Require().NoError(err)
+	s.True(!next.Before(time.Date(2026, 10, 20, 0, 30, 0, 0, time.UTC)) && next.Before(time.Date(2026, 10, 20, 0, 31, 0, 0, time.UTC)))
+
+	s.Error(Schedule{Interval: time.Hour, Windows: []TimeWindow{{Start: "25:00", End: "06:00"}}}.Validate())
+	s.Error(Schedule{Interval: time.Hour, Windows: []TimeWindow{{Start: "06:00", End: "06:00"}}}.Validate(), "expect empty window to be invalid")
+}
+
+func (s *FhirhoseTestSuite) TestPollRetriesFailedSchedule() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+
+	clock := newFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	conf := *s.client.Config
+	conf.Clock = clock
+	conf.Schedules = map[StreamName]Schedule{"user": {Cron: "0 0 31 2 *"}}
+
+	go pollOnInterval(context.Background(), conf, &userStream, nil)
+
+	s.Equal(scheduleRetryInterval, <-clock.waits, "expect failed schedule to be retried")
+	clock.advance(scheduleRetryInterval)
+	s.Equal(scheduleRetryInterval, <-clock.waits, "expect poll loop to keep running")
+	userStream.AssertNotCalled(s.T(), "Poll")
+}
+
+func (s *FhirhoseTestSuite) TestPollOnScheduleImmediate() {
+	polled := make(chan bool, 10)
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Poll").Return(nil, false, nil).Run(func(args mock.Arguments) {
+		polled <- true
+	})
+
+	clock := newFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	conf := *s.client.Config
+	conf.Clock = clock
+	conf.Schedules = map[StreamName]Schedule{"user": {Interval: time.Hour, Immediate: true}}
+
+	go pollOnInterval(context.Background(), conf, &userStream, nil)
+
+	s.Equal(time.Duration(0), <-clock.waits, "expect first poll without waiting")
+	clock.advance(0)
+	<-polled
+	s.Equal(time.Hour, <-clock.waits)
+	clock.advance(time.Hour)
+	<-polled
+}
+
+func (s *FhirhoseTestSuite) TestMemoryLeaseStore() {
+	store := NewMemoryLeaseStore()
+
+	acquired, err := store.Acquire("user", "a", time.Millisecond*50)
+	s.Require().NoError(err)
+	s.True(acquired)
+
+	acquired, _ = store.Acquire("user", "b", time.Millisecond*50)
+	s.False(acquired, "expect lease to be held by a")
+	acquired, _ = store.Acquire("user", "a", time.Millisecond*50)
+	s.True(acquired, "expect holder to renew")
+
+	time.Sleep(time.Millisecond * 60)
+	acquired, _ = store.Acquire("user", "b", time.Millisecond*50)
+	s.True(acquired, "expect expired lease to fail over")
+
+	s.NoError(store.Release("user", "a"))
+	acquired, _ = store.Acquire("user", "a", time.Millisecond*50)
+	s.False(acquired, "expect release by non holder to be ignored")
+}
+
+func (s *FhirhoseTestSuite) TestLeaderFailover() {
+	polled := make(chan bool, 10)
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Poll").Return(nil, false, nil).Run(func(args mock.Arguments) {
+		polled <- true
+	})
+
+	store := NewMemoryLeaseStore()
+	conf := *s.client.Config
+	conf.LeaseStore = store
+	conf.LeaseTTL = time.Millisecond * 60
+	conf.InstanceID = "b"
+	conf.Schedules = map[StreamName]Schedule{"user": {Interval: time.Hour, Immediate: true}}
+
+	// Instance a holds the lease and stops renewing
+	acquired, err := store.Acquire("fhirhose.user", "a", conf.LeaseTTL)
+	s.Require().NoError(err)
+	s.Require().True(acquired)
+
+	start := time.Now()
+	go leadStream(conf, &userStream, nil)
+
+	select {
+	case <-polled:
+		s.True(time.Since(start) >= conf.LeaseTTL, "expect b to wait for the lease of a to expire")
+	case <-time.After(time.Second):
+		s.Fail("expect b to take over polling")
+	}
+}
+
+// switchLeaseStore lease store whose lease is switched by the test
+type switchLeaseStore struct {
+	mu       sync.Mutex
+	leader   bool
+	released bool
+}
+
+func (l *switchLeaseStore) Acquire(key, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader, nil
+}
+
+func (l *switchLeaseStore) Release(key, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	return nil
+}
+
+func (l *switchLeaseStore) set(leader bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leader = leader
+}
+
+// blockingPollStream stream whose polls block until they are cancelled
+type blockingPollStream struct {
+	*IStreamMock
+	started   chan struct{}
+	cancelled chan error
+}
+
+func (b blockingPollStream) PollContext(ctx context.Context) ([]StreamMessage, bool, error) {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return nil, false, ctx.Err()
+}
+
+func (b blockingPollStream) RetrieveContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	return message, nil
+}
+
+func (b blockingPollStream) TransformContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	return message, nil
+}
+
+func (b blockingPollStream) UploadContext(ctx context.Context, message StreamMessage) (StreamMessage, bool, error) {
+	return message, true, nil
+}
+
+func (s *FhirhoseTestSuite) TestLeaderCancelsPollAndReleasesLease() {
+	userStream := blockingPollStream{IStreamMock: &IStreamMock{}, started: make(chan struct{}, 1), cancelled: make(chan error, 1)}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+
+	store := &switchLeaseStore{leader: true}
+	conf := *s.client.Config
+	conf.LeaseStore = store
+	conf.LeaseTTL = time.Millisecond * 60
+	conf.Schedules = map[StreamName]Schedule{"user": {Interval: time.Hour, Immediate: true}}
+	conf.control = newController([]IStream{StreamAdapter{userStream}})
+	stopped := make(chan struct{})
+	go func() {
+		leadStream(conf, StreamAdapter{userStream}, nil)
+		close(stopped)
+	}()
+
+	waitFor := func(channel interface{}, message string) {
+		switch c := channel.(type) {
+		case chan struct{}:
+			select {
+			case <-c:
+			case <-time.After(time.Second):
+				s.FailNow(message)
+			}
+		case chan error:
+			select {
+			case <-c:
+			case <-time.After(time.Second):
+				s.FailNow(message)
+			}
+		}
+	}
+
+	waitFor(userStream.started, "expect the leader to poll")
+	store.set(false)
+	waitFor(userStream.cancelled, "expect the running poll to be cancelled when the lease is lost")
+
+	store.set(true)
+	waitFor(userStream.started, "expect the leader to poll again once elected")
+	conf.control.shutdown()
+	waitFor(userStream.cancelled, "expect the running poll to be cancelled on shutdown")
+	waitFor(stopped, "expect leading to stop on shutdown")
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	s.True(store.released, "expect the lease to be released on shutdown")
+}
+
+// startJetStream starts an embedded nats server with JetStream enabled and connects to it
+func startJetStream(t *testing.T) *nats.Conn {
+	opts := &server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true}
+	natsServer, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(time.Second * 5) {
+		t.Fatal("embedded nats server not ready")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	conn, err := nats.Connect(natsServer.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func (s *FhirhoseTestSuite) TestJetStreamStatusStore() {
+	conn := startJetStream(s.T())
+	store, err := NewJetStreamStatusStore(conn, DefaultStatusStream, DefaultStatusTTL)
+	s.Require().NoError(err)
+
+	status, err := store.Get("user", "2.16.840")
+	s.Require().NoError(err)
+	s.Empty(status.Stages, "expect no stages of an identifier without records")
+
+	conf := *s.client.Config
+	conf.StatusStore = store
+	recordFailed(conf, "user", RetrieveAction, "2.16.840", "", errors.New("503 service unavailable"))
+	recordSucceeded(conf, "user", RetrieveAction, "2.16.840", "")
+	recordSucceeded(conf, "user", UploadAction, "2.16.840", "batch")
+	recordFiltered(conf, "user", UploadAction, "2.16.841", "unchanged")
+
+	status, err = store.Get("user", "2.16.841")
+	s.Require().NoError(err)
+	s.Len(status.Stages, 1)
+	status, err = store.Get("user", "2.16.840")
+	s.Require().NoError(err)
+	s.Len(status.Stages, 2)
+	retrieved := status.Stages[RetrieveAction]
+	s.Require().NotNil(retrieved.LastSucceeded)
+	s.Require().NotNil(retrieved.LastFailed)
+	s.Equal("503 service unavailable", retrieved.Error)
+	s.Equal("batch", status.Stages[UploadAction].BatchID)
+
+	// Readers load the stream without creating it
+	loaded, err := LoadJetStreamStatusStore(conn, DefaultStatusStream)
+	s.Require().NoError(err)
+	status, err = loaded.Get("user", "2.16.840")
+	s.Require().NoError(err)
+	s.Len(status.Stages, 2)
+	_, err = LoadJetStreamStatusStore(conn, "missing_status")
+	s.Error(err)
+
+	// Appends which aren't acknowledged are counted
+	metrics := NewMemoryMetrics()
+	conf.Metrics = metrics
+	conf.StatusStore = &JetStreamStatusStore{Log: &pubsub.Log{Conn: conn, Stream: "missing_status", Timeout: time.Millisecond * 100}}
+	recordSucceeded(conf, "user", RetrieveAction, "2.16.840", "")
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "status_failed"))
+}
+
+func (s *FhirhoseTestSuite) TestKeyValueLeaseStore() {
+	kv, err := pubsub.NewKeyValue(startJetStream(s.T()), "leases", 0)
+	s.Require().NoError(err)
+	store := &KeyValueLeaseStore{KeyValue: kv}
+
+	acquired, err := store.Acquire("fhirhose.user", "a", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.True(acquired, "expect a free lease to be acquired")
+	acquired, err = store.Acquire("fhirhose.car", "b", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.True(acquired, "expect leases of other streams to be independent")
+
+	acquired, err = store.Acquire("fhirhose.user", "b", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.False(acquired, "expect a held lease not to be acquired by another holder")
+	acquired, err = store.Acquire("fhirhose.user", "a", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.True(acquired, "expect the holder to renew its lease")
+
+	time.Sleep(time.Millisecond * 150)
+	acquired, err = store.Acquire("fhirhose.user", "b", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.True(acquired, "expect an expired lease to be taken over")
+
+	s.Require().NoError(store.Release("fhirhose.user", "a"))
+	acquired, err = store.Acquire("fhirhose.user", "a", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.False(acquired, "expect releasing a lease held by another holder to be ignored")
+	s.Require().NoError(store.Release("fhirhose.user", "b"))
+	acquired, err = store.Acquire("fhirhose.user", "a", time.Millisecond*100)
+	s.Require().NoError(err)
+	s.True(acquired, "expect a released lease to be acquired at once")
+}
+
+// limitedStream stream recording the poll limit set by backpressure
+type limitedStream struct {
+	*IStreamMock
+	limit int
+}
+
+func (l *limitedStream) SetPollLimit(limit int) { l.limit = limit }
+
+func (s *FhirhoseTestSuite) TestPollBackpressure() {
+	pending := uint64(0)
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	mockedPubSub.On("Pending", mock.Anything, "fhirhose").Return(func(string, string) uint64 {
+		return pending / 3
+	}, nil)
+
+	userStream := &limitedStream{IStreamMock: &IStreamMock{}}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Poll").Return(nil, false, nil)
+
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.Metrics = metrics
+	conf.Backpressure = &Backpressure{HighWaterMark: 90, LowWaterMark: 30}
+	conf.control = newController([]IStream{userStream})
+
+	pending = 30
+	pollUnlessPaused(context.Background(), conf, userStream, nil)
+	userStream.AssertNumberOfCalls(s.T(), "Poll", 1)
+	s.Equal(60, userStream.limit, "expect the poll to be limited to the headroom")
+
+	pending = 90
+	pollUnlessPaused(context.Background(), conf, userStream, nil)
+	userStream.AssertNumberOfCalls(s.T(), "Poll", 1)
+	state, _ := conf.control.state("user")
+	s.True(state.Backpressure)
+	s.Equal(uint64(90), state.Pending)
+
+	pending = 60
+	pollUnlessPaused(context.Background(), conf, userStream, nil)
+	userStream.AssertNumberOfCalls(s.T(), "Poll", 1)
+
+	pending = 30
+	pollUnlessPaused(context.Background(), conf, userStream, nil)
+	userStream.AssertNumberOfCalls(s.T(), "Poll", 2)
+	state, _ = conf.control.state("user")
+	s.False(state.Backpressure)
+	s.Equal(int64(2), metrics.Get("user", PollAction, "backpressure_skipped"))
+
+	// A zero high water mark disables backpressure
+	conf.Backpressure = &Backpressure{}
+	pending = 90
+	pollUnlessPaused(context.Background(), conf, userStream, nil)
+	userStream.AssertNumberOfCalls(s.T(), "Poll", 3)
+	s.NoError(Backpressure{}.Validate())
+	s.True(errors.Is(Backpressure{HighWaterMark: 10, LowWaterMark: 20}.Validate(), ErrInvalidBackpressure))
+}
+
+func (s *FhirhoseTestSuite) TestRunFailsWhenConsumerMissing() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Pending", mock.Anything, mock.Anything).Return(uint64(0), errors.New("consumer not found"))
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	s.client.Streams = []IStream{&userStream}
+	s.client.Config.PubSub = mockedPubSub
+	s.client.Config.WorkerAmount = 1
+
+	err := s.client.Run()
+	s.True(errors.Is(err, ErrConsumerFailed))
+	s.Contains(err.Error(), "fhirhose-user-polled")
+}
+
+func (s *FhirhoseTestSuite) TestConsumerSupervisorRestarts() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-retrieved", "fhirhose", mock.Anything).Return(errors.New("uknown error from active consumer")).Twice()
+	mockedPubSub.On("Consume", "fhirhose-user-retrieved", "fhirhose", mock.Anything).Return(nil).Once()
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+
+	errChan := make(chan Error, 10)
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.RestartBackoff = time.Millisecond
+	conf.control = newController([]IStream{&userStream})
+
+	consume(conf, "user", TransformAction, "fhirhose-user-retrieved", &errChan, func(msg *nats.Msg) {})
+
+	mockedPubSub.AssertNumberOfCalls(s.T(), "Consume", 3)
+	s.Len(errChan, 2, "expect every failure to be escalated")
+	failure := <-errChan
+	s.Equal(TransformAction, failure.Action)
+	s.True(errors.Is(failure.Err, ErrConsumerFailed))
+
+	state, _ := conf.control.state("user")
+	s.Require().Len(state.Consumers, 1)
+	s.Equal(2, state.Consumers[0].Restarts)
+	s.Contains(state.Consumers[0].LastError, "uknown error from active consumer")
+	s.False(state.Consumers[0].Running)
+}
+
+func (s *FhirhoseTestSuite) TestSpoolReplaysInOrder() {
+	spool, err := NewFileSpool(s.T().TempDir())
+	s.Require().NoError(err)
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(fmt.Errorf("publishing failed: %w", nats.ErrNoResponders)).Once()
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.Metrics = metrics
+	conf.Spool = spool
+
+	publisher := newPollPublisher(conf, "user")
+	for _, subject := range []string{"fhirhose.user.polled.1", "fhirhose.user.polled.2"} {
+		msg := nats.NewMsg(subject)
+		msg.Header.Set(pubsub.MsgIDHeader, subject)
+		s.NoError(publisher.publishOrSpool(msg))
+	}
+	spooled, err := spool.Len()
+	s.NoError(err)
+	s.Equal(2, spooled, "expect the second message to be spooled behind the first")
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+
+	// NATS is available again, spooled messages go first on the next poll
+	s.NoError(newPollPublisher(conf, "user").publishOrSpool(nats.NewMsg("fhirhose.user.polled.3")))
+	spooled, err = spool.Len()
+	s.NoError(err)
+	s.Equal(0, spooled)
+
+	var subjects []string
+	for _, call := range mockedPubSub.Calls[1:] {
+		subjects = append(subjects, call.Arguments.Get(0).(*nats.Msg).Subject)
+	}
+	s.Equal([]string{"fhirhose.user.polled.1", "fhirhose.user.polled.2", "fhirhose.user.polled.3"}, subjects)
+	s.Equal("fhirhose.user.polled.1", mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg).Header.Get(pubsub.MsgIDHeader))
+	s.Equal(int64(2), metrics.Get("user", PollAction, "replayed"), "expect replays to be counted by the stream of the message")
+	s.Equal(StreamName("user"), getSubjectStream(conf, "fhirhosecl.user.polled.4"), "expect custom loads to be counted by their stream")
+
+	// Replaying stops on shutdown
+	conf.control = newController(nil)
+	conf.control.shutdown()
+	done := make(chan struct{})
+	go func() {
+		replaySpoolOnInterval(conf)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.Fail("expect replaying to stop on shutdown")
+	}
+}
+
+func (s *FhirhoseTestSuite) TestSpoolMovesFailedMessagesAside() {
+	dir := s.T().TempDir()
+	spool, err := NewFileSpool(dir)
+	s.Require().NoError(err)
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+	conf.Metrics = metrics
+	conf.Spool = spool
+
+	// Errors which aren't retryable are returned instead of spooled
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(errors.New("maximum payload exceeded")).Once()
+	s.Error(newPollPublisher(conf, "user").publishOrSpool(nats.NewMsg("fhirhose.user.polled.0")))
+	for _, subject := range []string{"fhirhose.user.polled.1", "fhirhose.user.polled.2", "fhirhose.car.polled.3"} {
+		s.Require().NoError(spool.Append(nats.NewMsg(subject)))
+	}
+
+	mockedPubSub.On("PublishMsg", mock.MatchedBy(func(msg *nats.Msg) bool {
+		return msg.Subject == "fhirhose.user.polled.2"
+	})).Return(errors.New("maximum payload exceeded"))
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	replayed, err := replaySpool(conf)
+	s.NoError(err)
+	s.Equal(2, replayed, "expect replaying to continue after the failed message")
+	spooled, err := spool.Len()
+	s.NoError(err)
+	s.Equal(0, spooled)
+
+	failed, err := ioutil.ReadDir(filepath.Join(dir, spoolFailedDir))
+	s.Require().NoError(err)
+	s.Require().Len(failed, 1)
+	reopened, err := NewFileSpool(dir)
+	s.Require().NoError(err)
+	spooled, err = reopened.Len()
+	s.NoError(err)
+	s.Equal(0, spooled, "expect failed messages not to be replayed again")
+	s.Equal(int64(1), metrics.Get("user", PollAction, "spool_failed"))
+	s.Equal(int64(1), metrics.Get("user", PollAction, "replayed"))
+	s.Equal(int64(1), metrics.Get("car", PollAction, "replayed"))
+}
+
+func (s *FhirhoseTestSuite) TestForwardRedeliversWhenPublishFails() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(errors.New("nats: timeout")).Once()
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+
+	conf := *s.client.Config
+	conf.PubSub = mockedPubSub
+
+	s.False(forward(conf, &nats.Msg{}, "user", RetrieveAction, "1", StreamMessage{Identifier: "1"}, nil))
+	s.True(forward(conf, &nats.Msg{}, "user", RetrieveAction, "1", StreamMessage{Identifier: "1"}, nil))
+	s.Equal("fhirhose.user.retrieved.1", mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg).Subject)
+
+	// A message which can't be created because the claim check store is down is redelivered, not dropped
+	store, err := NewFileObjectStore(filepath.Join(s.T().TempDir(), "missing"))
+	s.Require().NoError(err)
+	s.Require().NoError(os.Remove(store.Dir))
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.PubSub = acknowledger
+	conf.ClaimCheckStore = store
+	conf.ClaimCheckThreshold = 1
+	conf.RedeliveryBackoff = time.Millisecond
+	s.False(forward(conf, nats.NewMsg("fhirhose.user.polled.1"), "user", RetrieveAction, "1", StreamMessage{Identifier: "1", Data: []byte("large")}, nil))
+	s.Eventually(func() bool { return acknowledger.nakCount() == 1 }, time.Second, time.Millisecond)
+	acknowledger.mu.Lock()
+	s.Equal(0, acknowledger.acks)
+	acknowledger.mu.Unlock()
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 2)
+}
+
+func (s *FhirhoseTestSuite) TestRunOnBoltBackend() {
+	boltClient, err := pubsub.NewBoltClient(filepath.Join(s.T().TempDir(), "fhirhose.db"))
+	s.Require().NoError(err)
+	defer boltClient.Close()
+
+	uploaded := make(chan StreamMessage, 1)
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Retrieve", mock.Anything).Return(StreamMessage{Identifier: "1", Data: []byte("retrieved")}, nil)
+	userStream.On("Transform", mock.Anything).Return(StreamMessage{Identifier: "1", Data: []byte("transformed")}, nil)
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{}, false, nil).Run(func(args mock.Arguments) {
+		uploaded <- args.Get(0).(StreamMessage)
+	})
+
+	s.client.Config.PubSub = boltClient
+	s.client.Config.DeduplicationEnabled = false
+	s.client.Config.WorkerAmount = 1
+	s.client.Streams = []IStream{&userStream}
+	s.Require().NoError(s.client.Run(), "expect the consumers to be created by the backend")
+
+	msg, err := newStreamMsg(*s.client.Config, "user", GetPublishAction("1", "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: "1"})
+	s.Require().NoError(err)
+	s.Require().NoError(boltClient.PublishMsg(msg))
+
+	select {
+	case message := <-uploaded:
+		s.Equal([]byte("transformed"), message.Data)
+	case <-time.After(time.Second * 5):
+		s.Fail("expect the message to pass every stage")
+	}
+}
+
+// acknowledgingPubSub pubsub client recording the acknowledgements of consumed messages
+type acknowledgingPubSub struct {
+	*psmocks.IPubSubClient
+	mu         sync.Mutex
+	acks       int
+	naks       int
+	inProgress int
+}
+
+func (a *acknowledgingPubSub) Ack(*nats.Msg) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks++
+	return nil
+}
+
+func (a *acknowledgingPubSub) Nak(*nats.Msg) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.naks++
+	return nil
+}
+
+// nakCount returns the amount of negative acknowledgements, which may be sent after a backoff
+func (a *acknowledgingPubSub) nakCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.naks
+}
+
+func (a *acknowledgingPubSub) InProgress(*nats.Msg) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inProgress++
+	return nil
+}
+
+// contextStream context aware stream blocking until the context is cancelled
+type contextStream struct {
+	*IStreamMock
+}
+
+func (c contextStream) PollContext(ctx context.Context) ([]StreamMessage, bool, error) {
+	<-ctx.Done()
+	return nil, false, ctx.Err()
+}
+
+func (c contextStream) RetrieveContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	<-ctx.Done()
+	return message, ctx.Err()
+}
+
+func (c contextStream) TransformContext(ctx context.Context, message StreamMessage) (StreamMessage, error) {
+	return message, nil
+}
+
+func (c contextStream) UploadContext(ctx context.Context, message StreamMessage) (StreamMessage, bool, error) {
+	return message, true, nil
+}
+
+func (s *FhirhoseTestSuite) TestStageTimeoutKeepsMessageInProgress() {
+	hung := make(chan struct{})
+	defer close(hung)
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Retrieve", mock.Anything).Return(StreamMessage{}, nil).Run(func(args mock.Arguments) {
+		<-hung
+	})
+
+	acknowledger := &acknowledgingPubSub{IPubSubClient: &psmocks.IPubSubClient{}}
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = acknowledger
+	conf.Metrics = metrics
+	conf.StageTimeouts = map[ActionName]time.Duration{RetrieveAction: time.Millisecond * 100}
+	conf.InProgressInterval = time.Millisecond * 20
+
+	err := runStage(conf, "user", RetrieveAction, nats.NewMsg("fhirhose.user.polled.1"), func(ctx context.Context) error {
+		_, err := WithContext(&userStream).RetrieveContext(ctx, StreamMessage{Identifier: "1"})
+		return err
+	})
+	s.True(errors.Is(err, ErrStageTimeout), "expect the hung retrieve to time out")
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "timeouts"))
+
+	acknowledger.mu.Lock()
+	defer acknowledger.mu.Unlock()
+	s.GreaterOrEqual(acknowledger.inProgress, 2, "expect the message to be kept in progress while the stage runs")
+}
+
+func (s *FhirhoseTestSuite) TestAbandonedRunsAreLimited() {
+	hung := make(chan struct{})
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Retrieve", mock.Anything).Return(StreamMessage{}, nil).Run(func(args mock.Arguments) {
+		<-hung
+	})
+
+	acknowledger := &acknowledgingPubSub{IPubSubClient: &psmocks.IPubSubClient{}}
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = acknowledger
+	conf.Metrics = metrics
+	conf.control = newController([]IStream{&userStream})
+	conf.StageTimeouts = map[ActionName]time.Duration{RetrieveAction: time.Millisecond * 50}
+	conf.InProgressInterval = time.Millisecond * 10
+	conf.RedeliveryBackoff = time.Millisecond
+	conf.MaxAbandonedRuns = 1
+
+	retrieve := func(ctx context.Context) error {
+		_, err := WithContext(&userStream).RetrieveContext(ctx, StreamMessage{Identifier: "1"})
+		return err
+	}
+	msg := nats.NewMsg("fhirhose.user.polled.1")
+	timedOut := runStage(conf, "user", RetrieveAction, msg, retrieve)
+	s.True(errors.Is(timedOut, ErrStageTimeout), "expect the hung retrieve to time out")
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "abandoned"))
+
+	// The abandoned run is still running, no further run is started
+	refused := runStage(conf, "user", RetrieveAction, nats.NewMsg("fhirhose.user.polled.2"), retrieve)
+	s.True(errors.Is(refused, ErrAbandonedRuns), "expect the stage to refuse another run")
+	s.Equal(ErrTransient, classify(refused))
+	userStream.AssertNumberOfCalls(s.T(), "Retrieve", 1)
+
+	// The message of the abandoned run is redelivered once the run returned
+	s.False(settleFailure(conf, "user", RetrieveAction, msg, nil, timedOut, nil))
+	s.False(settleFailure(conf, "user", RetrieveAction, nats.NewMsg("fhirhose.user.polled.2"), nil, refused, nil))
+	s.Eventually(func() bool { return acknowledger.nakCount() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 50)
+	s.Equal(1, acknowledger.nakCount(), "expect no redelivery while the abandoned run is running")
+
+	close(hung)
+	s.Eventually(func() bool { return acknowledger.nakCount() == 2 }, time.Second, time.Millisecond)
+	s.Eventually(func() bool { return !conf.control.abandonedRuns(conf, "user", RetrieveAction).full() }, time.Second, time.Millisecond)
+}
+
+func (s *FhirhoseTestSuite) TestAbandonedRunDoesNotWriteResults() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{Identifier: "late"}, true, nil).Run(func(args mock.Arguments) {
+		time.Sleep(time.Millisecond * 50)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	updated, shouldUpload, err := WithContext(&userStream).UploadContext(ctx, StreamMessage{Identifier: "1"})
+	s.True(errors.Is(err, context.DeadlineExceeded))
+
+	// The abandoned upload returns meanwhile, the race detector reports writes to the returned values
+	time.Sleep(time.Millisecond * 100)
+	s.Empty(updated.Identifier)
+	s.False(shouldUpload)
+}
+
+func (s *FhirhoseTestSuite) TestShutdownRedeliversMessage() {
+	userStream := StreamAdapter{IContextStream: contextStream{IStreamMock: &IStreamMock{}}}
+	userStream.IContextStream.(contextStream).On("GetStreamName").Return(StreamName("user"))
+
+	acknowledger := &acknowledgingPubSub{IPubSubClient: &psmocks.IPubSubClient{}}
+	conf := *s.client.Config
+	conf.PubSub = acknowledger
+	conf.control = newController([]IStream{userStream})
+
+	msg := nats.NewMsg("fhirhose.user.polled.1")
+	result := make(chan error)
+	go func() {
+		result <- runStage(conf, "user", RetrieveAction, msg, func(ctx context.Context) error {
+			_, err := WithContext(userStream).RetrieveContext(ctx, StreamMessage{Identifier: "1"})
+			return err
+		})
+	}()
+
+	conf.control.shutdown()
+	err := <-result
+	s.True(errors.Is(err, ErrShutdown), "expect the running stage to be cancelled")
+	s.True(redeliverOnShutdown(conf, msg))
+	s.Equal(1, acknowledger.naks, "expect the message to be handed back")
+
+	// Pollers stop on shutdown
+	done := make(chan struct{})
+	go func() {
+		pollOnInterval(context.Background(), conf, userStream, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.Fail("expect polling to stop on shutdown")
+	}
+}
+
+func (s *FhirhoseTestSuite) TestTransformPanicIsRecovered() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Transform", mock.Anything).Return(StreamMessage{}, nil).Run(func(args mock.Arguments) {
+		var fields map[string]string
+		fields["resourceType"] = "Patient"
+	})
+
+	conf := *s.client.Config
+	msg, err := newStreamMsg(conf, "user", GetPublishAction("1", "user", DefaultConsumerPrefix, RetrieveAction), StreamMessage{Identifier: "1"})
+	s.Require().NoError(err)
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-retrieved", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(msg)
+	})
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	metrics := NewMemoryMetrics()
+	conf.PubSub = acknowledger
+	conf.Metrics = metrics
+
+	errChan := make(chan Error, 10)
+	handleTransform(conf.GetConsumerPrefix(), &userStream, conf, &errChan)
+
+	s.Require().Len(errChan, 1, "expect the panic to be escalated")
+	failure := <-errChan
+	var panicErr *PanicError
+	s.Require().True(errors.As(failure.Err, &panicErr))
+	s.True(errors.Is(failure.Err, ErrPanic))
+	s.Contains(string(panicErr.Stack), "TestTransformPanicIsRecovered", "expect the stack of the panicking stream")
+	s.Equal(TransformAction, failure.Action)
+	s.Equal(int64(1), metrics.Get("user", TransformAction, "panics"))
+	s.Equal(1, acknowledger.acks, "expect the message to be handled like any other failure")
+	deadLetter := mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.deadletter."+EncodeIdentifier("1"), deadLetter.Subject, "expect the panic to be dead lettered")
+	s.Equal(string(TransformAction), deadLetter.Header.Get(FailedActionHeader))
+}
+
+func (s *FhirhoseTestSuite) TestCallbackAndPollPanicsAreRecovered() {
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	metrics := NewMemoryMetrics()
+	conf := *s.client.Config
+	conf.PubSub = acknowledger
+	conf.Metrics = metrics
+
+	errChan := make(chan Error, 10)
+	callback := recoverCallback(conf, "user", DebounceAction, &errChan, func(msg *nats.Msg) {
+		panic("unexpected message")
+	})
+	callback(nats.NewMsg("fhirhose.user.polled.1"))
+	s.Require().Len(errChan, 1)
+	s.True(errors.Is((<-errChan).Err, ErrPanic))
+	s.Equal(1, acknowledger.acks)
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Poll").Return(nil, false, nil).Run(func(args mock.Arguments) {
+		panic("source unavailable")
+	})
+	pollRecovered(context.Background(), conf, &userStream, &errChan)
+	s.Require().Len(errChan, 1)
+	failure := <-errChan
+	s.Equal(PollAction, failure.Action)
+	s.True(errors.Is(failure.Err, ErrPanic))
+	s.Equal(int64(1), metrics.Get("user", PollAction, "panics"))
+	s.Equal(int64(1), metrics.Get("user", DebounceAction, "panics"))
+
+	// Messages settled before the panic aren't settled again
+	published := len(mockedPubSub.Calls)
+	callback = recoverCallback(conf, "user", UploadAction, &errChan, func(msg *nats.Msg) {
+		acknowledge(conf, msg)
+		panic("after acknowledgement")
+	})
+	callback(nats.NewMsg("fhirhose.user.transformed.1"))
+	s.Require().Len(errChan, 1)
+	s.True(errors.Is((<-errChan).Err, ErrPanic))
+	s.Equal(2, acknowledger.acks, "expect the message to be acknowledged once")
+	s.Len(mockedPubSub.Calls, published, "expect the message not to be dead lettered")
+}
+
+// endpointStream stream uploading to a shared endpoint
+type endpointStream struct {
+	*IStreamMock
+}
+
+func (e endpointStream) GetEndpoint(action ActionName) string {
+	if action == UploadAction {
+		return "fhir-server"
+	}
+	return ""
+}
+
+func (s *FhirhoseTestSuite) TestCircuitBreakerValidation() {
+	rate, err := CircuitBreaker{}.getErrorRate()
+	s.NoError(err)
+	s.Equal(DefaultCircuitErrorRate, rate, "expect an unset error rate to use the default")
+	s.NoError(CircuitBreaker{ErrorRate: 1}.Validate())
+	for _, invalid := range []float64{-0.5, 1.5, math.NaN()} {
+		s.True(errors.Is(CircuitBreaker{ErrorRate: invalid}.Validate(), ErrInvalidCircuitBreaker), "expect error rate %v to be rejected", invalid)
+	}
+
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	s.client.Streams = []IStream{&userStream}
+	s.client.Config.CircuitBreakers = map[string]CircuitBreaker{"user.uploaded": {ErrorRate: 2}}
+	err = s.client.Run()
+	s.True(errors.Is(err, ErrInvalidCircuitBreaker), "expect the client not to run with an invalid circuit breaker")
+}
+
+func (s *FhirhoseTestSuite) TestCircuitBreakerUsesClock() {
+	clock := newFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	conf := *s.client.Config
+	conf.Clock = clock
+	breaker := &circuit{name: "user.uploaded", state: CircuitClosed, breaker: CircuitBreaker{MinRequests: 2, OpenDuration: time.Minute}}
+
+	recordCircuit(conf, "user", UploadAction, breaker, errors.New("503 service unavailable"), nil)
+	recordCircuit(conf, "user", UploadAction, breaker, nil, nil)
+	s.False(allowCircuit(conf, "user", UploadAction, breaker, nil), "expect the default error rate to open the circuit")
+
+	// The open duration passes on the clock of the config
+	clock.mu.Lock()
+	clock.now = clock.now.Add(time.Minute)
+	clock.mu.Unlock()
+	s.True(allowCircuit(conf, "user", UploadAction, breaker, nil))
+}
+
+func (s *FhirhoseTestSuite) TestCircuitBreakerStates() {
+	breaker := &circuit{name: "user.uploaded", state: CircuitClosed, breaker: CircuitBreaker{ErrorRate: 0.5, MinRequests: 4, OpenDuration: time.Minute}}
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	for _, failed := range []bool{false, true, false} {
+		_, changed := breaker.record(now, failed)
+		s.False(changed, "expect the circuit to wait for the minimum requests")
+	}
+	state, changed := breaker.record(now, true)
+	s.True(changed)
+	s.Equal(CircuitOpen, state)
+
+	allowed, _, _ := breaker.allow(now.Add(time.Second))
+	s.False(allowed, "expect an open circuit to hold back requests")
+	s.Equal(time.Second*59, breaker.retryIn(now.Add(time.Second)))
+
+	allowed, state, changed = breaker.allow(now.Add(time.Minute))
+	s.True(allowed && changed)
+	s.Equal(CircuitHalfOpen, state)
+	allowed, _, _ = breaker.allow(now.Add(time.Minute))
+	s.False(allowed, "expect a single probe while half open")
+
+	state, _ = breaker.record(now.Add(time.Minute), true)
+	s.Equal(CircuitOpen, state, "expect a failed probe to open the circuit again")
+	breaker.allow(now.Add(time.Minute * 2))
+	state, _ = breaker.record(now.Add(time.Minute*2), false)
+	s.Equal(CircuitClosed, state, "expect a successful probe to close the circuit")
+
+	// Streams share the circuit breaker of their endpoint
+	userStream := endpointStream{IStreamMock: &IStreamMock{}}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	carStream := endpointStream{IStreamMock: &IStreamMock{}}
+	carStream.On("GetStreamName").Return(StreamName("car"))
+	conf := *s.client.Config
+	conf.CircuitBreakers = map[string]CircuitBreaker{"fhir-server": {ErrorRate: 0.5}, "user.retrieved": {ErrorRate: 0.5}}
+	conf.control = newController([]IStream{userStream, carStream})
+	s.NotNil(getCircuit(conf, userStream, UploadAction))
+	s.Same(getCircuit(conf, userStream, UploadAction), getCircuit(conf, carStream, UploadAction))
+	s.NotNil(getCircuit(conf, userStream, RetrieveAction))
+	s.Nil(getCircuit(conf, carStream, RetrieveAction), "expect stages without configured circuit to pass")
+}
+
+func (s *FhirhoseTestSuite) TestCircuitBreakerHoldsBackUploads() {
+	var uploadTimes []time.Time
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{}, false, errors.New("fhir server unavailable")).Twice().Run(func(args mock.Arguments) {
+		uploadTimes = append(uploadTimes, time.Now())
+	})
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{}, false, nil).Run(func(args mock.Arguments) {
+		uploadTimes = append(uploadTimes, time.Now())
+	})
+
+	conf := *s.client.Config
+	msg, err := newStreamMsg(conf, "user", GetPublishAction("1", "user", DefaultConsumerPrefix, TransformAction), StreamMessage{Identifier: "1"})
+	s.Require().NoError(err)
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-transformed", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for i := 0; i < 3; i++ {
+			args.Get(2).(func(msg *nats.Msg))(msg)
+		}
+	})
+	metrics := NewMemoryMetrics()
+	conf.PubSub = &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.Metrics = metrics
+	conf.CircuitBreakers = map[string]CircuitBreaker{
+		GetCircuitName("user", UploadAction): {ErrorRate: 1, MinRequests: 2, OpenDuration: time.Millisecond * 100},
+	}
+	conf.control = newController([]IStream{&userStream})
+
+	errChan := make(chan Error, 10)
+	handleUpload(conf.GetConsumerPrefix(), &userStream, conf, &errChan, nil)
+
+	var states []CircuitState
+	for len(errChan) > 0 {
+		var circuitErr *CircuitError
+		if failure := <-errChan; errors.As(failure.Err, &circuitErr) {
+			s.Equal("user.uploaded", circuitErr.Circuit)
+			states = append(states, circuitErr.State)
+		}
+	}
+	s.Equal([]CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}, states)
+	s.Require().Len(uploadTimes, 3)
+	s.True(uploadTimes[2].Sub(uploadTimes[1]) >= time.Millisecond*100, "expect the probe to wait for the open duration")
+	s.Equal(int64(1), metrics.Get("user", UploadAction, "circuit_open"))
+	s.Equal(int64(1), metrics.Get("user", UploadAction, "circuit_half_open"))
+}
+
+func (s *FhirhoseTestSuite) TestStageErrorClassification() {
+	failures := map[string]error{
+		"filtered":  Skip(errors.New("inactive patient")),
+		"transient": Transient(errors.New("503 service unavailable")),
+		"permanent": Permanent(errors.New("invalid birth date")),
+		"unknown":   errors.New("unexpected response"),
+	}
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	for identifier, failure := range failures {
+		identifier := identifier
+		userStream.On("Retrieve", mock.MatchedBy(func(message StreamMessage) bool {
+			return message.Identifier == identifier
+		})).Return(StreamMessage{Identifier: identifier}, failure)
+	}
+
+	conf := *s.client.Config
+	conf.RedeliveryBackoff = time.Millisecond
+	var msgs []*nats.Msg
+	for _, identifier := range []string{"filtered", "transient", "permanent", "unknown"} {
+		msg, err := newStreamMsg(conf, "user", GetPublishAction(identifier, "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: identifier})
+		s.Require().NoError(err)
+		msgs = append(msgs, msg)
+	}
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-polled", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for _, msg := range msgs {
+			args.Get(2).(func(msg *nats.Msg))(msg)
+		}
+	})
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	metrics := NewMemoryMetrics()
+	conf.PubSub = acknowledger
+	conf.Metrics = metrics
+
+	errChan := make(chan Error, 10)
+	handleRetrieve(conf.GetConsumerPrefix(), &userStream, conf, &errChan)
+
+	s.Equal(3, acknowledger.acks, "expect the skip, the dead letter and the unclassified failure to be acknowledged")
+	s.Eventually(func() bool { return acknowledger.nakCount() == 1 }, time.Second, time.Millisecond, "expect the transient failure to be redelivered")
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "filtered"))
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "retried"))
+	s.Equal(int64(1), metrics.Get("user", RetrieveAction, "dead_lettered"))
+
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+	deadLetter := mockedPubSub.Calls[1].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.deadletter."+EncodeIdentifier("permanent"), deadLetter.Subject)
+	s.Equal("permanent failure: invalid birth date", deadLetter.Header.Get(FailureHeader))
+	s.Equal(msgs[2].Data, deadLetter.Data)
+
+	s.Require().Len(errChan, 3, "expect every failure except the skip to be escalated")
+	var err error = <-errChan
+	s.True(errors.Is(err, ErrTransient), "expect the error to unwrap to its class")
+	s.Equal("user retrieved: transient failure: 503 service unavailable", err.Error())
+	s.True(errors.Is(<-errChan, ErrPermanent))
+	unknown := <-errChan
+	s.False(errors.Is(unknown, ErrTransient) || errors.Is(unknown, ErrPermanent))
+}
+
+func (s *FhirhoseTestSuite) TestTransientFailureRedelivery() {
+	conf := *s.client.Config
+	s.Equal(time.Second, conf.getRedeliveryBackoff(1))
+	s.Equal(time.Second*4, conf.getRedeliveryBackoff(3))
+	s.Equal(DefaultMaxRedeliveryBackoff, conf.getRedeliveryBackoff(100))
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.PubSub = acknowledger
+	conf.RedeliveryBackoff = time.Millisecond * 50
+	conf.InProgressInterval = time.Millisecond * 10
+	conf.MaxDeliveries = 3
+
+	msg := nats.NewMsg(GetPublishAction("1", "user", DefaultConsumerPrefix, PollAction))
+	msg.Reply = "$BOLT.ACK.fhirhose-user-polled.1.1"
+	failure := Transient(errors.New("503 service unavailable"))
+	s.False(settleFailure(conf, "user", RetrieveAction, msg, nil, failure, nil))
+	s.Equal(0, acknowledger.nakCount(), "expect the redelivery to wait for the backoff")
+	s.Eventually(func() bool { return acknowledger.nakCount() == 1 }, time.Second, time.Millisecond)
+	acknowledger.mu.Lock()
+	s.Greater(acknowledger.inProgress, 0, "expect the message to be kept in progress during the backoff")
+	acknowledger.mu.Unlock()
+
+	// The last delivery is dead lettered instead of redelivered
+	msg.Reply = "$BOLT.ACK.fhirhose-user-polled.3.1"
+	s.False(settleFailure(conf, "user", RetrieveAction, msg, nil, failure, nil))
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+	deadLetter := mockedPubSub.Calls[0].Arguments.Get(0).(*nats.Msg)
+	s.Equal("fhirhose.user.deadletter.1", deadLetter.Subject)
+	s.Equal("permanent failure: failed 3 deliveries: transient failure: 503 service unavailable", deadLetter.Header.Get(FailureHeader))
+	acknowledger.mu.Lock()
+	s.Equal(1, acknowledger.acks)
+	acknowledger.mu.Unlock()
+}
+
+func (s *FhirhoseTestSuite) TestPipelineEvents() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Retrieve", mock.MatchedBy(func(message StreamMessage) bool {
+		return message.Identifier == "inactive"
+	})).Return(StreamMessage{Identifier: "inactive"}, Skip(errors.New("inactive patient")))
+	userStream.On("Retrieve", mock.MatchedBy(func(message StreamMessage) bool {
+		return message.Identifier == "invalid"
+	})).Return(StreamMessage{Identifier: "invalid"}, Permanent(errors.New("invalid birth date")))
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{Identifier: "a.b"}, false, nil)
+
+	conf := *s.client.Config
+	conf.EventsEnabled = true
+	var retrieveMsgs []*nats.Msg
+	for _, identifier := range []string{"inactive", "invalid"} {
+		msg, err := newStreamMsg(conf, "user", GetPublishAction(identifier, "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: identifier})
+		s.Require().NoError(err)
+		retrieveMsgs = append(retrieveMsgs, msg)
+	}
+	uploadMsg, err := newStreamMsg(conf, "user", GetPublishAction("a.b", "user", DefaultConsumerPrefix, TransformAction), StreamMessage{Identifier: "a.b"})
+	s.Require().NoError(err)
+
+	events := map[string]PipelineEvent{}
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-polled", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for _, msg := range retrieveMsgs {
+			args.Get(2).(func(msg *nats.Msg))(msg)
+		}
+	})
+	mockedPubSub.On("Consume", "fhirhose-user-transformed", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(uploadMsg)
+	})
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	mockedPubSub.On("Publish", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		var event PipelineEvent
+		s.Require().NoError(json.Unmarshal(args.Get(1).([]byte), &event))
+		events[args.String(0)] = event
+	})
+	conf.PubSub = &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+
+	handleRetrieve(conf.GetConsumerPrefix(), &userStream, conf, nil)
+	handleUpload(conf.GetConsumerPrefix(), &userStream, conf, nil, nil)
+
+	s.Require().Len(events, 3)
+	filtered := events["fhirhose.user.filtered.inactive"]
+	s.Equal(EventSchemaVersion, filtered.Version)
+	s.Equal(FilteredAction, filtered.Type)
+	s.Equal(RetrieveAction, filtered.Action)
+	s.Equal("inactive patient", filtered.Reason)
+	s.False(filtered.Time.IsZero())
+
+	failed := events["fhirhose.user.failed.invalid"]
+	s.Equal(FailedAction, failed.Type)
+	s.Equal(StreamName("user"), failed.Stream)
+	s.Equal("invalid", failed.Identifier)
+	s.Equal("permanent", failed.Class)
+	s.True(failed.DeadLettered)
+	s.Equal("permanent failure: invalid birth date", failed.Error)
+
+	uploaded := events["fhirhose.user.uploaded."+EncodeIdentifier("a.b")]
+	s.Equal(UploadAction, uploaded.Type)
+	s.Equal("a.b", uploaded.Identifier)
+}
+
+func (s *FhirhoseTestSuite) TestPipelineEventMatchesSchema() {
+	schemaData, err := ioutil.ReadFile(filepath.Join("schema", "event.v1.json"))
+	s.Require().NoError(err)
+	var schema struct {
+		Required   []string `json:"required"`
+		Properties map[string]struct {
+			Const *int     `json:"const"`
+			Enum  []string `json:"enum"`
+		} `json:"properties"`
+	}
+	s.Require().NoError(json.Unmarshal(schemaData, &schema))
+	s.Equal(EventSchemaVersion, *schema.Properties["version"].Const)
+	s.ElementsMatch([]string{string(UploadAction), string(FailedAction), string(FilteredAction)}, schema.Properties["type"].Enum)
+
+	data, err := json.Marshal(PipelineEvent{
+		Version: EventSchemaVersion, Type: FailedAction, Stream: "user", Identifier: "1", Action: UploadAction,
+		Error: "failed", Class: "permanent", DeadLettered: true, Reason: "reason", Time: time.Now(),
+	})
+	s.Require().NoError(err)
+	var fields map[string]interface{}
+	s.Require().NoError(json.Unmarshal(data, &fields))
+	s.Len(fields, len(schema.Properties), "expect every field of the event to be described by the schema")
+	for field := range fields {
+		s.Contains(schema.Properties, field)
+	}
+
+	data, err = json.Marshal(PipelineEvent{})
+	s.Require().NoError(err)
+	fields = map[string]interface{}{}
+	s.Require().NoError(json.Unmarshal(data, &fields))
+	for field := range fields {
+		s.Contains(schema.Required, field, "expect fields without omitempty to be required")
+	}
+}
+
+func (s *FhirhoseTestSuite) TestProcessingStatus() {
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	userStream.On("Retrieve", mock.Anything).Return(StreamMessage{}, Transient(errors.New("503 service unavailable"))).Once()
+	userStream.On("Retrieve", mock.Anything).Return(StreamMessage{Identifier: "2.16.840"}, nil)
+	userStream.On("Upload", mock.Anything).Return(StreamMessage{Identifier: "2.16.840"}, false, nil)
+
+	conf := *s.client.Config
+	conf.StatusStore = NewMemoryStatusStore()
+	retrieveMsg, err := newStreamMsg(conf, "user", GetPublishAction("2.16.840", "user", DefaultConsumerPrefix, PollAction), StreamMessage{Identifier: "2.16.840"})
+	s.Require().NoError(err)
+	uploadMsg, err := newStreamMsg(conf, "user", GetPublishAction("2.16.840", "user", DefaultConsumerPrefix, TransformAction), StreamMessage{Identifier: "2.16.840"})
+	s.Require().NoError(err)
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("Consume", "fhirhose-user-polled", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(retrieveMsg)
+		args.Get(2).(func(msg *nats.Msg))(retrieveMsg)
+	})
+	mockedPubSub.On("Consume", "fhirhose-user-transformed", "fhirhose", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(msg *nats.Msg))(uploadMsg)
+	})
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	conf.PubSub = &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+
+	handleRetrieve(conf.GetConsumerPrefix(), &userStream, conf, nil)
+	handleUpload(conf.GetConsumerPrefix(), &userStream, conf, nil, nil)
+
+	status, err := GetStatus(conf.StatusStore, "user", "2.16.840")
+	s.Require().NoError(err)
+	s.Len(status.Stages, 2)
+	retrieved := status.Stages[RetrieveAction]
+	s.Require().NotNil(retrieved.LastSucceeded)
+	s.Require().NotNil(retrieved.LastFailed)
+	s.False(retrieved.LastSucceeded.Before(*retrieved.LastFailed), "expect the redelivered message to succeed after the failure")
+	s.Equal("transient failure: 503 service unavailable", retrieved.Error)
+	s.NotNil(status.Stages[UploadAction].LastSucceeded)
+
+	s.client.Streams = []IStream{&userStream}
+	s.client.Config.AdminToken = "secret"
+	s.client.Config.StatusStore = conf.StatusStore
+	server := httptest.NewServer(s.client.AdminHandler())
+	defer server.Close()
+	request := func(method, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+"/streams/user/status", strings.NewReader(body))
+		s.Require().NoError(err)
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		s.Require().NoError(err)
+		return res
+	}
+
+	res := request(http.MethodPost, `{"identifier": "2.16.840"}`)
+	s.Equal(http.StatusOK, res.StatusCode)
+	var response ProcessingStatus
+	s.Require().NoError(json.NewDecoder(res.Body).Decode(&response))
+	s.Equal("2.16.840", response.Identifier)
+	s.Equal(status.Stages[RetrieveAction].Error, response.Stages[RetrieveAction].Error)
+
+	res = request(http.MethodPost, `{"identifier": "unknown"}`)
+	s.Equal(http.StatusNotFound, res.StatusCode)
+	res = request(http.MethodPost, `{}`)
+	s.Equal(http.StatusBadRequest, res.StatusCode)
+	res = request(http.MethodGet, "")
+	s.Equal(http.StatusNotFound, res.StatusCode, "expect the identifier to be refused in the url")
+}
+
+func (s *FhirhoseTestSuite) TestUploadCallbackRetriesBatch() {
+	var batches [][]StreamMessage
+	uploadFunc := UploadHandlerFunc(func(messages []StreamMessage) error {
+		batches = append(batches, messages)
+		if len(batches) == 1 {
+			return errors.New("fhir server unavailable")
+		}
+		return nil
+	})
+	userStream := IStreamMock{}
+	userStream.On("GetStreamName").Return(StreamName("user"))
+	s.client.Streams = []IStream{&userStream}
+	s.client.UploadCallback = &uploadFunc
+	s.client.Config.StatusStore = NewMemoryStatusStore()
+	s.client.Config.UploadBatchSize = 0
+	s.client.Config.UploadRetryBackoff = time.Millisecond
+	uploadChannel := make(chan StreamMessage)
+	s.client.uploadChannel = &uploadChannel
+	s.Require().NoError(s.client.Run())
+
+	uploadChannel <- StreamMessage{Identifier: "1", stream: "user", identifier: "1"}
+	s.Eventually(func() bool {
+		status, err := GetStatus(s.client.Config.StatusStore, "user", "1")
+		return err == nil && status.Stages[UploadAction].LastSucceeded != nil
+	}, time.Second, time.Millisecond*10)
+
+	status, err := GetStatus(s.client.Config.StatusStore, "user", "1")
+	s.Require().NoError(err)
+	uploaded := status.Stages[UploadAction]
+	s.NotNil(uploaded.LastFailed)
+	s.Equal("transient failure: fhir server unavailable", uploaded.Error, "expect upload callback errors to be retried")
+	s.Len(uploaded.BatchID, 16)
+}
+
+func (s *FhirhoseTestSuite) TestBatchUploadsFlushPartialBatch() {
+	conf := *s.client.Config
+	conf.UploadBatchSize = 10
+	conf.InProgressInterval = time.Millisecond * 20
+	acknowledger := &acknowledgingPubSub{IPubSubClient: &psmocks.IPubSubClient{}}
+	conf.PubSub = acknowledger
+
+	handled := make(chan []StreamMessage, 1)
+	handler := func(uploads []StreamMessage) ([]error, error) {
+		handled <- uploads
+		return nil, nil
+	}
+	uploadChan := make(chan StreamMessage)
+	stopped := make(chan struct{})
+	go func() {
+		batchUploads(conf, handler, &uploadChan, nil)
+		close(stopped)
+	}()
+
+	start := time.Now()
+	uploadChan <- StreamMessage{Identifier: "1", consumed: nats.NewMsg("fhirhose.user.transformed.1")}
+	select {
+	case uploads := <-handled:
+		s.Len(uploads, 1)
+		s.True(time.Since(start) >= batchMaxWait, "expect the partial batch to wait for more items")
+	case <-time.After(batchMaxWait * 3):
+		s.FailNow("expect the partial batch to be handled without new items")
+	}
+	close(uploadChan)
+	<-stopped
+
+	acknowledger.mu.Lock()
+	defer acknowledger.mu.Unlock()
+	s.Equal(1, acknowledger.acks)
+	s.Greater(acknowledger.inProgress, 0, "expect the collected item to be kept in progress while it waits")
+}
+
+func (s *FhirhoseTestSuite) TestBatchHandlerResults() {
+	conf := *s.client.Config
+	conf.StatusStore = NewMemoryStatusStore()
+	conf.UploadMaxAttempts = 2
+	conf.UploadRetryBackoff = time.Millisecond
+	conf.RedeliveryBackoff = time.Millisecond
+	metrics := NewMemoryMetrics()
+	conf.Metrics = metrics
+
+	mockedPubSub := &psmocks.IPubSubClient{}
+	mockedPubSub.On("PublishMsg", mock.Anything).Return(nil)
+	acknowledger := &acknowledgingPubSub{IPubSubClient: mockedPubSub}
+	conf.PubSub = acknowledger
+
+	var batch []StreamMessage
+	for _, identifier := range []string{"uploaded", "invalid", "busy", "inactive"} {
+		msg, err := newStreamMsg(conf, "user", GetPublishAction(identifier, "user", DefaultConsumerPrefix, TransformAction), StreamMessage{Identifier: identifier})
+		s.Require().NoError(err)
+		batch = append(batch, StreamMessage{Identifier: identifier, stream: "user", identifier: identifier, consumed: msg})
+	}
+
+	var attempts [][]string
+	handler := func(uploads []StreamMessage) ([]error, error) {
+		var identifiers []string
+		results := make([]error, len(uploads))
+		for i, upload := range uploads {
+			identifiers = append(identifiers, upload.Identifier)
+			switch upload.Identifier {
+			case "invalid":
+				results[i] = Permanent(errors.New("invalid resource"))
+			case "busy":
+				results[i] = errors.New("409 conflict")
+			case "inactive":
+				results[i] = Skip(errors.New("inactive patient"))
+			}
+		}
+		attempts = append(attempts, identifiers)
+		return results, nil
+	}
+
+	errChan := make(chan Error, 10)
+	inProgress := newBatchInProgress(conf)
+	defer inProgress.stop()
+	uploadBatch(conf, "user", handler, batch, nil, inProgress, &errChan)
+
+	s.Equal([][]string{{"uploaded", "invalid", "busy", "inactive"}, {"busy"}}, attempts, "expect only the retryable item to be retried")
+	s.Equal(int64(1), metrics.Get("user", UploadAction, "batch_retried"), "expect retries to be counted on the stream of the batch")
+	s.Equal(3, acknowledger.acks, "expect the uploaded, dead lettered and filtered items to be acknowledged")
+	s.Eventually(func() bool { return acknowledger.nakCount() == 1 }, time.Second, time.Millisecond, "expect the retryable item to be requeued after the last attempt")
+	mockedPubSub.AssertNumberOfCalls(s.T(), "PublishMsg", 1)
+	s.Equal("fhirhose.user.deadletter.invalid", mockedPubSub.Calls[0].Arguments.Get(0).(*nats.Msg).Subject)
+
+	s.Require().Len(errChan, 2)
+	for _, identifier := range []string{"invalid", "busy"} {
+		err := <-errChan
+		s.Require().NotNil(err.StreamMessage, "expect the error to reference the failed item")
+		s.Equal(identifier, err.StreamMessage.Identifier)
+	}
+
+	status, err := GetStatus(conf.StatusStore, "user", "busy")
+	s.Require().NoError(err)
+	s.Equal("transient failure: 409 conflict", status.Stages[UploadAction].Error)
+	s.NotEmpty(status.Stages[UploadAction].BatchID)
+	status, err = GetStatus(conf.StatusStore, "user", "uploaded")
+	s.Require().NoError(err)
+	s.NotNil(status.Stages[UploadAction].LastSucceeded)
+
+	_, err = handleBatch(handler, batch[:1], "batch")
+	s.NoError(err)
+	_, err = handleBatch(func(uploads []StreamMessage) ([]error, error) { return []error{nil, nil}, nil }, batch[:1], "batch")
+	s.True(errors.Is(err, ErrBatchResults))
+}
+
+func (s *FhirhoseTestSuite) TestBatchUploadsPerStream() {
+	conf := *s.client.Config
+	conf.UploadBatchSize = 1
+	conf.PubSub = &acknowledgingPubSub{IPubSubClient: &psmocks.IPubSubClient{}}
+
+	handled := make(chan []StreamMessage, 2)
+	handler := func(uploads []StreamMessage) ([]error, error) {
+		handled <- uploads
+		return nil, nil
+	}
+	uploadChan := make(chan StreamMessage)
+	stopped := make(chan struct{})
+	go func() {
+		batchUploads(conf, handler, &uploadChan, nil)
+		close(stopped)
+	}()
+
+	uploadChan <- StreamMessage{Identifier: "1", stream: "user"}
+	uploadChan <- StreamMessage{Identifier: "2", stream: "patient"}
+	uploadChan <- StreamMessage{Identifier: "3", stream: "user"}
+	uploads := <-handled
+	s.Require().Len(uploads, 2)
+	s.Equal([]string{"1", "3"}, []string{uploads[0].Identifier, uploads[1].Identifier}, "expect batches to contain one stream")
+	close(uploadChan)
+	<-stopped
+	s.Len(handled, 0, "expect the partial batch of the other stream to be requeued")
+}
+
 func TestFhirhoseTestSuite(t *testing.T) {
 	suite.Run(t, new(FhirhoseTestSuite))
 }
@@ -7,11 +7,12 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/nats-io/jsm.go v0.0.20
 	github.com/nats-io/jwt v1.2.0 // indirect
-	github.com/nats-io/nats-server/v2 v2.1.9 // indirect
+	github.com/nats-io/nats-server/v2 v2.1.8-0.20201204171240-e1b590db604e
 	github.com/nats-io/nats.go v1.10.1-0.20201111151633-9e1f4a0d80d8
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/sys v0.0.0-20201106081118-db71ae66460a // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
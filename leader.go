@@ -0,0 +1,199 @@
+package fhirhose
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// DefaultLeaseTTL default time a poll lease is valid without renewal
+const DefaultLeaseTTL = time.Second * 15
+
+// ILeaseStore interface containing functions to hold a lease
+// only the holder of the lease of a stream polls the stream
+type ILeaseStore interface {
+	// Acquire acquires or renews the lease, returns true when the holder holds the lease
+	Acquire(key, holder string, ttl time.Duration) (bool, error)
+	// Release releases the lease when it is held by the holder
+	Release(key, holder string) error
+}
+
+// lease value stored in a lease store
+type lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// MemoryLeaseStore in memory lease store, only useful for replicas within a single process
+type MemoryLeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+// NewMemoryLeaseStore creates a new in memory lease store
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: make(map[string]lease)}
+}
+
+// Acquire acquires the lease when it is free, expired or already held by the holder
+func (s *MemoryLeaseStore) Acquire(key, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	current, found := s.leases[key]
+	if found && current.Holder != holder && now.Before(current.Expires) {
+		return false, nil
+	}
+	s.leases[key] = lease{Holder: holder, Expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Release releases the lease when it is held by the holder
+func (s *MemoryLeaseStore) Release(key, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leases[key].Holder == holder {
+		delete(s.leases, key)
+	}
+	return nil
+}
+
+// KeyValueLeaseStore lease store backed by a JetStream key value bucket
+// leases are renewed with optimistic concurrency on the revision of the key
+type KeyValueLeaseStore struct {
+	KeyValue *pubsub.KeyValue
+}
+
+// Acquire acquires the lease when it is free, expired or already held by the holder
+func (s *KeyValueLeaseStore) Acquire(key, holder string, ttl time.Duration) (bool, error) {
+	value, err := json.Marshal(lease{Holder: holder, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+
+	entry, err := s.KeyValue.Get(key)
+	if errors.Is(err, pubsub.ErrKeyNotFound) {
+		_, err = s.KeyValue.Create(key, value)
+		return s.acquired(err)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var current lease
+	if err := json.Unmarshal(entry.Value, &current); err != nil {
+		return false, fmt.Errorf("reading lease %s failed: %w", key, err)
+	}
+	if current.Holder != holder && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	_, err = s.KeyValue.Update(key, value, entry.Revision)
+	return s.acquired(err)
+}
+
+// Release releases the lease when it is held by the holder
+func (s *KeyValueLeaseStore) Release(key, holder string) error {
+	entry, err := s.KeyValue.Get(key)
+	if errors.Is(err, pubsub.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var current lease
+	if err := json.Unmarshal(entry.Value, &current); err != nil || current.Holder != holder {
+		return nil
+	}
+	return s.KeyValue.Delete(key)
+}
+
+// acquired converts a lost race into not acquired
+func (s *KeyValueLeaseStore) acquired(err error) (bool, error) {
+	if errors.Is(err, pubsub.ErrRevisionMismatch) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// leadStream polls the stream only while this instance holds the lease of the stream
+// failover happens within the lease ttl plus one renewal interval
+// a running poll is cancelled when the lease is lost and the lease is released on shutdown
+func leadStream(conf Config, stream IStream, errChan *chan Error) {
+	clock := conf.getClock()
+	ttl := conf.getLeaseTTL()
+	key := fmt.Sprintf("%s.%s", conf.GetStreamName(), stream.GetStreamName())
+	holder := conf.getInstanceID()
+	logger := conf.logger().WithFields(Fields{"resource": stream.GetStreamName(), "holder": holder})
+
+	var cancel context.CancelFunc
+	for {
+		leader, err := conf.LeaseStore.Acquire(key, holder, ttl)
+		if err != nil {
+			// Step down, another instance may take over when the lease expires
+			logger.WithError(err).Error("can't acquire poll lease")
+			leader = false
+		}
+
+		if leader && cancel == nil {
+			logger.Info("elected poll leader")
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(conf.control.context())
+			go pollOnInterval(ctx, conf, stream, errChan)
+		}
+		if !leader && cancel != nil {
+			logger.Warn("lost poll leadership")
+			cancel()
+			cancel = nil
+		}
+
+		select {
+		case <-clock.After(ttl / 3):
+		case <-conf.control.context().Done():
+			if cancel != nil {
+				cancel()
+				// Another instance takes over at once instead of after the lease ttl
+				if err := conf.LeaseStore.Release(key, holder); err != nil {
+					logger.WithError(err).Error("can't release poll lease")
+				}
+			}
+			logger.Info("stopped leading on shutdown")
+			return
+		}
+	}
+}
+
+// getLeaseTTL returns the configured lease ttl or the default
+func (c Config) getLeaseTTL() time.Duration {
+	if c.LeaseTTL > 0 {
+		return c.LeaseTTL
+	}
+	return DefaultLeaseTTL
+}
+
+// getInstanceID returns the configured instance id or a generated id based on the hostname
+func (c Config) getInstanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+	return defaultInstanceID
+}
+
+// defaultInstanceID generated instance id of this process
+var defaultInstanceID = func() string {
+	hostname, _ := os.Hostname()
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+}()
@@ -0,0 +1,221 @@
+package fhirhose
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevel level of a log event
+type LogLevel int
+
+const (
+	// DebugLevel level used for diagnostic events
+	DebugLevel LogLevel = iota
+	// InfoLevel level used for progress events
+	InfoLevel
+	// WarnLevel level used for unexpected but handled events
+	WarnLevel
+	// ErrorLevel level used for failures
+	ErrorLevel
+)
+
+// Fields structured fields of a log event
+type Fields map[string]interface{}
+
+// ILogger interface containing the structured logging function used by the package
+type ILogger interface {
+	Log(level LogLevel, event string, fields Fields)
+}
+
+// RedactFunc func used to redact a field value before it is logged
+type RedactFunc func(key string, value interface{}) interface{}
+
+// DefaultRedactedFields fields which can contain patient data
+// errors of the package don't contain identifiers, errors of the streams can, add logrus.ErrorKey to redact them too
+var DefaultRedactedFields = []string{"id", "desc", "messageId", "subject"}
+
+// Logging configuration of the package logging
+type Logging struct {
+	// Logger receives all log events
+	// Default LogrusLogger with the standard logrus logger
+	Logger ILogger
+	// Levels overrides the level of log events by event name, e.g. "polled item"
+	Levels map[string]LogLevel
+	// SampleRates logs one out of every n log events by event name, used for per item events
+	SampleRates map[string]int
+	// Redact redacts field values before they are logged
+	// Default nil logs all values
+	Redact RedactFunc
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// defaultLogging logging used when no logging is configured
+var defaultLogging = &Logging{}
+
+// LogrusLogger logger adapter for logrus
+type LogrusLogger struct {
+	// Logger logrus logger, default the standard logger
+	Logger *logrus.Logger
+}
+
+// Log logs the event with logrus
+func (l *LogrusLogger) Log(level LogLevel, event string, fields Fields) {
+	logger := l.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	entry := logger.WithFields(logrus.Fields(fields))
+	switch level {
+	case DebugLevel:
+		entry.Debug(event)
+	case InfoLevel:
+		entry.Info(event)
+	case WarnLevel:
+		entry.Warn(event)
+	default:
+		entry.Error(event)
+	}
+}
+
+// HashRedactor creates a redact func which replaces the fields with a salted hash
+// the hash is stable so log lines of the same identifier can still be correlated
+// Default fields DefaultRedactedFields
+func HashRedactor(salt string, fields ...string) RedactFunc {
+	redacted := redactedFields(fields)
+	return func(key string, value interface{}) interface{} {
+		if !redacted[key] {
+			return value
+		}
+		hash := sha256.Sum256([]byte(salt + fmt.Sprint(value)))
+		return hex.EncodeToString(hash[:])[:16]
+	}
+}
+
+// MaskRedactor creates a redact func which replaces the fields with a mask
+// Default fields DefaultRedactedFields
+func MaskRedactor(fields ...string) RedactFunc {
+	redacted := redactedFields(fields)
+	return func(key string, value interface{}) interface{} {
+		if !redacted[key] {
+			return value
+		}
+		return "***"
+	}
+}
+
+// redactedFields creates a lookup of the fields or the default redacted fields
+func redactedFields(fields []string) map[string]bool {
+	if len(fields) == 0 {
+		fields = DefaultRedactedFields
+	}
+	redacted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		redacted[field] = true
+	}
+	return redacted
+}
+
+// sample reports if the event should be logged based on the sample rate of the event
+func (l *Logging) sample(event string) bool {
+	rate := l.SampleRates[event]
+	if rate <= 1 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+	}
+	l.counts[event]++
+	return l.counts[event]%rate == 1
+}
+
+// log redacts the fields and passes the event to the logger
+func (l *Logging) log(level LogLevel, event string, fields Fields) {
+	if override, found := l.Levels[event]; found {
+		level = override
+	}
+	if !l.sample(event) {
+		return
+	}
+
+	if l.Redact != nil {
+		redacted := make(Fields, len(fields))
+		for key, value := range fields {
+			redacted[key] = l.Redact(key, value)
+		}
+		fields = redacted
+	}
+
+	logger := l.Logger
+	if logger == nil {
+		logger = &LogrusLogger{}
+	}
+	logger.Log(level, event, fields)
+}
+
+// logEntry log event under construction
+type logEntry struct {
+	logging *Logging
+	fields  Fields
+}
+
+// logger returns a new log entry for the configured logging
+func (c Config) logger() *logEntry {
+	logging := c.Logging
+	if logging == nil {
+		logging = defaultLogging
+	}
+	return &logEntry{logging: logging, fields: Fields{}}
+}
+
+// WithField adds a field to the log entry
+func (e *logEntry) WithField(key string, value interface{}) *logEntry {
+	return e.WithFields(Fields{key: value})
+}
+
+// WithFields adds fields to the log entry
+func (e *logEntry) WithFields(fields Fields) *logEntry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &logEntry{logging: e.logging, fields: merged}
+}
+
+// WithError adds the error to the log entry
+func (e *logEntry) WithError(err error) *logEntry {
+	return e.WithField(logrus.ErrorKey, err)
+}
+
+// Debug logs the event at debug level
+func (e *logEntry) Debug(event string) {
+	e.logging.log(DebugLevel, event, e.fields)
+}
+
+// Info logs the event at info level
+func (e *logEntry) Info(event string) {
+	e.logging.log(InfoLevel, event, e.fields)
+}
+
+// Warn logs the event at warn level
+func (e *logEntry) Warn(event string) {
+	e.logging.log(WarnLevel, event, e.fields)
+}
+
+// Error logs the event at error level
+func (e *logEntry) Error(event string) {
+	e.logging.log(ErrorLevel, event, e.fields)
+}
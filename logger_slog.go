@@ -0,0 +1,51 @@
+//go:build go1.21
+// +build go1.21
+
+package fhirhose
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// SlogLogger logger adapter for log/slog
+type SlogLogger struct {
+	// Logger slog logger, default the slog default logger
+	Logger *slog.Logger
+}
+
+// Log logs the event with slog
+func (l *SlogLogger) Log(level LogLevel, event string, fields Fields) {
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, fields[key]))
+	}
+
+	logger.LogAttrs(context.Background(), slogLevel(level), event, attrs...)
+}
+
+// slogLevel converts the level to a slog level
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case DebugLevel:
+		return slog.LevelDebug
+	case InfoLevel:
+		return slog.LevelInfo
+	case WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -0,0 +1,110 @@
+package fhirhose
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// newStreamMsg creates the nats message published for the stream message
+// the data is encrypted and moved into the claim check store when configured
+// failures of the key provider and the claim check store are transient unless classified, marshalling failures permanent
+func newStreamMsg(conf Config, stream StreamName, subject string, message StreamMessage) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(IdentifierHeader, EncodeIdentifier(message.Identifier))
+
+	var err error
+	if conf.KeyProvider != nil {
+		message, err = encryptMessage(conf, message)
+		if err != nil {
+			return nil, transientUnlessClassified(err)
+		}
+		msg.Header.Set(EncryptionKeyIDHeader, message.Encryption.KeyID)
+	}
+
+	message, err = checkMessage(conf, stream, message)
+	if err != nil {
+		return nil, transientUnlessClassified(err)
+	}
+
+	msg.Data, err = json.Marshal(&message)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("marshalling message failed: %w", err))
+	}
+
+	return msg, nil
+}
+
+// unmarshalMessage unmarshals the message, resolves the data from the claim check store and decrypts it
+// the returned claim check is the key which can be released after the message is handled
+func unmarshalMessage(conf Config, data []byte) (message StreamMessage, claimCheck string, err error) {
+	if err := json.Unmarshal(data, &message); err != nil {
+		return message, "", Permanent(fmt.Errorf("unmarshalling message failed: %w", err))
+	}
+
+	if message.ClaimCheck != "" {
+		claimCheck = message.ClaimCheck
+		message, err = resolveMessage(conf, message)
+		if err != nil {
+			return message, claimCheck, err
+		}
+	}
+
+	if message.Encryption != nil {
+		message, err = decryptMessage(conf, message)
+		if err != nil {
+			return message, claimCheck, err
+		}
+	}
+
+	return message, claimCheck, nil
+}
+
+// forward publishes the handled message downstream and acknowledges the upstream message once the publish is confirmed
+// when the publish fails the upstream message is redelivered, returns true when the upstream message is acknowledged
+// a message which can't be created is settled by the class of the error, see settleFailure
+// the subject is based on the identifier of the consumed message
+func forward(conf Config, upstream *nats.Msg, stream StreamName, action ActionName, identifier string, message StreamMessage, errChan *chan Error) bool {
+	actionString := GetPublishAction(identifier, stream, conf.GetConsumerPrefix(), action)
+	publishMsg, err := newStreamMsg(conf, stream, actionString, message)
+	if err != nil {
+		conf.logger().WithError(err).Error("can't create message")
+		return settleFailure(conf, stream, action, upstream, &message, err, errChan)
+	}
+
+	if err := conf.PubSub.PublishMsg(publishMsg); err != nil {
+		conf.logger().WithError(err).Error("can't publish new event")
+		negativeAcknowledge(conf, upstream)
+		return false
+	}
+
+	acknowledge(conf, upstream)
+	return true
+}
+
+// transientUnlessClassified classifies unclassified errors as transient
+func transientUnlessClassified(err error) error {
+	if classify(err) != nil {
+		return err
+	}
+	return Transient(err)
+}
+
+// acknowledge acknowledges the consumed message
+func acknowledge(conf Config, msg *nats.Msg) {
+	markSettled(msg)
+	if err := pubsub.Ack(conf.PubSub, msg); err != nil {
+		conf.logger().WithError(err).Error("can't acknowledge message")
+	}
+}
+
+// negativeAcknowledge negatively acknowledges the consumed message so it is redelivered
+func negativeAcknowledge(conf Config, msg *nats.Msg) {
+	markSettled(msg)
+	if err := pubsub.Nak(conf.PubSub, msg); err != nil {
+		conf.logger().WithError(err).Error("can't negatively acknowledge message")
+	}
+}
@@ -0,0 +1,65 @@
+package fhirhose
+
+import (
+	"fmt"
+	"sync"
+)
+
+// IMetrics interface containing functions to report pipeline metrics
+type IMetrics interface {
+	Count(stream StreamName, action ActionName, name string, value int64)
+}
+
+// MemoryMetrics in memory metrics which keeps a counter per stream, action and name
+type MemoryMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+// NewMemoryMetrics creates new in memory metrics
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		counters: make(map[string]int64),
+	}
+}
+
+// Count adds the value to the counter
+func (m *MemoryMetrics) Count(stream StreamName, action ActionName, name string, value int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[GetMetricName(stream, action, name)] += value
+}
+
+// Get returns the value of the counter
+func (m *MemoryMetrics) Get(stream StreamName, action ActionName, name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[GetMetricName(stream, action, name)]
+}
+
+// Snapshot returns a copy of all counters
+func (m *MemoryMetrics) Snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(m.counters))
+	for name, value := range m.counters {
+		snapshot[name] = value
+	}
+
+	return snapshot
+}
+
+// GetMetricName create metric name based on stream, action and name
+func GetMetricName(stream StreamName, action ActionName, name string) string {
+	return fmt.Sprintf("%s.%s.%s", stream, action, name)
+}
+
+// count reports the value to the configured metrics when defined
+func count(conf Config, stream StreamName, action ActionName, name string, value int64) {
+	if conf.Metrics != nil {
+		conf.Metrics.Count(stream, action, name, value)
+	}
+}
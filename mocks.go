@@ -21,6 +21,11 @@ type IRegisterMock struct {
 	mock.Mock
 }
 
+// Debouncers provides a mock function with given fields: _a0, _a1, _a2
+func (_m *IRegisterMock) Debouncers(_a0 Config, _a1 []IStream, _a2 *chan Error) {
+	_m.Called(_a0, _a1, _a2)
+}
+
 // Pollers provides a mock function with given fields: _a0, _a1, _a2
 func (_m *IRegisterMock) Pollers(_a0 Config, _a1 []IStream, _a2 *chan Error) {
 	_m.Called(_a0, _a1, _a2)
@@ -36,9 +41,9 @@ func (_m *IRegisterMock) Transformers(_a0 Config, _a1 []IStream, _a2 *chan Error
 	_m.Called(_a0, _a1, _a2)
 }
 
-// Uploaders provides a mock function with given fields: _a0, _a1, _a2
-func (_m *IRegisterMock) Uploaders(_a0 Config, _a1 []IStream, _a2 *chan Error) {
-	_m.Called(_a0, _a1, _a2)
+// Uploaders provides a mock function with given fields: _a0, _a1, _a2, _a3
+func (_m *IRegisterMock) Uploaders(_a0 Config, _a1 []IStream, _a2 *chan Error, _a3 *chan StreamMessage) {
+	_m.Called(_a0, _a1, _a2, _a3)
 }
 
 // IStreamMock is an autogenerated mock type for the IStream type
@@ -47,7 +52,7 @@ type IStreamMock struct {
 }
 
 // GetStreamName provides a mock function with given fields:
-func (_m *IStreamMock) GetEventType() StreamName {
+func (_m *IStreamMock) GetStreamName() StreamName {
 	ret := _m.Called()
 
 	var r0 StreamName
@@ -61,105 +66,101 @@ func (_m *IStreamMock) GetEventType() StreamName {
 }
 
 // Poll provides a mock function with given fields:
-func (_m *IStreamMock) Poll() ([]string, error) {
+func (_m *IStreamMock) Poll() ([]StreamMessage, bool, error) {
 	ret := _m.Called()
 
-	var r0 []string
-	if rf, ok := ret.Get(0).(func() []string); ok {
+	var r0 []StreamMessage
+	if rf, ok := ret.Get(0).(func() []StreamMessage); ok {
 		r0 = rf()
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]string)
+			r0 = ret.Get(0).([]StreamMessage)
 		}
 	}
 
-	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
+	var r1 bool
+	if rf, ok := ret.Get(1).(func() bool); ok {
 		r1 = rf()
 	} else {
-		r1 = ret.Error(1)
+		r1 = ret.Get(1).(bool)
 	}
 
-	return r0, r1
+	var r2 error
+	if rf, ok := ret.Get(2).(func() error); ok {
+		r2 = rf()
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
 }
 
-// Retrieve provides a mock function with given fields: _a0
-func (_m *IStreamMock) Retrieve(_a0 string) (string, []byte, error) {
-	ret := _m.Called(_a0)
+// Retrieve provides a mock function with given fields: inputMessage
+func (_m *IStreamMock) Retrieve(inputMessage StreamMessage) (StreamMessage, error) {
+	ret := _m.Called(inputMessage)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(string) string); ok {
-		r0 = rf(_a0)
+	var r0 StreamMessage
+	if rf, ok := ret.Get(0).(func(StreamMessage) StreamMessage); ok {
+		r0 = rf(inputMessage)
 	} else {
-		r0 = ret.Get(0).(string)
+		r0 = ret.Get(0).(StreamMessage)
 	}
 
-	var r1 []byte
-	if rf, ok := ret.Get(1).(func(string) []byte); ok {
-		r1 = rf(_a0)
+	var r1 error
+	if rf, ok := ret.Get(1).(func(StreamMessage) error); ok {
+		r1 = rf(inputMessage)
 	} else {
-		if ret.Get(1) != nil {
-			r1 = ret.Get(1).([]byte)
-		}
+		r1 = ret.Error(1)
 	}
 
-	var r2 error
-	if rf, ok := ret.Get(2).(func(string) error); ok {
-		r2 = rf(_a0)
+	return r0, r1
+}
+
+// Transform provides a mock function with given fields: inputMessage
+func (_m *IStreamMock) Transform(inputMessage StreamMessage) (StreamMessage, error) {
+	ret := _m.Called(inputMessage)
+
+	var r0 StreamMessage
+	if rf, ok := ret.Get(0).(func(StreamMessage) StreamMessage); ok {
+		r0 = rf(inputMessage)
 	} else {
-		r2 = ret.Error(2)
+		r0 = ret.Get(0).(StreamMessage)
 	}
 
-	return r0, r1, r2
+	var r1 error
+	if rf, ok := ret.Get(1).(func(StreamMessage) error); ok {
+		r1 = rf(inputMessage)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// Transform provides a mock function with given fields: _a0, _a1
-func (_m *IStreamMock) Transform(_a0 string, _a1 []byte) (string, []byte, error) {
-	ret := _m.Called(_a0, _a1)
+// Upload provides a mock function with given fields: inputMessage
+func (_m *IStreamMock) Upload(inputMessage StreamMessage) (StreamMessage, bool, error) {
+	ret := _m.Called(inputMessage)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(string, []byte) string); ok {
-		r0 = rf(_a0, _a1)
+	var r0 StreamMessage
+	if rf, ok := ret.Get(0).(func(StreamMessage) StreamMessage); ok {
+		r0 = rf(inputMessage)
 	} else {
-		r0 = ret.Get(0).(string)
+		r0 = ret.Get(0).(StreamMessage)
 	}
 
-	var r1 []byte
-	if rf, ok := ret.Get(1).(func(string, []byte) []byte); ok {
-		r1 = rf(_a0, _a1)
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(StreamMessage) bool); ok {
+		r1 = rf(inputMessage)
 	} else {
-		if ret.Get(1) != nil {
-			r1 = ret.Get(1).([]byte)
-		}
+		r1 = ret.Get(1).(bool)
 	}
 
 	var r2 error
-	if rf, ok := ret.Get(2).(func(string, []byte) error); ok {
-		r2 = rf(_a0, _a1)
+	if rf, ok := ret.Get(2).(func(StreamMessage) error); ok {
+		r2 = rf(inputMessage)
 	} else {
 		r2 = ret.Error(2)
 	}
 
 	return r0, r1, r2
 }
-
-//// Upload provides a mock function with given fields: _a0, _a1
-//func (_m *IStreamMock) Upload(inputID string, inputData []byte) (string, error, bool) {
-//	ret := _m.Called(inputID, inputData)
-//
-//	var r0 string
-//	if rf, ok := ret.Get(0).(func(string, []byte) string); ok {
-//		r0 = rf(inputID, inputData)
-//	} else {
-//		r0 = ret.Get(0).(string)
-//	}
-//
-//	var r1 error
-//	if rf, ok := ret.Get(1).(func(string, []byte) error); ok {
-//		r1 = rf(inputID, inputData)
-//	} else {
-//		r1 = ret.Error(1)
-//	}
-//
-//	return r0, r1, outputProcess
-//}
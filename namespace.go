@@ -0,0 +1,60 @@
+package fhirhose
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultConsumerTemplate default template of consumer names
+const DefaultConsumerTemplate = "{prefix}-{stream}-{action}"
+
+// GetStreamName returns the JetStream stream name of the client
+// default DefaultStreamName or fhirhose-<tenant> when a tenant is configured
+func (c Config) GetStreamName() StreamName {
+	if c.StreamName != "" {
+		return c.StreamName
+	}
+	if c.Tenant != "" {
+		return StreamName(fmt.Sprintf("%s-%s", DefaultStreamName, c.Tenant))
+	}
+	return DefaultStreamName
+}
+
+// GetConsumerPrefix returns the subject and consumer prefix of the regular lane
+// default DefaultConsumerPrefix or fhirhose-<tenant> when a tenant is configured
+func (c Config) GetConsumerPrefix() ConsumerPrefix {
+	if c.ConsumerPrefix != "" {
+		return c.ConsumerPrefix
+	}
+	if c.Tenant != "" {
+		return ConsumerPrefix(fmt.Sprintf("%s-%s", DefaultConsumerPrefix, c.Tenant))
+	}
+	return DefaultConsumerPrefix
+}
+
+// GetCustomLoadPrefix returns the subject and consumer prefix of the custom load lane
+// default DefaultConsumerCustomLoadPrefix or fhirhosecl-<tenant> when a tenant is configured
+func (c Config) GetCustomLoadPrefix() ConsumerPrefix {
+	if c.CustomLoadPrefix != "" {
+		return c.CustomLoadPrefix
+	}
+	if c.Tenant != "" {
+		return ConsumerPrefix(fmt.Sprintf("%s-%s", DefaultConsumerCustomLoadPrefix, c.Tenant))
+	}
+	return DefaultConsumerCustomLoadPrefix
+}
+
+// GetConsumerName create consumer name based on the consumer template
+// the template supports the {prefix}, {stream}, {action} and {tenant} placeholders
+func (c Config) GetConsumerName(stream StreamName, prefix ConsumerPrefix, action ActionName) string {
+	if c.ConsumerTemplate == "" {
+		return GetConsumeAction(stream, prefix, action)
+	}
+
+	return strings.NewReplacer(
+		"{prefix}", string(prefix),
+		"{stream}", string(stream),
+		"{action}", string(action),
+		"{tenant}", c.Tenant,
+	).Replace(c.ConsumerTemplate)
+}
@@ -0,0 +1,781 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltAckPrefix reply subject prefix of messages delivered by the bolt client
+	boltAckPrefix = "$BOLT.ACK."
+	// defaultBoltStream default name of the stream of the bolt client
+	defaultBoltStream = "fhirhose"
+	// defaultAckWait default time a delivered message may stay unacknowledged
+	defaultAckWait = time.Second * 30
+	// defaultDuplicateWindow default window in which messages with the same message id are dropped
+	defaultDuplicateWindow = time.Minute * 2
+	// defaultBoltPollInterval default interval in which idle consumers check for redeliveries
+	defaultBoltPollInterval = time.Millisecond * 100
+)
+
+var (
+	// ErrConsumerNotFound err returned when the consumer doesn't exist
+	ErrConsumerNotFound = errors.New("consumer not found")
+	// ErrStreamNotFound err returned when the stream doesn't exist
+	ErrStreamNotFound = errors.New("stream not found")
+
+	boltMessagesBucket  = []byte("messages")
+	boltConsumersBucket = []byte("consumers")
+	boltPendingBucket   = []byte("pending")
+	boltDeadlinesBucket = []byte("deadlines")
+	boltMsgIDsBucket    = []byte("msgids")
+	boltCountsBucket    = []byte("counts")
+)
+
+// BoltClient pubsub client on an embedded bbolt database, used for single node deployments without NATS
+// all published messages are kept in a single stream, consumers are durable pull consumers with a filter subject
+type BoltClient struct {
+	DB *bolt.DB
+	// Stream name of the stream
+	// Default "fhirhose"
+	Stream string
+	// AckWait time a delivered message may stay unacknowledged before it is redelivered
+	// Default 30 seconds
+	AckWait time.Duration
+	// MaxDeliver maximum amount of deliveries of a message
+	// Default 0 redelivers until the message is acknowledged
+	MaxDeliver int
+	// MaxAge maximum age of stored messages
+	// Default 0 keeps messages forever
+	MaxAge time.Duration
+	// MaxMsgs maximum amount of stored messages, the oldest messages are removed first
+	// Default 0 keeps all messages
+	MaxMsgs int
+	// DuplicateWindow window in which messages with the same Nats-Msg-Id header are dropped
+	// Default 2 minutes
+	DuplicateWindow time.Duration
+	// PollInterval interval in which idle consumers check for redeliveries
+	// Default 100 milliseconds
+	PollInterval time.Duration
+
+	mu            sync.Mutex
+	published     chan struct{}
+	closed        chan struct{}
+	subscriptions []*boltSubscription
+	lastPurge     time.Time
+}
+
+// boltMsg message as stored in the bolt database
+type boltMsg struct {
+	Subject string
+	Header  http.Header
+	Data    []byte
+	Time    time.Time
+}
+
+// boltConsumer durable consumer as stored in the bolt database
+type boltConsumer struct {
+	Filter string
+	// Delivered last stream sequence scanned by the consumer
+	Delivered uint64
+}
+
+// boltPending delivered message waiting for acknowledgement
+type boltPending struct {
+	Deadline   time.Time
+	Deliveries int
+}
+
+// boltMsgID sequence and time of a published message id
+type boltMsgID struct {
+	Sequence uint64
+	Time     time.Time
+}
+
+// boltSubscription core subscription of the bolt client
+type boltSubscription struct {
+	subscription *nats.Subscription
+	callback     nats.MsgHandler
+}
+
+// NewBoltClient opens or creates the bolt database at the path
+func NewBoltClient(path string) (*BoltClient, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt database failed: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltMessagesBucket, boltConsumersBucket, boltPendingBucket, boltDeadlinesBucket, boltMsgIDsBucket, boltCountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating bolt buckets failed: %w", err)
+	}
+
+	return &BoltClient{
+		DB:        db,
+		published: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// Close stops all consumers and closes the database
+func (b *BoltClient) Close() error {
+	b.mu.Lock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	b.mu.Unlock()
+	return b.DB.Close()
+}
+
+// AddConsumer creates the durable consumer receiving all messages matching the filter subject
+// the filter of an existing consumer is updated, its position is kept and its pending counter recounted
+func (b *BoltClient) AddConsumer(name, filter string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		consumers := tx.Bucket(boltConsumersBucket)
+		consumer := boltConsumer{Filter: filter}
+		if data := consumers.Get([]byte(name)); data != nil {
+			if err := json.Unmarshal(data, &consumer); err != nil {
+				return fmt.Errorf("reading consumer %s failed: %w", name, err)
+			}
+			consumer.Filter = filter
+		}
+		pending, err := tx.Bucket(boltPendingBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		if err := indexDeadlines(tx, name, pending); err != nil {
+			return err
+		}
+		if err := countPending(tx, name, consumer, pending); err != nil {
+			return err
+		}
+		return putJSON(consumers, []byte(name), consumer)
+	})
+}
+
+// Publish stores the message on the stream
+func (b *BoltClient) Publish(subj string, data []byte) error {
+	return b.PublishMsg(&nats.Msg{Subject: subj, Data: data})
+}
+
+// PublishMsg stores the message on the stream, messages with a known Nats-Msg-Id within the duplicate window are dropped
+func (b *BoltClient) PublishMsg(msg *nats.Msg) error {
+	now := time.Now()
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		msgIDs := tx.Bucket(boltMsgIDsBucket)
+		msgID := msg.Header.Get(MsgIDHeader)
+		if msgID != "" {
+			var known boltMsgID
+			if data := msgIDs.Get([]byte(msgID)); data != nil && json.Unmarshal(data, &known) == nil && now.Sub(known.Time) < b.getDuplicateWindow() {
+				return nil
+			}
+		}
+
+		messages := tx.Bucket(boltMessagesBucket)
+		sequence, err := messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := putJSON(messages, sequenceKey(sequence), boltMsg{Subject: msg.Subject, Header: msg.Header, Data: msg.Data, Time: now}); err != nil {
+			return err
+		}
+		if msgID != "" {
+			if err := putJSON(msgIDs, []byte(msgID), boltMsgID{Sequence: sequence, Time: now}); err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket(boltConsumersBucket).ForEach(func(name, value []byte) error {
+			var consumer boltConsumer
+			if err := json.Unmarshal(value, &consumer); err != nil {
+				return err
+			}
+			if !subjectMatches(consumer.Filter, msg.Subject) {
+				return nil
+			}
+			return addPending(tx, string(name), 1)
+		})
+		if err != nil {
+			return err
+		}
+		return b.purge(tx, now)
+	})
+	if err != nil {
+		return fmt.Errorf("publishing to %s failed: %w", subjectPrefix(msg.Subject), err)
+	}
+
+	b.mu.Lock()
+	close(b.published)
+	b.published = make(chan struct{})
+	subscriptions := b.subscriptions
+	b.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		if subjectMatches(subscription.subscription.Subject, msg.Subject) {
+			subscription.callback(&nats.Msg{Subject: msg.Subject, Header: msg.Header, Data: msg.Data})
+		}
+	}
+	return nil
+}
+
+// Subscribe calls the callback for every message published on the client matching the subject
+// the returned subscription isn't bound to a connection, unsubscribe with Unsubscribe of the client
+func (b *BoltClient) Subscribe(subj string, callback nats.MsgHandler) (*nats.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscription := &nats.Subscription{Subject: subj}
+	b.subscriptions = append(b.subscriptions, &boltSubscription{subscription: subscription, callback: callback})
+	return subscription, nil
+}
+
+// Unsubscribe removes the subscription returned by Subscribe, unknown subscriptions are ignored
+func (b *BoltClient) Unsubscribe(subscription *nats.Subscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Publishes in progress keep calling the callback of their copy of the subscriptions
+	subscriptions := make([]*boltSubscription, 0, len(b.subscriptions))
+	for _, existing := range b.subscriptions {
+		if existing.subscription != subscription {
+			subscriptions = append(subscriptions, existing)
+		}
+	}
+	b.subscriptions = subscriptions
+	return nil
+}
+
+// Consume delivers the messages of the consumer to the callback until the client is closed
+// messages which aren't acknowledged within the ack wait are redelivered
+func (b *BoltClient) Consume(consumer, stream string, callback func(msg *nats.Msg)) error {
+	if stream != b.getStream() {
+		return fmt.Errorf("loading consumer %s for stream %s failed: %w", consumer, stream, ErrStreamNotFound)
+	}
+
+	for {
+		b.mu.Lock()
+		published := b.published
+		b.mu.Unlock()
+
+		msg, err := b.next(consumer)
+		if err != nil {
+			select {
+			case <-b.closed:
+				// The database is closed while receiving
+				return nil
+			default:
+				return err
+			}
+		}
+		if msg != nil {
+			callback(msg)
+			continue
+		}
+
+		select {
+		case <-b.closed:
+			return nil
+		case <-published:
+		case <-time.After(b.getPollInterval()):
+		}
+	}
+}
+
+// Pending returns the amount of messages waiting for delivery or acknowledgement on the consumer
+// read from the pending counter of the consumer, kept up to date by publishes, acknowledgements and purges
+func (b *BoltClient) Pending(consumer, stream string) (uint64, error) {
+	if stream != b.getStream() {
+		return 0, fmt.Errorf("loading consumer %s for stream %s failed: %w", consumer, stream, ErrStreamNotFound)
+	}
+
+	var pending uint64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		if _, err := loadConsumer(tx, consumer); err != nil {
+			return err
+		}
+		if count := tx.Bucket(boltCountsBucket).Get([]byte(consumer)); count != nil {
+			pending = binary.BigEndian.Uint64(count)
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// Ack acknowledges the delivered message so it is never redelivered
+func (b *BoltClient) Ack(msg *nats.Msg) error {
+	return b.updatePending(msg, func(*boltPending) bool {
+		return true
+	})
+}
+
+// Nak redelivers the delivered message immediately
+func (b *BoltClient) Nak(msg *nats.Msg) error {
+	return b.updatePending(msg, func(state *boltPending) bool {
+		state.Deadline = time.Time{}
+		return false
+	})
+}
+
+// InProgress resets the ack wait of the delivered message
+func (b *BoltClient) InProgress(msg *nats.Msg) error {
+	return b.updatePending(msg, func(state *boltPending) bool {
+		state.Deadline = time.Now().Add(b.getAckWait())
+		return false
+	})
+}
+
+// next delivers the next message of the consumer, redeliveries go first
+// returns nil when no message is available
+func (b *BoltClient) next(consumer string) (*nats.Msg, error) {
+	now := time.Now()
+	if ready, err := b.ready(consumer, now); err != nil || !ready {
+		if err != nil {
+			return nil, fmt.Errorf("receiving from consumer %s failed: %w", consumer, err)
+		}
+		return nil, nil
+	}
+
+	var msg *nats.Msg
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		state, err := loadConsumer(tx, consumer)
+		if err != nil {
+			return err
+		}
+		messages := tx.Bucket(boltMessagesBucket)
+		pending := tx.Bucket(boltPendingBucket).Bucket([]byte(consumer))
+		deadlines := tx.Bucket(boltDeadlinesBucket).Bucket([]byte(consumer))
+
+		// Redeliver messages of which the ack wait expired, the deadline index is ordered by deadline
+		for key, _ := deadlines.Cursor().First(); key != nil; key, _ = deadlines.Cursor().First() {
+			deadline, sequence := parseDeadlineKey(key)
+			if deadline > deadlineNanos(now) {
+				break
+			}
+
+			var delivery boltPending
+			data := pending.Get(sequenceKey(sequence))
+			if data == nil {
+				if err := deadlines.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+
+			stored := messages.Get(sequenceKey(sequence))
+			if stored == nil || b.MaxDeliver > 0 && delivery.Deliveries >= b.MaxDeliver {
+				// Removed by retention or delivered too often
+				if err := deletePending(pending, deadlines, sequence, delivery); err != nil {
+					return err
+				}
+				if err := addPending(tx, consumer, -1); err != nil {
+					return err
+				}
+				continue
+			}
+
+			delivered := delivery
+			delivered.Deliveries++
+			delivered.Deadline = now.Add(b.getAckWait())
+			if err := putPending(pending, deadlines, sequence, &delivery, delivered); err != nil {
+				return err
+			}
+			msg, err = newBoltMsg(consumer, sequence, delivered.Deliveries, stored)
+			return err
+		}
+
+		// Deliver the next new message matching the filter
+		cursor := messages.Cursor()
+		for key, value := cursor.Seek(sequenceKey(state.Delivered + 1)); key != nil; key, value = cursor.Next() {
+			state.Delivered = binary.BigEndian.Uint64(key)
+
+			var stored boltMsg
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			if !subjectMatches(state.Filter, stored.Subject) {
+				continue
+			}
+
+			if err := putPending(pending, deadlines, state.Delivered, nil, boltPending{Deadline: now.Add(b.getAckWait()), Deliveries: 1}); err != nil {
+				return err
+			}
+			msg, err = newBoltMsg(consumer, state.Delivered, 1, value)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if msg == nil {
+			// Every stored message is scanned, messages removed by retention are skipped too
+			state.Delivered = messages.Sequence()
+		}
+		return putJSON(tx.Bucket(boltConsumersBucket), []byte(consumer), state)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("receiving from consumer %s failed: %w", consumer, err)
+	}
+	return msg, nil
+}
+
+// ready reports if the consumer has expired deliveries or messages it didn't scan yet
+// checked in a read only transaction so idle consumers don't write to the database
+func (b *BoltClient) ready(consumer string, now time.Time) (bool, error) {
+	var ready bool
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		state, err := loadConsumer(tx, consumer)
+		if err != nil {
+			return err
+		}
+		if key, _ := tx.Bucket(boltDeadlinesBucket).Bucket([]byte(consumer)).Cursor().First(); key != nil {
+			if deadline, _ := parseDeadlineKey(key); deadline <= deadlineNanos(now) {
+				ready = true
+				return nil
+			}
+		}
+		ready = tx.Bucket(boltMessagesBucket).Sequence() > state.Delivered
+		return nil
+	})
+	return ready, err
+}
+
+// updatePending updates the pending delivery of the message, acknowledged messages are ignored
+// the delivery is removed when update returns true
+func (b *BoltClient) updatePending(msg *nats.Msg, update func(state *boltPending) (remove bool)) error {
+	consumer, sequence, _, err := parseBoltReply(msg.Reply)
+	if err != nil {
+		return err
+	}
+
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(boltPendingBucket).Bucket([]byte(consumer))
+		deadlines := tx.Bucket(boltDeadlinesBucket).Bucket([]byte(consumer))
+		if pending == nil || deadlines == nil {
+			return fmt.Errorf("acknowledging %s failed: %w", consumer, ErrConsumerNotFound)
+		}
+		data := pending.Get(sequenceKey(sequence))
+		if data == nil {
+			return nil
+		}
+		var state boltPending
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		updated := state
+		if update(&updated) {
+			if err := deletePending(pending, deadlines, sequence, state); err != nil {
+				return err
+			}
+			return addPending(tx, consumer, -1)
+		}
+		return putPending(pending, deadlines, sequence, &state, updated)
+	})
+}
+
+// putPending stores the pending delivery and moves it in the deadline index, previous is nil for a new delivery
+func putPending(pending, deadlines *bolt.Bucket, sequence uint64, previous *boltPending, delivery boltPending) error {
+	if previous != nil {
+		if err := deadlines.Delete(deadlineKey(previous.Deadline, sequence)); err != nil {
+			return err
+		}
+	}
+	if err := deadlines.Put(deadlineKey(delivery.Deadline, sequence), nil); err != nil {
+		return err
+	}
+	return putJSON(pending, sequenceKey(sequence), delivery)
+}
+
+// deletePending removes the pending delivery and its deadline
+func deletePending(pending, deadlines *bolt.Bucket, sequence uint64, delivery boltPending) error {
+	if err := deadlines.Delete(deadlineKey(delivery.Deadline, sequence)); err != nil {
+		return err
+	}
+	return pending.Delete(sequenceKey(sequence))
+}
+
+// addPending adds the delta to the pending counter of the consumer, the counter doesn't drop below zero
+func addPending(tx *bolt.Tx, consumer string, delta int64) error {
+	counts := tx.Bucket(boltCountsBucket)
+	var count uint64
+	if data := counts.Get([]byte(consumer)); data != nil {
+		count = binary.BigEndian.Uint64(data)
+	}
+	switch {
+	case delta >= 0:
+		count += uint64(delta)
+	case uint64(-delta) > count:
+		count = 0
+	default:
+		count -= uint64(-delta)
+	}
+	return counts.Put([]byte(consumer), sequenceKey(count))
+}
+
+// countPending counts the pending deliveries and the messages the consumer didn't scan yet into its pending counter
+// used when the consumer is added, its filter changes or the database was created without counters
+func countPending(tx *bolt.Tx, consumer string, state boltConsumer, pending *bolt.Bucket) error {
+	count := uint64(pending.Stats().KeyN)
+	cursor := tx.Bucket(boltMessagesBucket).Cursor()
+	for key, value := cursor.Seek(sequenceKey(state.Delivered + 1)); key != nil; key, value = cursor.Next() {
+		var stored boltMsg
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		if subjectMatches(state.Filter, stored.Subject) {
+			count++
+		}
+	}
+	return tx.Bucket(boltCountsBucket).Put([]byte(consumer), sequenceKey(count))
+}
+
+// indexDeadlines creates the deadline index of the consumer, pending deliveries of databases without index are indexed
+func indexDeadlines(tx *bolt.Tx, consumer string, pending *bolt.Bucket) error {
+	if tx.Bucket(boltDeadlinesBucket).Bucket([]byte(consumer)) != nil {
+		return nil
+	}
+	deadlines, err := tx.Bucket(boltDeadlinesBucket).CreateBucket([]byte(consumer))
+	if err != nil {
+		return err
+	}
+	return pending.ForEach(func(key, value []byte) error {
+		var delivery boltPending
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			return err
+		}
+		return deadlines.Put(deadlineKey(delivery.Deadline, binary.BigEndian.Uint64(key)), nil)
+	})
+}
+
+// purge removes messages outside the retention limits and expired message ids
+// the message limit is enforced on every publish, the age limits at most once a second
+func (b *BoltClient) purge(tx *bolt.Tx, now time.Time) error {
+	// Messages are only removed from the head so the stored messages are the sequences from the first to the last
+	messages := tx.Bucket(boltMessagesBucket)
+	excess := 0
+	if first, _ := messages.Cursor().First(); b.MaxMsgs > 0 && first != nil {
+		excess = int(messages.Sequence()-binary.BigEndian.Uint64(first)+1) - b.MaxMsgs
+	}
+	expire := now.Sub(b.lastPurge) >= time.Second
+	if excess <= 0 && !expire {
+		return nil
+	}
+
+	var removed [][]byte
+	var subjects []string
+	cursor := messages.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		var stored boltMsg
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+		if len(removed) >= excess && (!expire || b.MaxAge <= 0 || now.Sub(stored.Time) < b.MaxAge) {
+			break
+		}
+		removed = append(removed, append([]byte{}, key...))
+		subjects = append(subjects, stored.Subject)
+	}
+	for _, key := range removed {
+		if err := messages.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := uncountRemoved(tx, removed, subjects); err != nil {
+		return err
+	}
+	if !expire {
+		return nil
+	}
+	b.lastPurge = now
+
+	msgIDs := tx.Bucket(boltMsgIDsBucket)
+	removed = removed[:0]
+	err := msgIDs.ForEach(func(key, value []byte) error {
+		var known boltMsgID
+		if json.Unmarshal(value, &known) != nil || now.Sub(known.Time) >= b.getDuplicateWindow() {
+			removed = append(removed, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range removed {
+		if err := msgIDs.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uncountRemoved removes the messages removed by retention which consumers didn't scan yet from their pending counters
+// removed deliveries are uncounted once the consumer finds them missing
+func uncountRemoved(tx *bolt.Tx, removed [][]byte, subjects []string) error {
+	if len(removed) == 0 {
+		return nil
+	}
+	return tx.Bucket(boltConsumersBucket).ForEach(func(name, value []byte) error {
+		var consumer boltConsumer
+		if err := json.Unmarshal(value, &consumer); err != nil {
+			return err
+		}
+		var uncounted int64
+		for i, key := range removed {
+			if binary.BigEndian.Uint64(key) > consumer.Delivered && subjectMatches(consumer.Filter, subjects[i]) {
+				uncounted++
+			}
+		}
+		if uncounted == 0 {
+			return nil
+		}
+		return addPending(tx, string(name), -uncounted)
+	})
+}
+
+// getStream returns the configured stream name or the default
+func (b *BoltClient) getStream() string {
+	if b.Stream != "" {
+		return b.Stream
+	}
+	return defaultBoltStream
+}
+
+// getAckWait returns the configured ack wait or the default
+func (b *BoltClient) getAckWait() time.Duration {
+	if b.AckWait > 0 {
+		return b.AckWait
+	}
+	return defaultAckWait
+}
+
+// getDuplicateWindow returns the configured duplicate window or the default
+func (b *BoltClient) getDuplicateWindow() time.Duration {
+	if b.DuplicateWindow > 0 {
+		return b.DuplicateWindow
+	}
+	return defaultDuplicateWindow
+}
+
+// getPollInterval returns the configured poll interval or the default
+func (b *BoltClient) getPollInterval() time.Duration {
+	if b.PollInterval > 0 {
+		return b.PollInterval
+	}
+	return defaultBoltPollInterval
+}
+
+// loadConsumer loads the consumer state
+func loadConsumer(tx *bolt.Tx, consumer string) (boltConsumer, error) {
+	var state boltConsumer
+	data := tx.Bucket(boltConsumersBucket).Get([]byte(consumer))
+	if data == nil {
+		return state, fmt.Errorf("loading consumer %s failed: %w", consumer, ErrConsumerNotFound)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("reading consumer %s failed: %w", consumer, err)
+	}
+	return state, nil
+}
+
+// newBoltMsg creates the delivered message, the reply subject identifies the delivery for acknowledgements
+func newBoltMsg(consumer string, sequence uint64, deliveries int, data []byte) (*nats.Msg, error) {
+	var stored boltMsg
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	return &nats.Msg{
+		Subject: stored.Subject,
+		Reply:   fmt.Sprintf("%s%s.%d.%d", boltAckPrefix, consumer, deliveries, sequence),
+		Header:  stored.Header,
+		Data:    stored.Data,
+	}, nil
+}
+
+// parseBoltReply returns the consumer, sequence and amount of deliveries of a delivered message
+func parseBoltReply(reply string) (string, uint64, int, error) {
+	tokens := strings.Split(strings.TrimPrefix(reply, boltAckPrefix), ".")
+	if !strings.HasPrefix(reply, boltAckPrefix) || len(tokens) < 3 {
+		return "", 0, 0, fmt.Errorf("acknowledging %q failed: message isn't delivered by a bolt consumer", reply)
+	}
+	deliveries, err := strconv.Atoi(tokens[len(tokens)-2])
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("acknowledging %q failed: %w", reply, err)
+	}
+	sequence, err := strconv.ParseUint(tokens[len(tokens)-1], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("acknowledging %q failed: %w", reply, err)
+	}
+	return strings.Join(tokens[:len(tokens)-2], "."), sequence, deliveries, nil
+}
+
+// deadlineKey returns the key of a delivery in the deadline index, sorted by deadline and sequence
+func deadlineKey(deadline time.Time, sequence uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, deadlineNanos(deadline))
+	binary.BigEndian.PutUint64(key[8:], sequence)
+	return key
+}
+
+// parseDeadlineKey returns the deadline in unix nanoseconds and the sequence of the deadline key
+func parseDeadlineKey(key []byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])
+}
+
+// deadlineNanos returns the deadline in unix nanoseconds, the zero deadline of a negatively acknowledged message is 0
+func deadlineNanos(deadline time.Time) uint64 {
+	if deadline.IsZero() || deadline.UnixNano() < 0 {
+		return 0
+	}
+	return uint64(deadline.UnixNano())
+}
+
+// sequenceKey returns the sortable key of the sequence
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// putJSON stores the value as json
+func putJSON(bucket *bolt.Bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// subjectMatches checks if the subject matches the filter with * and > wildcards
+func subjectMatches(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range filterTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjectTokens)
+}
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NewClient connects to the nats server urls with the connection options
+// the options are reused for every connection the client creates, e.g. nats.UserCredentials,
+// nats.Nkey, nats.UserInfo, nats.Secure, nats.RootCAs, nats.Name and nats.MaxReconnects
+func NewClient(url string, options ...nats.Option) (*Client, error) {
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to nats server failed: %w", err)
+	}
+	return &Client{Conn: conn, URL: url, Options: options}, nil
+}
+
+// Close drains the pooled consumer connections and the connection of the client
+func (p *Client) Close() error {
+	p.mu.Lock()
+	pool := p.pool
+	p.pool = nil
+	p.mu.Unlock()
+
+	for _, conn := range pool {
+		if err := conn.Drain(); err != nil && err != nats.ErrConnectionClosed {
+			return fmt.Errorf("draining pooled connection failed: %w", err)
+		}
+	}
+	if p.Conn != nil {
+		if err := p.Conn.Drain(); err != nil && err != nats.ErrConnectionClosed {
+			return fmt.Errorf("draining connection failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// connect creates a new connection with the connection options of the client
+// without options the options of the client connection are copied
+func (p *Client) connect() (*nats.Conn, error) {
+	var conn *nats.Conn
+	var err error
+	if len(p.Options) == 0 && p.Conn != nil {
+		options := p.Conn.Opts
+		if p.URL != "" {
+			options.Url = p.URL
+			options.Servers = nil
+		}
+		conn, err = options.Connect()
+	} else {
+		url := p.URL
+		if url == "" {
+			// The connected url keeps the scheme and user info of the client connection
+			url = p.Conn.ConnectedUrl()
+		}
+		conn, err = nats.Connect(url, p.Options...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to nats server failed: %w", err)
+	}
+	return conn, nil
+}
+
+// consumerConn returns the connection for a consumer, release frees the connection when the consumer stops
+// without a pool every consumer gets its own connection, with a pool consumers share connections round robin
+func (p *Client) consumerConn() (conn *nats.Conn, release func() error, err error) {
+	if p.PoolSize <= 0 {
+		conn, err := p.connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.Drain, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Fill the pool up to its size and replace closed connections
+	index := p.next % p.PoolSize
+	p.next++
+	if index >= len(p.pool) {
+		conn, err := p.connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		p.pool = append(p.pool, conn)
+		index = len(p.pool) - 1
+	} else if p.pool[index].IsClosed() {
+		conn, err := p.connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		p.pool[index] = conn
+	}
+	return p.pool[index], func() error { return nil }, nil
+}
@@ -0,0 +1,337 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// kvOperationHeader header marking delete operations in a key value bucket
+	kvOperationHeader = "KV-Operation"
+	// expectedLastSequenceHeader header used for optimistic concurrency on a stream
+	expectedLastSequenceHeader = "Nats-Expected-Last-Sequence"
+	// jsNotFound JetStream error code returned when a stream or message doesn't exist
+	jsNotFound = 404
+	// maxStreamNameLength maximum length of a JetStream stream name
+	maxStreamNameLength = 256
+	// kvGetAttempts attempts to read the last message of a key which is replaced while it is read
+	kvGetAttempts = 3
+)
+
+var (
+	// ErrKeyNotFound err returned when the key doesn't exist in the bucket
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrRevisionMismatch err returned when the key has been changed since the given revision
+	ErrRevisionMismatch = errors.New("revision mismatch")
+	// ErrInvalidKey err returned when the key can't be represented in a subject
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// KeyValue key value bucket on JetStream servers without native key value support
+// every key is a stream KV_<bucket>_<encoded key> keeping only the last message of $KV.<bucket>.<key>
+// so revisions are stream sequences and updates use the expected last sequence of the stream
+// suited for small amounts of keys, e.g. leases, every key costs a stream on the server
+type KeyValue struct {
+	Conn    *nats.Conn
+	Bucket  string
+	TTL     time.Duration
+	Timeout time.Duration
+}
+
+// KeyValueEntry value of a key with its revision
+type KeyValueEntry struct {
+	Key      string
+	Value    []byte
+	Revision uint64
+	Created  time.Time
+}
+
+// jsAPIError error of a JetStream API response
+type jsAPIError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+// jsStoredMsg message returned by the JetStream message get API
+type jsStoredMsg struct {
+	Subject  string    `json:"subject"`
+	Sequence uint64    `json:"seq"`
+	Header   []byte    `json:"hdrs"`
+	Data     []byte    `json:"data"`
+	Time     time.Time `json:"time"`
+}
+
+// jsStreamState state of a stream returned by the JetStream stream info API
+type jsStreamState struct {
+	Messages uint64 `json:"messages"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+// NewKeyValue returns the bucket, streams of the keys are created on their first write
+// values expire after the ttl without update, ttl 0 keeps values forever
+func NewKeyValue(conn *nats.Conn, bucket string, ttl time.Duration) (*KeyValue, error) {
+	if bucket == "" || strings.ContainsAny(bucket, ".*> \t\r\n") {
+		return nil, fmt.Errorf("%w: bucket %q", ErrInvalidKey, bucket)
+	}
+	return &KeyValue{Conn: conn, Bucket: bucket, TTL: ttl, Timeout: time.Second * 5}, nil
+}
+
+// Get returns the latest value of the key
+func (kv *KeyValue) Get(key string) (*KeyValueEntry, error) {
+	if err := kv.validateKey(key); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		last, err := kv.last(key)
+		if errors.Is(err, errReplaced) && attempt < kvGetAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if last == nil || isDeleteMarker(last) {
+			// Deleted keys keep a marker message
+			return nil, ErrKeyNotFound
+		}
+
+		return &KeyValueEntry{
+			Key:      key,
+			Value:    last.Data,
+			Revision: last.Sequence,
+			Created:  last.Time,
+		}, nil
+	}
+}
+
+// Put sets the value of the key and returns the new revision
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	if err := kv.createStream(key); err != nil {
+		return 0, err
+	}
+	return kv.publish(nats.NewMsg(kv.subject(key)), key, value)
+}
+
+// Create sets the value of the key only when the key doesn't exist
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	if err := kv.createStream(key); err != nil {
+		return 0, err
+	}
+	state, err := kv.state(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Deleted and expired keys are recreated on top of their last sequence
+	if state.Messages > 0 {
+		_, err := kv.Get(key)
+		if err == nil {
+			return 0, fmt.Errorf("creating key %s failed: %w", key, ErrRevisionMismatch)
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			return 0, err
+		}
+	}
+
+	msg := nats.NewMsg(kv.subject(key))
+	if state.LastSeq > 0 {
+		msg.Header.Set(expectedLastSequenceHeader, strconv.FormatUint(state.LastSeq, 10))
+	}
+	// The server ignores an expected last sequence of 0, concurrent creates of a new key are dropped as duplicates
+	msg.Header.Set(MsgIDHeader, fmt.Sprintf("create-%d", state.LastSeq))
+	return kv.publish(msg, key, value)
+}
+
+// Update sets the value of the key only when the latest revision equals the given revision
+func (kv *KeyValue) Update(key string, value []byte, revision uint64) (uint64, error) {
+	if revision == 0 {
+		return kv.Create(key, value)
+	}
+	if err := kv.validateKey(key); err != nil {
+		return 0, err
+	}
+	msg := nats.NewMsg(kv.subject(key))
+	msg.Header.Set(expectedLastSequenceHeader, strconv.FormatUint(revision, 10))
+	return kv.publish(msg, key, value)
+}
+
+// Delete removes the key
+func (kv *KeyValue) Delete(key string) error {
+	if err := kv.createStream(key); err != nil {
+		return err
+	}
+	msg := nats.NewMsg(kv.subject(key))
+	msg.Header.Set(kvOperationHeader, "DEL")
+	_, err := kv.publish(msg, key, nil)
+	return err
+}
+
+// isDeleteMarker checks if the message marks a deleted key, header names are canonicalized when published
+func isDeleteMarker(msg *jsStoredMsg) bool {
+	return bytes.Contains(bytes.ToLower(msg.Header), []byte(strings.ToLower(kvOperationHeader)))
+}
+
+// errReplaced err returned when the last message of a key is replaced while it is read
+var errReplaced = errors.New("key replaced while reading")
+
+// last returns the last message of the key including delete markers, nil when the key was never written or expired
+func (kv *KeyValue) last(key string) (*jsStoredMsg, error) {
+	state, err := kv.state(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.Messages == 0 {
+		return nil, nil
+	}
+
+	var response struct {
+		Error   *jsAPIError  `json:"error"`
+		Message *jsStoredMsg `json:"message"`
+	}
+	request := map[string]uint64{"seq": state.LastSeq}
+	if err := kv.request("$JS.API.STREAM.MSG.GET."+kv.streamName(key), request, &response); err != nil {
+		return nil, fmt.Errorf("getting key %s failed: %w", key, err)
+	}
+	if response.Error != nil || response.Message == nil {
+		// The message is removed by a newer revision or expired since the stream state was read
+		return nil, fmt.Errorf("getting key %s failed: %w", key, errReplaced)
+	}
+	return response.Message, nil
+}
+
+// state returns the state of the stream of the key, ErrKeyNotFound when the key never had a stream
+func (kv *KeyValue) state(key string) (*jsStreamState, error) {
+	var response struct {
+		Error *jsAPIError   `json:"error"`
+		State jsStreamState `json:"state"`
+	}
+	if err := kv.request("$JS.API.STREAM.INFO."+kv.streamName(key), nil, &response); err != nil {
+		return nil, fmt.Errorf("getting key %s failed: %w", key, err)
+	}
+	if response.Error != nil {
+		if response.Error.Code == jsNotFound {
+			return nil, ErrKeyNotFound
+		}
+		return nil, fmt.Errorf("getting key %s failed: %s", key, response.Error.Description)
+	}
+	return &response.State, nil
+}
+
+// createStream creates the stream of the key, creating an existing stream with the same config succeeds
+func (kv *KeyValue) createStream(key string) error {
+	if err := kv.validateKey(key); err != nil {
+		return err
+	}
+
+	config := map[string]interface{}{
+		"name":          kv.streamName(key),
+		"subjects":      []string{kv.subject(key)},
+		"retention":     "limits",
+		"max_consumers": -1,
+		"max_msgs":      1,
+		"max_bytes":     -1,
+		"max_age":       kv.TTL.Nanoseconds(),
+		"discard":       "old",
+		"storage":       "file",
+		"num_replicas":  1,
+	}
+	var response struct {
+		Error *jsAPIError `json:"error"`
+	}
+	if err := kv.request("$JS.API.STREAM.CREATE."+kv.streamName(key), config, &response); err != nil {
+		return fmt.Errorf("creating key %s failed: %w", key, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("creating key %s failed: %s", key, response.Error.Description)
+	}
+	return nil
+}
+
+// publish publishes the value and waits for the JetStream acknowledgement
+func (kv *KeyValue) publish(msg *nats.Msg, key string, value []byte) (uint64, error) {
+	msg.Data = value
+	res, err := kv.Conn.RequestMsg(msg, kv.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("publishing key %s failed: %w", key, err)
+	}
+
+	var ack struct {
+		Error     *jsAPIError `json:"error"`
+		Sequence  uint64      `json:"seq"`
+		Duplicate bool        `json:"duplicate"`
+	}
+	if err := json.Unmarshal(res.Data, &ack); err != nil {
+		return 0, fmt.Errorf("publishing key %s failed: %w", key, err)
+	}
+	if ack.Error != nil {
+		if strings.HasPrefix(ack.Error.Description, "wrong last sequence") {
+			return 0, fmt.Errorf("publishing key %s failed: %w", key, ErrRevisionMismatch)
+		}
+		return 0, fmt.Errorf("publishing key %s failed: %s", key, ack.Error.Description)
+	}
+	if ack.Duplicate {
+		// Another client created the key concurrently
+		return 0, fmt.Errorf("publishing key %s failed: %w", key, ErrRevisionMismatch)
+	}
+	return ack.Sequence, nil
+}
+
+// request sends a JetStream API request and unmarshals the response
+func (kv *KeyValue) request(subject string, request interface{}, response interface{}) error {
+	var data []byte
+	if request != nil {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+	res, err := kv.Conn.Request(subject, data, kv.Timeout)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(res.Data, response)
+}
+
+// streamName returns the stream name of the key
+// characters other than letters, digits and dashes are hex encoded so every key has its own stream
+func (kv *KeyValue) streamName(key string) string {
+	var name strings.Builder
+	name.WriteString("KV_")
+	name.WriteString(kv.Bucket)
+	name.WriteString("_")
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			name.WriteByte(c)
+		} else {
+			fmt.Fprintf(&name, "_%02x", c)
+		}
+	}
+	return name.String()
+}
+
+// subject returns the subject of the key
+func (kv *KeyValue) subject(key string) string {
+	return fmt.Sprintf("$KV.%s.%s", kv.Bucket, key)
+}
+
+// validateKey validates if the key can be represented in a subject and a stream name
+func (kv *KeyValue) validateKey(key string) error {
+	if key == "" || strings.ContainsAny(key, "*> \t\r\n") || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") || strings.Contains(key, "..") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	if len(kv.streamName(key)) > maxStreamNameLength {
+		return fmt.Errorf("%w: %q exceeds the stream name length", ErrInvalidKey, key)
+	}
+	return nil
+}
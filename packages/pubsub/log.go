@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+)
+
+// Log append only log on a JetStream stream, messages of a subject are read back in order
+// appends wait for the acknowledgement of JetStream so failed appends are returned
+type Log struct {
+	Conn    *nats.Conn
+	Stream  string
+	Timeout time.Duration
+}
+
+// NewLog creates the stream of the log when it doesn't exist, messages expire after the ttl, ttl 0 keeps them forever
+// the stream contains every subject prefixed with the stream name
+func NewLog(conn *nats.Conn, stream string, ttl time.Duration) (*Log, error) {
+	manager, err := jsm.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("creating new manager failed: %w", err)
+	}
+	_, err = manager.LoadOrNewStream(stream, jsm.Subjects(stream+".>"), jsm.MaxAge(ttl), jsm.FileStorage(), jsm.LimitsRetention(), jsm.DiscardOld())
+	if err != nil {
+		return nil, fmt.Errorf("creating log stream %s failed: %w", stream, err)
+	}
+	return &Log{Conn: conn, Stream: stream, Timeout: defaultPublishTimeout}, nil
+}
+
+// LoadLog loads the log of an existing stream, the stream isn't created when it doesn't exist
+func LoadLog(conn *nats.Conn, stream string) (*Log, error) {
+	manager, err := jsm.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("creating new manager failed: %w", err)
+	}
+	if _, err := manager.LoadStream(stream); err != nil {
+		return nil, fmt.Errorf("loading log stream %s failed: %w", stream, err)
+	}
+	return &Log{Conn: conn, Stream: stream, Timeout: defaultPublishTimeout}, nil
+}
+
+// Append appends the data to the subject of the log once JetStream acknowledged it
+func (l *Log) Append(subject string, data []byte) error {
+	msg := nats.NewMsg(l.subject(subject))
+	msg.Data = data
+	publisher := &Client{Conn: l.Conn, PublishTimeout: l.Timeout}
+	return publisher.PublishMsg(msg)
+}
+
+// Read calls the callback with every message of the subject in the log in order
+func (l *Log) Read(subject string, callback func(data []byte) error) error {
+	manager, err := jsm.New(l.Conn, jsm.WithTimeout(l.Timeout))
+	if err != nil {
+		return fmt.Errorf("creating new manager failed: %w", err)
+	}
+
+	inbox := nats.NewInbox()
+	sub, err := l.Conn.SubscribeSync(inbox)
+	if err != nil {
+		return fmt.Errorf("reading log %s failed: %w", subjectPrefix(l.subject(subject)), err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	consumer, err := manager.NewConsumer(l.Stream, jsm.DeliverySubject(inbox), jsm.FilterStreamBySubject(l.subject(subject)), jsm.DeliverAllAvailable(), jsm.AcknowledgeNone())
+	if err != nil {
+		return fmt.Errorf("reading log %s failed: %w", subjectPrefix(l.subject(subject)), err)
+	}
+	defer func() {
+		_ = consumer.Delete()
+	}()
+
+	// Nothing was delivered nor is pending, the subject has no messages
+	state, err := consumer.State()
+	if err != nil {
+		return fmt.Errorf("reading log %s failed: %w", subjectPrefix(l.subject(subject)), err)
+	}
+	if state.Delivered.Consumer == 0 && state.NumPending == 0 {
+		return nil
+	}
+
+	for {
+		msg, err := sub.NextMsg(l.Timeout)
+		if err != nil {
+			return fmt.Errorf("reading log %s failed: %w", subjectPrefix(l.subject(subject)), err)
+		}
+		if err := callback(msg.Data); err != nil {
+			return err
+		}
+
+		// Delivered messages carry the amount of messages still pending for the consumer
+		metadata, err := jsm.ParseJSMsgMetadata(msg)
+		if err != nil {
+			return fmt.Errorf("reading log %s failed: %w", subjectPrefix(l.subject(subject)), err)
+		}
+		if metadata.Pending() == 0 {
+			return nil
+		}
+	}
+}
+
+// subject returns the subject of the log prefixed with the stream name
+func (l *Log) subject(subject string) string {
+	return l.Stream + "." + subject
+}
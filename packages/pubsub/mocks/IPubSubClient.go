@@ -26,6 +26,27 @@ func (_m *IPubSubClient) Consume(consumer, stream string, cb func(*nats.Msg)) er
 	return r0
 }
 
+// Pending provides a mock function with given fields: consumer, stream
+func (_m *IPubSubClient) Pending(consumer string, stream string) (uint64, error) {
+	ret := _m.Called(consumer, stream)
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func(string, string) uint64); ok {
+		r0 = rf(consumer, stream)
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(consumer, stream)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Publish provides a mock function with given fields: subj, data
 func (_m *IPubSubClient) Publish(subj string, data []byte) error {
 	ret := _m.Called(subj, data)
@@ -40,6 +61,20 @@ func (_m *IPubSubClient) Publish(subj string, data []byte) error {
 	return r0
 }
 
+// PublishMsg provides a mock function with given fields: msg
+func (_m *IPubSubClient) PublishMsg(msg *nats.Msg) error {
+	ret := _m.Called(msg)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*nats.Msg) error); ok {
+		r0 = rf(msg)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Subscribe provides a mock function with given fields: subj, cb
 func (_m *IPubSubClient) Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error) {
 	ret := _m.Called(subj, cb)
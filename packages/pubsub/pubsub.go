@@ -3,67 +3,270 @@ package pubsub
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/jsm.go/api"
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// MsgIDHeader header used by JetStream to deduplicate published messages
+	MsgIDHeader = "Nats-Msg-Id"
+	// statusHeader header of JetStream status messages, e.g. 408 when a pull request expired
+	statusHeader = "Status"
+	// defaultMaxWait default time a pull request waits for a full batch
+	defaultMaxWait = time.Second
+	// defaultPublishTimeout default time a publish waits for the acknowledgement of JetStream
+	defaultPublishTimeout = time.Second * 5
+)
+
+var (
+	// ErrNotAcknowledged err returned when a published message isn't acknowledged by a stream
+	ErrNotAcknowledged = errors.New("not acknowledged by a stream")
+	// errDeadlineExceeded err returned when the connection of a consumer timed out
+	errDeadlineExceeded = errors.New("connection deadline exceeded")
+	// errReconnected err returned when the connection of a consumer reconnected and outstanding pull requests are lost
+	errReconnected = errors.New("connection reconnected")
+)
+
 // IPubSubClient wrapper of github.com/nats-io/nats.go client
 type IPubSubClient interface {
 	Publish(subj string, data []byte) error
+	PublishMsg(msg *nats.Msg) error
 	Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error)
 	Consume(consumer, stream string, cb func(msg *nats.Msg)) error
+	Pending(consumer, stream string) (uint64, error)
+}
+
+// IAcknowledger optional interface of clients acknowledging consumed messages themselves
+// messages of clients without it are acknowledged on their JetStream reply subject
+type IAcknowledger interface {
+	Ack(msg *nats.Msg) error
+	Nak(msg *nats.Msg) error
+	InProgress(msg *nats.Msg) error
+}
+
+// IConsumerManager optional interface of clients creating their durable consumers on startup
+// consumers of clients without it, e.g. JetStream, have to exist before consuming
+type IConsumerManager interface {
+	AddConsumer(name, filter string) error
+}
+
+// Ack acknowledges the consumed message so it isn't redelivered
+func Ack(client IPubSubClient, msg *nats.Msg) error {
+	if acknowledger, ok := client.(IAcknowledger); ok {
+		return acknowledger.Ack(msg)
+	}
+	return msg.Respond(nil)
+}
+
+// Nak negatively acknowledges the consumed message so it is redelivered
+func Nak(client IPubSubClient, msg *nats.Msg) error {
+	if acknowledger, ok := client.(IAcknowledger); ok {
+		return acknowledger.Nak(msg)
+	}
+	return msg.Nak()
+}
+
+// InProgress extends the acknowledgement deadline of the consumed message
+func InProgress(client IPubSubClient, msg *nats.Msg) error {
+	if acknowledger, ok := client.(IAcknowledger); ok {
+		return acknowledger.InProgress(msg)
+	}
+	return msg.AckProgress()
+}
+
+// Delivered returns how often the consumed message has been delivered, 1 for messages without delivery metadata
+func Delivered(msg *nats.Msg) uint64 {
+	if strings.HasPrefix(msg.Reply, boltAckPrefix) {
+		if _, _, deliveries, err := parseBoltReply(msg.Reply); err == nil && deliveries > 0 {
+			return uint64(deliveries)
+		}
+		return 1
+	}
+	metadata, err := jsm.ParseJSMsgMetadata(msg)
+	if err != nil || metadata.Delivered() == 0 {
+		return 1
+	}
+	return uint64(metadata.Delivered())
+}
+
+// subjectPrefix returns the subject without its last token, which holds the identifier of the message
+// used in errors so they don't contain patient data
+func subjectPrefix(subject string) string {
+	if i := strings.LastIndex(subject, "."); i >= 0 {
+		return subject[:i]
+	}
+	return subject
+}
+
+// IsRetryable reports if a failed publish may succeed later, e.g. on timeouts, missing responders or disconnects
+func IsRetryable(err error) bool {
+	for _, retryable := range []error{
+		nats.ErrTimeout,
+		nats.ErrNoResponders,
+		nats.ErrDisconnected,
+		nats.ErrConnectionClosed,
+		nats.ErrConnectionReconnecting,
+		nats.ErrConnectionDraining,
+		context.DeadlineExceeded,
+	} {
+		if errors.Is(err, retryable) {
+			return true
+		}
+	}
+	return false
 }
 
 // Client struct
 type Client struct {
 	Conn *nats.Conn
+	// URL nats server urls used for the connections of consumers
+	// Default the connected url of Conn
+	URL string
+	// Options connection options applied to every connection the client creates
+	// Default the options of Conn, so clients without NewClient keep e.g. the credentials and reconnect options
+	Options []nats.Option
+	// PoolSize amount of connections shared by all consumers
+	// Default 0 opens a connection per consumer
+	PoolSize int
+	// BatchSize amount of messages fetched per pull request of a consumer
+	// Default 1 fetches messages one at a time
+	BatchSize int
+	// MaxWait maximum time a pull request waits for a full batch
+	// Default 1 second
+	MaxWait time.Duration
+	// Concurrency amount of messages of a fetched batch handled at the same time
+	// Default 1
+	Concurrency int
+	// PublishTimeout time PublishMsg waits for the acknowledgement of JetStream
+	// Default 5 seconds
+	PublishTimeout time.Duration
+
+	mu   sync.Mutex
+	pool []*nats.Conn
+	next int
 }
 
-// Publish wrapper for connection publish function
+// Publish wrapper for connection publish function, doesn't wait for an acknowledgement
 func (p *Client) Publish(topic string, data []byte) error {
 	return p.Conn.Publish(topic, data)
 }
 
+// PublishMsg publishes the message to JetStream and waits for the acknowledgement of the stream
+// an error is returned when the message isn't stored, e.g. when JetStream is unavailable
+func (p *Client) PublishMsg(msg *nats.Msg) error {
+	timeout := p.PublishTimeout
+	if timeout <= 0 {
+		timeout = defaultPublishTimeout
+	}
+
+	res, err := p.Conn.RequestMsg(msg, timeout)
+	if err != nil {
+		return fmt.Errorf("publishing to %s failed: %w", subjectPrefix(msg.Subject), err)
+	}
+
+	var ack struct {
+		Error    *jsAPIError `json:"error"`
+		Stream   string      `json:"stream"`
+		Sequence uint64      `json:"seq"`
+	}
+	if err := json.Unmarshal(res.Data, &ack); err != nil {
+		return fmt.Errorf("publishing to %s failed: invalid acknowledgement: %w", subjectPrefix(msg.Subject), err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("publishing to %s failed: %s", subjectPrefix(msg.Subject), ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("publishing to %s failed: %w", subjectPrefix(msg.Subject), ErrNotAcknowledged)
+	}
+	return nil
+}
+
 // Consume creates a new consumer connection ands start listing for messages
 // every message is handled by the given callback parameter
-func (p *Client) Consume(consumer, stream string, callback func(msg *nats.Msg)) (err error) {
-	// Create new connection for every consumer
+// with a batch size above 1 or a connection pool messages are fetched in batches, see consumeBatches
+func (p *Client) Consume(consumer, stream string, callback func(msg *nats.Msg)) error {
+	for {
+		err := p.consume(consumer, stream, callback)
+		if errors.Is(err, errReconnected) {
+			logrus.Warn("consumer connection reconnected, returning fresh consumer with new connection")
+			continue
+		}
+		if !errors.Is(err, errDeadlineExceeded) {
+			return err
+		}
+		// Handle timeout by returning new consumer
+		logrus.Warn("connection deadline exceeded, returning fresh consumer with new connection")
+	}
+}
+
+// consume consumes messages until the consumer fails
+// errDeadlineExceeded is returned when the consumer should be recreated on a new connection
+func (p *Client) consume(consumer, stream string, callback func(msg *nats.Msg)) error {
+	// Create new connection for every consumer, or share a pooled connection
 	// We do this because every consumer connection is blocking
-	consumerConn, err := nats.Connect(p.Conn.ConnectedAddr())
+	consumerConn, release, err := p.consumerConn()
 	if err != nil {
-		return fmt.Errorf("connecting to nats server failed: %w", err)
+		return err
 	}
 
 	// Create new manager for consumer connection
 	manager, err := jsm.New(consumerConn, jsm.WithTimeout(time.Hour*1))
 	if err != nil {
+		_ = release()
 		return fmt.Errorf("creating new manager failed: %w", err)
 	}
 
 	// Load active consumer from manager
 	activeConsumer, err := manager.LoadConsumer(stream, consumer)
 	if err != nil {
+		_ = release()
 		return fmt.Errorf("loading consumer %s for stream %s failed: %w", consumer, stream, err)
 	}
 
+	if p.BatchSize > 1 || p.PoolSize > 0 {
+		// Pooled consumers pull on their own inbox, requests of consumers sharing a connection would block each other
+		defer func() {
+			_ = release()
+		}()
+		return p.consumeBatches(consumerConn, activeConsumer, callback)
+	}
+
+	// A pull request is lost when the server restarts, stop waiting for it once the connection reconnected
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reconnected := consumerConn.Opts.ReconnectedCB
+	consumerConn.SetReconnectHandler(func(conn *nats.Conn) {
+		cancel()
+		if reconnected != nil {
+			reconnected(conn)
+		}
+	})
+
 	// Poll messages on the active consumer
 	for {
-		msg, err := activeConsumer.NextMsg()
+		msg, err := nextMsg(ctx, activeConsumer)
 		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				_ = release()
+				return errReconnected
+			}
 			if errors.Is(err, context.DeadlineExceeded) {
-				// Handle timeout by returning new consumer
-				logrus.Warn("connection deadline exceeded, returning fresh consumer with new connection")
-				err := consumerConn.Drain()
+				err := release()
 				if err != nil {
 					return fmt.Errorf("draining timed out consumer connection failed: %w", err)
 				}
-				return p.Consume(consumer, stream, callback)
+				return errDeadlineExceeded
 			}
+			_ = release()
 			return fmt.Errorf("uknown error from active consumer: %w", err)
 		}
 
@@ -72,6 +275,114 @@ func (p *Client) Consume(consumer, stream string, callback func(msg *nats.Msg))
 	}
 }
 
+// nextMsg waits for the next message of the active consumer until the context is cancelled or an hour passed
+func nextMsg(ctx context.Context, activeConsumer *jsm.Consumer) (*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	return activeConsumer.NextMsgContext(ctx)
+}
+
+// consumeBatches fetches batches of messages on the active consumer and handles every batch concurrently
+// the acknowledgements of a batch are pipelined on the connection and flushed once per batch
+func (p *Client) consumeBatches(conn *nats.Conn, activeConsumer *jsm.Consumer, callback func(msg *nats.Msg)) error {
+	inbox := nats.NewInbox()
+	sub, err := conn.SubscribeSync(inbox)
+	if err != nil {
+		return fmt.Errorf("subscribing to batch inbox failed: %w", err)
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	maxWait := p.MaxWait
+	if maxWait <= 0 {
+		maxWait = defaultMaxWait
+	}
+
+	batchSize := p.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	batch := make([]*nats.Msg, 0, batchSize)
+	for {
+		expires := time.Now().Add(maxWait)
+		err := activeConsumer.NextMsgRequest(inbox, &api.JSApiConsumerGetNextRequest{
+			Batch:   batchSize,
+			Expires: expires,
+		})
+		if err != nil {
+			return fmt.Errorf("requesting batch from consumer %s failed: %w", activeConsumer.Name(), err)
+		}
+
+		batch = batch[:0]
+		for len(batch) < batchSize {
+			msg, err := sub.NextMsg(time.Until(expires))
+			if errors.Is(err, nats.ErrTimeout) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("receiving batch from consumer %s failed: %w", activeConsumer.Name(), err)
+			}
+			if len(msg.Data) == 0 && msg.Header.Get(statusHeader) != "" {
+				// Pull request expired or was rejected, handle what was received
+				break
+			}
+			batch = append(batch, msg)
+		}
+
+		p.handleBatch(batch, callback)
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("flushing acknowledgements of consumer %s failed: %w", activeConsumer.Name(), err)
+		}
+	}
+}
+
+// handleBatch handles the messages of a batch with at most Concurrency callbacks at the same time
+func (p *Client) handleBatch(batch []*nats.Msg, callback func(msg *nats.Msg)) {
+	if p.Concurrency <= 1 {
+		for _, msg := range batch {
+			callback(msg)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, p.Concurrency)
+	for _, msg := range batch {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(msg *nats.Msg) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			callback(msg)
+		}(msg)
+	}
+	wg.Wait()
+}
+
+// Pending returns the amount of messages waiting for delivery or acknowledgement on the consumer
+func (p *Client) Pending(consumer, stream string) (uint64, error) {
+	manager, err := jsm.New(p.Conn)
+	if err != nil {
+		return 0, fmt.Errorf("creating new manager failed: %w", err)
+	}
+
+	activeConsumer, err := manager.LoadConsumer(stream, consumer)
+	if err != nil {
+		return 0, fmt.Errorf("loading consumer %s for stream %s failed: %w", consumer, stream, err)
+	}
+
+	state, err := activeConsumer.State()
+	if err != nil {
+		return 0, fmt.Errorf("loading state of consumer %s failed: %w", consumer, err)
+	}
+
+	return state.NumPending + uint64(state.NumAckPending), nil
+}
+
 // Subscribe wrapper for connection subscribe function
 func (p *Client) Subscribe(topic string, callback nats.MsgHandler) (subscription *nats.Subscription, err error) {
 	s, err := p.Conn.Subscribe(topic, func(msg *nats.Msg) {
@@ -1,10 +1,20 @@
 package pubsub
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lumc/fhirhose/packages/pubsub/mocks"
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestMockClient(t *testing.T) {
@@ -12,3 +22,542 @@ func TestMockClient(t *testing.T) {
 	var register IPubSubClient = &mocks.IPubSubClient{}
 	fmt.Println(register)
 }
+
+// startServer starts an embedded nats server with JetStream enabled
+func startServer(tb testing.TB, opts server.Options) *server.Server {
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = tb.TempDir()
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(&opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(time.Second * 5) {
+		tb.Fatal("embedded nats server not ready")
+	}
+	tb.Cleanup(s.Shutdown)
+	return s
+}
+
+// startJetStream starts an embedded nats server and connects to it
+func startJetStream(tb testing.TB) *nats.Conn {
+	s := startServer(tb, server.Options{})
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(conn.Close)
+	return conn
+}
+
+// createConsumer creates a memory stream with a durable pull consumer and publishes the amount of messages
+func createConsumer(tb testing.TB, conn *nats.Conn, amount int) *jsm.Consumer {
+	manager, err := jsm.New(conn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stream, err := manager.NewStream("bench", jsm.Subjects("bench.>"), jsm.MemoryStorage())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	consumer, err := stream.NewConsumer(jsm.DurableName("worker"), jsm.AcknowledgeExplicit(), jsm.DeliverAllAvailable())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for i := 0; i < amount; i++ {
+		if _, err := conn.Request("bench.item", []byte("message"), time.Second); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return consumer
+}
+
+func TestConsumeBatches(t *testing.T) {
+	conn := startJetStream(t)
+	consumer := createConsumer(t, conn, 25)
+	client := &Client{Conn: conn, BatchSize: 10, MaxWait: time.Millisecond * 100, Concurrency: 4}
+
+	var mu sync.Mutex
+	received := 0
+	done := make(chan struct{})
+	go func() {
+		_ = client.Consume("worker", "bench", func(msg *nats.Msg) {
+			_ = msg.Respond(nil)
+			mu.Lock()
+			defer mu.Unlock()
+			received++
+			if received == 25 {
+				close(done)
+			}
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("expected 25 messages, received %d", received)
+	}
+
+	// Acknowledgements are flushed after the batch
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		state, err := consumer.State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.NumAckPending == 0 && state.NumPending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all messages acknowledged, %d pending", state.NumAckPending)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestConsumeWithConnectionOptions(t *testing.T) {
+	s := startServer(t, server.Options{Username: "fhirhose", Password: "secret"})
+	client, err := NewClient(s.ClientURL(), nats.UserInfo("fhirhose", "secret"), nats.Name("fhirhose"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.PoolSize = 1
+	createConsumer(t, client.Conn, 2)
+
+	received := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_ = client.Consume("worker", "bench", func(msg *nats.Msg) {
+				_ = msg.Respond(nil)
+				received <- msg.Subject
+			})
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected the authenticated consumers to receive messages")
+		}
+	}
+	if clients := s.NumClients(); clients != 2 {
+		t.Fatalf("expected the consumers to share a pooled connection, %d connections", clients)
+	}
+}
+
+func TestConsumerConnKeepsOptionsOfConn(t *testing.T) {
+	s := startServer(t, server.Options{Username: "fhirhose", Password: "secret"})
+	conn, err := nats.Connect(s.ClientURL(), nats.UserInfo("fhirhose", "secret"), nats.Name("fhirhose"), nats.MaxReconnects(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Conn: conn}
+	defer client.Close()
+
+	consumerConn, release, err := client.consumerConn()
+	if err != nil {
+		t.Fatalf("expected the consumer connection to use the credentials of the client connection: %v", err)
+	}
+	defer release()
+	if consumerConn.Opts.Name != "fhirhose" || consumerConn.Opts.MaxReconnect != -1 {
+		t.Fatalf("expected the options of the client connection, got name %q and max reconnects %d", consumerConn.Opts.Name, consumerConn.Opts.MaxReconnect)
+	}
+}
+
+func TestPublishMsgWaitsForAcknowledgement(t *testing.T) {
+	conn := startJetStream(t)
+	createConsumer(t, conn, 0)
+	client := &Client{Conn: conn, PublishTimeout: time.Millisecond * 200}
+
+	if err := client.PublishMsg(nats.NewMsg("bench.item")); err != nil {
+		t.Fatalf("expected publish to the stream to be acknowledged: %v", err)
+	}
+	err := client.PublishMsg(nats.NewMsg("unknown.item"))
+	if err == nil {
+		t.Fatal("expected publish without stream to fail")
+	}
+	if strings.Contains(err.Error(), "item") {
+		t.Fatalf("expected the error not to contain the last subject token: %v", err)
+	}
+}
+
+// BenchmarkConsume measures messages per second for different batch sizes against an embedded server
+func BenchmarkConsume(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 50, 100} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			conn := startJetStream(b)
+			createConsumer(b, conn, b.N)
+			client := &Client{Conn: conn, BatchSize: batchSize, MaxWait: time.Millisecond * 100, Concurrency: 4}
+
+			var received int64
+			done := make(chan struct{})
+			b.ResetTimer()
+			start := time.Now()
+			go func() {
+				_ = client.Consume("worker", "bench", func(msg *nats.Msg) {
+					_ = msg.Respond(nil)
+					if atomic.AddInt64(&received, 1) == int64(b.N) {
+						close(done)
+					}
+				})
+			}()
+			<-done
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
+
+func TestBoltClient(t *testing.T) {
+	client, err := NewBoltClient(filepath.Join(t.TempDir(), "fhirhose.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.AckWait = time.Millisecond * 50
+	client.MaxDeliver = 2
+
+	if err := client.AddConsumer("fhirhose-user-polled", "fhirhose.user.polled.>"); err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"fhirhose.user.polled.1", "fhirhose.user.retrieved.1", "fhirhose.user.polled.2"} {
+		msg := nats.NewMsg(subject)
+		msg.Header.Set(MsgIDHeader, subject)
+		if err := client.PublishMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+		// Duplicates within the duplicate window are dropped
+		if err := client.PublishMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, err := client.Pending("fhirhose-user-polled", "fhirhose"); err != nil || pending != 2 {
+		t.Fatalf("expected 2 pending messages, got %d: %v", pending, err)
+	}
+	if _, err := client.Pending("fhirhose-user-missing", "fhirhose"); !errors.Is(err, ErrConsumerNotFound) {
+		t.Fatalf("expected consumer not found, got %v", err)
+	}
+
+	received := make(chan *nats.Msg, 10)
+	go func() {
+		_ = client.Consume("fhirhose-user-polled", "fhirhose", func(msg *nats.Msg) {
+			received <- msg
+		})
+	}()
+	next := func() *nats.Msg {
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("expected a message")
+			return nil
+		}
+	}
+
+	first := next()
+	second := next()
+	if first.Subject != "fhirhose.user.polled.1" || second.Subject != "fhirhose.user.polled.2" {
+		t.Fatalf("expected messages in order, got %s and %s", first.Subject, second.Subject)
+	}
+	if err := Ack(client, first); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := client.Pending("fhirhose-user-polled", "fhirhose"); err != nil || pending != 1 {
+		t.Fatalf("expected the acknowledged message not to be pending, %d pending: %v", pending, err)
+	}
+
+	// The unacknowledged message is redelivered after the ack wait until max deliver
+	if delivered := Delivered(second); delivered != 1 {
+		t.Fatalf("expected the first delivery, got %d", delivered)
+	}
+	redelivered := next()
+	if redelivered.Subject != "fhirhose.user.polled.2" {
+		t.Fatalf("expected redelivery of the unacknowledged message, got %s", redelivered.Subject)
+	}
+	if delivered := Delivered(redelivered); delivered != 2 {
+		t.Fatalf("expected the second delivery, got %d", delivered)
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("expected no delivery after max deliver, got %s", msg.Subject)
+	case <-time.After(time.Millisecond * 200):
+	}
+	if pending, err := client.Pending("fhirhose-user-polled", "fhirhose"); err != nil || pending != 0 {
+		t.Fatalf("expected no pending messages after max deliver, %d pending: %v", pending, err)
+	}
+}
+
+func TestBoltClientIdleConsumer(t *testing.T) {
+	client, err := NewBoltClient(filepath.Join(t.TempDir(), "fhirhose.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.PollInterval = time.Millisecond * 10
+
+	if err := client.AddConsumer("fhirhose-user-polled", "fhirhose.user.polled.>"); err != nil {
+		t.Fatal(err)
+	}
+	var published []string
+	subscription, err := client.Subscribe("fhirhose.user.>", func(msg *nats.Msg) {
+		published = append(published, msg.Subject)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"fhirhose.user.polled.1", "fhirhose.user.retrieved.1"} {
+		if err := client.Publish(subject, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Unsubscribe(subscription); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("fhirhose.user.polled.2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 2 {
+		t.Fatalf("expected no callbacks after unsubscribe, got %v", published)
+	}
+
+	received := make(chan *nats.Msg, 10)
+	go func() {
+		_ = client.Consume("fhirhose-user-polled", "fhirhose", func(msg *nats.Msg) {
+			received <- msg
+		})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			if err := Ack(client, msg); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a message")
+		}
+	}
+
+	// An idle consumer only reads, the last committed transaction stays the same
+	lastTx := func() (id int) {
+		_ = client.DB.View(func(tx *bolt.Tx) error {
+			id = tx.ID()
+			return nil
+		})
+		return id
+	}
+	time.Sleep(time.Millisecond * 20)
+	idle := lastTx()
+	time.Sleep(time.Millisecond * 100)
+	if tx := lastTx(); tx != idle {
+		t.Fatalf("expected no writes of an idle consumer, transaction %d after %d", tx, idle)
+	}
+
+	// Negatively acknowledged messages are redelivered before the ack wait
+	if err := client.Publish("fhirhose.user.polled.3", nil); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+	if err := Nak(client, msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case redelivered := <-received:
+		if redelivered.Subject != msg.Subject || Delivered(redelivered) != 2 {
+			t.Fatalf("expected the redelivery of %s, got %s", msg.Subject, redelivered.Subject)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a redelivery")
+	}
+}
+
+func TestBoltClientRetention(t *testing.T) {
+	client, err := NewBoltClient(filepath.Join(t.TempDir(), "fhirhose.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.MaxMsgs = 2
+
+	if err := client.AddConsumer("fhirhose-user-polled", "fhirhose.user.polled.*"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Publish(fmt.Sprintf("fhirhose.user.polled.%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, err := client.Pending("fhirhose-user-polled", "fhirhose"); err != nil || pending != 2 {
+		t.Fatalf("expected the oldest message to be removed, %d pending: %v", pending, err)
+	}
+
+	// Changing the filter recounts the pending messages
+	if err := client.AddConsumer("fhirhose-user-polled", "fhirhose.user.polled.2"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := client.Pending("fhirhose-user-polled", "fhirhose"); err != nil || pending != 1 {
+		t.Fatalf("expected the pending messages of the new filter, %d pending: %v", pending, err)
+	}
+}
+
+func TestKeyValue(t *testing.T) {
+	conn := startJetStream(t)
+	kv, err := NewKeyValue(conn, "leases", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.Get("fhirhose.user"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected unknown key not to be found: %v", err)
+	}
+	revision, err := kv.Put("fhirhose.user", []byte("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("fhirhose.car", []byte("car")); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := kv.Get("fhirhose.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Value) != "user" || entry.Revision != revision {
+		t.Fatalf("expected the value and revision of the key, got %q revision %d", entry.Value, entry.Revision)
+	}
+
+	updated, err := kv.Update("fhirhose.user", []byte("updated"), revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Update("fhirhose.user", []byte("stale"), revision); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected update of a stale revision to fail: %v", err)
+	}
+	if _, err := kv.Create("fhirhose.user", []byte("created")); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("expected create of an existing key to fail: %v", err)
+	}
+	if entry, err := kv.Get("fhirhose.user"); err != nil || string(entry.Value) != "updated" || entry.Revision != updated {
+		t.Fatalf("expected the updated value, got %v %v", entry, err)
+	}
+	if entry, err := kv.Get("fhirhose.car"); err != nil || string(entry.Value) != "car" {
+		t.Fatalf("expected keys not to overwrite each other, got %v %v", entry, err)
+	}
+
+	if err := kv.Delete("fhirhose.user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("fhirhose.user"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected deleted key not to be found: %v", err)
+	}
+	if _, err := kv.Create("fhirhose.user", []byte("recreated")); err != nil {
+		t.Fatalf("expected deleted key to be created again: %v", err)
+	}
+
+	if _, err := kv.Get("fhirhose.*"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected wildcard key to be invalid: %v", err)
+	}
+}
+
+func TestKeyValueConcurrentCreate(t *testing.T) {
+	conn := startJetStream(t)
+	kv, err := NewKeyValue(conn, "leases", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := kv.Create("fhirhose.user", []byte(fmt.Sprint(i)))
+			if err == nil {
+				atomic.AddInt32(&created, 1)
+			} else if !errors.Is(err, ErrRevisionMismatch) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("expected a single create to win, %d created", created)
+	}
+}
+
+func TestKeyValueTTL(t *testing.T) {
+	conn := startJetStream(t)
+	kv, err := NewKeyValue(conn, "leases", time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.Create("fhirhose.user", []byte("holder")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 500)
+	if _, err := kv.Get("fhirhose.user"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the value to expire: %v", err)
+	}
+	if _, err := kv.Create("fhirhose.user", []byte("next holder")); err != nil {
+		t.Fatalf("expected expired key to be created again: %v", err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	conn := startJetStream(t)
+	log, err := NewLog(conn, "status", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLog(conn, "status", 0); err != nil {
+		t.Fatalf("expected an existing log to be loaded: %v", err)
+	}
+
+	read := func(subject string) []string {
+		var values []string
+		err := log.Read(subject, func(data []byte) error {
+			values = append(values, string(data))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+
+	if values := read("user.1"); len(values) != 0 {
+		t.Fatalf("expected no messages of an unknown subject, got %v", values)
+	}
+	for _, value := range []string{"polled", "retrieved", "uploaded"} {
+		if err := log.Append("user.1", []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Append("user.2", []byte("polled")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends aren't acknowledged, wait until the server stored them
+	deadline := time.Now().Add(time.Second)
+	for len(read("user.2")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if values := read("user.1"); strings.Join(values, ",") != "polled,retrieved,uploaded" {
+		t.Fatalf("expected the messages of the subject in order, got %v", values)
+	}
+	if values := read("user.2"); strings.Join(values, ",") != "polled" {
+		t.Fatalf("expected only the messages of the subject, got %v", values)
+	}
+}
@@ -0,0 +1,345 @@
+// Package pubsubtest is a conformance suite for pubsub.IPubSubClient implementations
+package pubsubtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// Subjects subjects the stream of a backend under test must contain
+	Subjects = "conformance.>"
+	// timeout maximum wait for an expected delivery
+	timeout = time.Second * 10
+	// quiet wait in which no unexpected delivery may arrive
+	quiet = time.Millisecond * 300
+	// ackWait ack wait of consumers which aren't expected to redeliver
+	ackWait = time.Second * 30
+	// shortAckWait ack wait of consumers which are expected to redeliver
+	shortAckWait = time.Millisecond * 300
+)
+
+// Backend backend under test of the conformance suite
+type Backend struct {
+	// Client client connected to the backend
+	Client pubsub.IPubSubClient
+	// Stream stream containing the Subjects
+	Stream string
+	// AddConsumer creates a durable consumer which redelivers unacknowledged messages after the ack wait
+	AddConsumer func(name, filter string, ackWait time.Duration) error
+	// Restart restarts the backend and returns the client to use afterwards
+	// clients of a server should reconnect and return themselves, embedded backends may return a reopened client
+	// Default nil skips the reconnect test
+	Restart func() (pubsub.IPubSubClient, error)
+}
+
+// RunConformance runs the conformance suite, newBackend is called for every test and returns a fresh backend
+func RunConformance(t *testing.T, newBackend func(t *testing.T) Backend) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, backend Backend)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"Filtering", testFiltering},
+		{"Redelivery", testRedelivery},
+		{"Ordering", testOrdering},
+		{"ConcurrentConsumers", testConcurrentConsumers},
+		{"Reconnect", testReconnect},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newBackend(t))
+		})
+	}
+}
+
+// testRoundTrip publishes messages and expects them to be consumed with subject, header and data
+func testRoundTrip(t *testing.T, backend Backend) {
+	addConsumer(t, backend, "roundtrip", "conformance.roundtrip.>", ackWait)
+
+	msg := nats.NewMsg("conformance.roundtrip.1")
+	msg.Header.Set("Fhirhose-Identifier", "1")
+	msg.Data = []byte("message")
+	if err := backend.Client.PublishMsg(msg); err != nil {
+		t.Fatalf("publishing message failed: %v", err)
+	}
+	if err := backend.Client.Publish("conformance.roundtrip.2", []byte("data")); err != nil {
+		t.Fatalf("publishing data failed: %v", err)
+	}
+	waitForPending(t, backend, "roundtrip", 2)
+
+	received := consume(t, backend.Client, "roundtrip", backend.Stream, nil)
+	first := receive(t, received)
+	if first.Subject != msg.Subject || string(first.Data) != "message" || first.Header.Get("Fhirhose-Identifier") != "1" {
+		t.Fatalf("expected the published message, got %s %q with header %v", first.Subject, first.Data, first.Header)
+	}
+	second := receive(t, received)
+	if second.Subject != "conformance.roundtrip.2" || string(second.Data) != "data" {
+		t.Fatalf("expected the published data, got %s %q", second.Subject, second.Data)
+	}
+	waitForPending(t, backend, "roundtrip", 0)
+}
+
+// testFiltering expects consumers to receive only the subjects matching their filter
+func testFiltering(t *testing.T, backend Backend) {
+	addConsumer(t, backend, "filter-a", "conformance.filter.a.>", ackWait)
+	addConsumer(t, backend, "filter-b", "conformance.filter.b.*", ackWait)
+
+	for _, subject := range []string{"conformance.filter.a.1", "conformance.filter.b.1", "conformance.filter.c.1", "conformance.filter.b.1.2", "conformance.filter.a.2.3"} {
+		publish(t, backend.Client, subject, nil)
+	}
+
+	receivedA := consume(t, backend.Client, "filter-a", backend.Stream, nil)
+	receivedB := consume(t, backend.Client, "filter-b", backend.Stream, nil)
+	expectSubjects(t, receivedA, "conformance.filter.a.1", "conformance.filter.a.2.3")
+	expectSubjects(t, receivedB, "conformance.filter.b.1")
+	expectNone(t, receivedA)
+	expectNone(t, receivedB)
+}
+
+// testRedelivery expects negatively acknowledged and unacknowledged messages to be redelivered
+func testRedelivery(t *testing.T, backend Backend) {
+	addConsumer(t, backend, "redelivery", "conformance.redelivery.>", shortAckWait)
+	publish(t, backend.Client, "conformance.redelivery.1", []byte("message"))
+
+	var mu sync.Mutex
+	deliveries := 0
+	received := consume(t, backend.Client, "redelivery", backend.Stream, func(msg *nats.Msg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries++
+		switch deliveries {
+		case 1:
+			return pubsub.Nak(backend.Client, msg)
+		case 2:
+			// Missed ack, redelivered after the ack wait
+			return nil
+		default:
+			return pubsub.Ack(backend.Client, msg)
+		}
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		msg := receive(t, received)
+		if msg.Subject != "conformance.redelivery.1" || string(msg.Data) != "message" {
+			t.Fatalf("expected redelivery of the message, got %s %q", msg.Subject, msg.Data)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < shortAckWait {
+		t.Fatalf("expected the missed ack to be redelivered after the ack wait, redelivered after %s", elapsed)
+	}
+	expectNone(t, received)
+	waitForPending(t, backend, "redelivery", 0)
+}
+
+// testOrdering expects messages of a subject to be consumed in publish order
+func testOrdering(t *testing.T, backend Backend) {
+	addConsumer(t, backend, "ordering", "conformance.ordering.>", ackWait)
+
+	const amount = 20
+	for i := 0; i < amount; i++ {
+		publish(t, backend.Client, fmt.Sprintf("conformance.ordering.%d", i%2), []byte(fmt.Sprint(i)))
+	}
+
+	received := consume(t, backend.Client, "ordering", backend.Stream, nil)
+	last := map[string]int{}
+	for i := 0; i < amount; i++ {
+		msg := receive(t, received)
+		var index int
+		if _, err := fmt.Sscan(string(msg.Data), &index); err != nil {
+			t.Fatalf("unexpected message %q", msg.Data)
+		}
+		if previous, ok := last[msg.Subject]; ok && index < previous {
+			t.Fatalf("expected %s in order, got %d after %d", msg.Subject, index, previous)
+		}
+		last[msg.Subject] = index
+	}
+}
+
+// testConcurrentConsumers expects consumers sharing a durable to receive every message exactly once
+func testConcurrentConsumers(t *testing.T, backend Backend) {
+	addConsumer(t, backend, "concurrent", "conformance.concurrent.>", ackWait)
+
+	const amount = 50
+	for i := 0; i < amount; i++ {
+		publish(t, backend.Client, fmt.Sprintf("conformance.concurrent.%d", i), nil)
+	}
+
+	received := make(chan *nats.Msg, amount*2)
+	for i := 0; i < 3; i++ {
+		go forward(consume(t, backend.Client, "concurrent", backend.Stream, nil), received)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < amount; i++ {
+		msg := receive(t, received)
+		if seen[msg.Subject] {
+			t.Fatalf("expected %s to be delivered once", msg.Subject)
+		}
+		seen[msg.Subject] = true
+	}
+	expectNone(t, received)
+}
+
+// testReconnect expects stream and consumer to survive a restart of the backend and the client to continue
+func testReconnect(t *testing.T, backend Backend) {
+	if backend.Restart == nil {
+		t.Skip("backend can't be restarted")
+	}
+	addConsumer(t, backend, "reconnect", "conformance.reconnect.>", ackWait)
+
+	publish(t, backend.Client, "conformance.reconnect.1", nil)
+	received := consume(t, backend.Client, "reconnect", backend.Stream, nil)
+	expectSubjects(t, received, "conformance.reconnect.1")
+
+	client, err := backend.Restart()
+	if err != nil {
+		t.Fatalf("restarting backend failed: %v", err)
+	}
+	if client != backend.Client {
+		// The consumer of a reopened client stopped with the previous client
+		received = consume(t, client, "reconnect", backend.Stream, nil)
+	}
+
+	// Publishing fails until the client reconnected
+	deadline := time.Now().Add(timeout)
+	for {
+		err := client.PublishMsg(nats.NewMsg("conformance.reconnect.2"))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the client to reconnect: %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	expectSubjects(t, received, "conformance.reconnect.2")
+	expectNone(t, received)
+}
+
+// addConsumer adds the consumer to the backend
+func addConsumer(t *testing.T, backend Backend, name, filter string, ackWait time.Duration) {
+	t.Helper()
+	if err := backend.AddConsumer(name, filter, ackWait); err != nil {
+		t.Fatalf("adding consumer %s failed: %v", name, err)
+	}
+}
+
+// publish publishes the message and waits for the acknowledgement of the backend
+func publish(t *testing.T, client pubsub.IPubSubClient, subject string, data []byte) {
+	t.Helper()
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if err := client.PublishMsg(msg); err != nil {
+		t.Fatalf("publishing %s failed: %v", subject, err)
+	}
+}
+
+// consume consumes the consumer until the test completes and restarts it when it fails
+// handle decides on the acknowledgement of a delivery, default nil acknowledges every delivery
+func consume(t *testing.T, client pubsub.IPubSubClient, consumer, stream string, handle func(msg *nats.Msg) error) <-chan *nats.Msg {
+	if handle == nil {
+		handle = func(msg *nats.Msg) error { return pubsub.Ack(client, msg) }
+	}
+
+	received := make(chan *nats.Msg, 100)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		for {
+			err := client.Consume(consumer, stream, func(msg *nats.Msg) {
+				// Deliveries after the test completed are left to the backend
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := handle(msg); err != nil {
+					return
+				}
+				select {
+				case received <- msg:
+				case <-done:
+				}
+			})
+			if err == nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 50):
+			}
+		}
+	}()
+	return received
+}
+
+// forward forwards the deliveries of a consumer until the test completes
+func forward(from <-chan *nats.Msg, to chan<- *nats.Msg) {
+	for {
+		select {
+		case msg := <-from:
+			to <- msg
+		case <-time.After(timeout):
+			return
+		}
+	}
+}
+
+// receive waits for the next delivery
+func receive(t *testing.T, received <-chan *nats.Msg) *nats.Msg {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(timeout):
+		t.Fatal("expected a delivery")
+		return nil
+	}
+}
+
+// expectSubjects expects deliveries of the subjects in order
+func expectSubjects(t *testing.T, received <-chan *nats.Msg, subjects ...string) {
+	t.Helper()
+	for _, subject := range subjects {
+		if msg := receive(t, received); msg.Subject != subject {
+			t.Fatalf("expected %s, got %s", subject, msg.Subject)
+		}
+	}
+}
+
+// expectNone expects no further delivery
+func expectNone(t *testing.T, received <-chan *nats.Msg) {
+	t.Helper()
+	select {
+	case msg := <-received:
+		t.Fatalf("expected no further delivery, got %s", msg.Subject)
+	case <-time.After(quiet):
+	}
+}
+
+// waitForPending waits until the consumer has the amount of pending messages
+func waitForPending(t *testing.T, backend Backend, consumer string, amount uint64) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		pending, err := backend.Client.Pending(consumer, backend.Stream)
+		if err == nil && pending == amount {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending messages of %s, got %d: %v", amount, consumer, pending, err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
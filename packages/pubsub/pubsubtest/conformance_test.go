@@ -0,0 +1,103 @@
+package pubsubtest
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// startServer starts an embedded nats server with JetStream enabled
+func startServer(t *testing.T, opts server.Options) *server.Server {
+	opts.Host = "127.0.0.1"
+	opts.JetStream = true
+	opts.NoLog = true
+	opts.NoSigs = true
+	s, err := server.NewServer(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(time.Second * 5) {
+		t.Fatal("embedded nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestNatsClientConformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Backend {
+		opts := server.Options{Port: -1, StoreDir: t.TempDir()}
+		s := startServer(t, opts)
+		opts.Port = s.Addr().(*net.TCPAddr).Port
+
+		client, err := pubsub.NewClient(s.ClientURL(), nats.MaxReconnects(-1), nats.ReconnectWait(time.Millisecond*50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+
+		manager, err := jsm.New(client.Conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := manager.NewStream("conformance", jsm.Subjects(Subjects), jsm.FileStorage())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return Backend{
+			Client: client,
+			Stream: "conformance",
+			AddConsumer: func(name, filter string, ackWait time.Duration) error {
+				_, err := stream.NewConsumer(jsm.DurableName(name), jsm.FilterStreamBySubject(filter), jsm.AckWait(ackWait), jsm.AcknowledgeExplicit(), jsm.DeliverAllAvailable())
+				return err
+			},
+			Restart: func() (pubsub.IPubSubClient, error) {
+				s.Shutdown()
+				s.WaitForShutdown()
+				s = startServer(t, opts)
+				return client, nil
+			},
+		}
+	})
+}
+
+func TestBoltClientConformance(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Backend {
+		path := filepath.Join(t.TempDir(), "fhirhose.db")
+		client, err := pubsub.NewBoltClient(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Stream = "conformance"
+		t.Cleanup(func() { _ = client.Close() })
+
+		return Backend{
+			Client: client,
+			Stream: "conformance",
+			AddConsumer: func(name, filter string, ackWait time.Duration) error {
+				client.AckWait = ackWait
+				return client.AddConsumer(name, filter)
+			},
+			Restart: func() (pubsub.IPubSubClient, error) {
+				if err := client.Close(); err != nil {
+					return nil, err
+				}
+				reopened, err := pubsub.NewBoltClient(path)
+				if err != nil {
+					return nil, err
+				}
+				reopened.Stream = "conformance"
+				t.Cleanup(func() { _ = reopened.Close() })
+				return reopened, nil
+			},
+		}
+	})
+}
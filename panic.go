@@ -0,0 +1,103 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrPanic err wrapped by every recovered panic
+var ErrPanic = errors.New("panic recovered")
+
+// settlements settlement of the consumed messages handled by a recovered callback by message
+var settlements sync.Map
+
+// settlement tracks if the consumed message has been acknowledged, negatively acknowledged or handed over
+type settlement struct {
+	settled int32
+}
+
+// PanicError error of a recovered panic containing the panic value and the stack of the panicking goroutine
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error returns the panic value
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPanic, p.Value)
+}
+
+// Unwrap returns ErrPanic so panics can be checked with errors.Is
+func (p *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// recovered runs the function and returns a recovered panic as PanicError
+func recovered(run func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return run()
+}
+
+// reportPanic logs and counts the recovered panic when the error is one
+func reportPanic(conf Config, stream StreamName, action ActionName, err error) {
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		return
+	}
+
+	conf.logger().WithFields(Fields{
+		"resource": stream,
+		"action":   action,
+		"stack":    string(panicErr.Stack),
+	}).WithError(err).Error("recovered panic")
+	count(conf, stream, action, "panics", 1)
+}
+
+// recoverCallback recovers panics of the consumer callback so they don't stop the process
+// the panic is escalated to the error channel and the message is dead lettered as permanent failure
+// messages the callback settled before the panic aren't settled again
+func recoverCallback(conf Config, stream StreamName, action ActionName, errChan *chan Error, callback func(msg *nats.Msg)) func(msg *nats.Msg) {
+	return func(msg *nats.Msg) {
+		tracked := &settlement{}
+		settlements.Store(msg, tracked)
+		defer settlements.Delete(msg)
+
+		err := recovered(func() error {
+			callback(msg)
+			return nil
+		})
+		if err == nil {
+			return
+		}
+
+		reportPanic(conf, stream, action, err)
+		if atomic.LoadInt32(&tracked.settled) == 0 {
+			settleFailure(conf, stream, action, msg, nil, err, errChan)
+			return
+		}
+		if errChan != nil {
+			*errChan <- Error{
+				Event:         stream,
+				Action:        action,
+				StreamMessage: nil,
+				Err:           err,
+			}
+		}
+	}
+}
+
+// markSettled marks the consumed message as settled when it is handled by a recovered callback
+func markSettled(msg *nats.Msg) {
+	if tracked, ok := settlements.Load(msg); ok {
+		atomic.StoreInt32(&tracked.(*settlement).settled, 1)
+	}
+}
@@ -1,81 +1,219 @@
 package fhirhose
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/lumc/fhirhose/packages/pubsub"
 )
 
 // Pollers runs all polls for the registered streams based on an time interval
+// when a lease store is configured only the elected instance polls a stream
 func (c *Register) Pollers(conf Config, streams []IStream, errChan *chan Error) {
 	for _, stream := range streams {
 		go func(stream IStream) {
-			pollOnInterval(conf, stream, errChan)
+			if conf.LeaseStore != nil {
+				leadStream(conf, stream, errChan)
+				return
+			}
+			pollOnInterval(conf.control.context(), conf, stream, errChan)
 		}(stream)
 	}
 }
 
-// pollOnInterval runs a poller for a stream
-func pollOnInterval(conf Config, stream IStream, errChan *chan Error) {
-	ticker := time.NewTicker(conf.PollInterval)
-	done := make(chan bool)
-
-	logrus.WithFields(logrus.Fields{
-		"resource": stream.GetStreamName(),
-	}).Infof("starting poll in %v", conf.PollInterval)
+// pollOnInterval runs a poller for a stream based on the schedule of the stream until the context is done
+// a running poll is cancelled with the context
+func pollOnInterval(ctx context.Context, conf Config, stream IStream, errChan *chan Error) {
+	clock := conf.getClock()
+	schedule := conf.getSchedule(stream.GetStreamName())
+	conf.logger().WithField("resource", stream.GetStreamName()).Info("starting poll")
 
+	wait, scheduled := schedulePoll(conf, stream.GetStreamName(), clock, schedule.First)
 	for {
 		select {
-		case <-done:
+		case <-conf.control.context().Done():
+			conf.logger().WithField("resource", stream.GetStreamName()).Info("stopping poll on shutdown")
 			return
-		case <-ticker.C:
-			messages, customLoad, err := stream.Poll()
-			if err != nil {
-				if errChan != nil {
-					*errChan <- Error{
-						Event:         stream.GetStreamName(),
-						Action:        PollAction,
-						StreamMessage: nil,
-						Error:         err,
-					}
-				}
+		case <-ctx.Done():
+			conf.logger().WithField("resource", stream.GetStreamName()).Info("stopping poll")
+			return
+		case <-wait:
+			if !scheduled {
+				wait, scheduled = schedulePoll(conf, stream.GetStreamName(), clock, schedule.First)
+				continue
 			}
+			pollRecovered(ctx, conf, stream, errChan)
+			wait, scheduled = schedulePoll(conf, stream.GetStreamName(), clock, schedule.Next)
+		case <-conf.control.triggered(stream.GetStreamName()):
+			conf.logger().WithField("resource", stream.GetStreamName()).Info("triggered poll")
+			pollRecovered(ctx, conf, stream, errChan)
+		}
+	}
+}
+
+// schedulePoll returns the wait for the next poll time, a failed search is retried after the schedule retry interval
+// so the poll loop keeps running, scheduled is false while waiting for the retry
+func schedulePoll(conf Config, stream StreamName, clock IClock, next func(time.Time) (time.Time, error)) (wait <-chan time.Time, scheduled bool) {
+	at, err := next(clock.Now())
+	if err != nil {
+		conf.logger().WithField("resource", stream).WithError(err).Error("can't schedule poll, retrying")
+		return clock.After(scheduleRetryInterval), false
+	}
+	conf.logger().WithFields(Fields{"resource": stream, "next": at}).Debug("scheduled poll")
+	return clock.After(at.Sub(clock.Now())), true
+}
+
+// pollRecovered polls unless paused and recovers panics so the poll loop keeps running
+func pollRecovered(ctx context.Context, conf Config, stream IStream, errChan *chan Error) {
+	err := recovered(func() error {
+		pollUnlessPaused(ctx, conf, stream, errChan)
+		return nil
+	})
+	if err == nil {
+		return
+	}
+
+	reportPanic(conf, stream.GetStreamName(), PollAction, err)
+	if errChan != nil {
+		*errChan <- Error{
+			Event:         stream.GetStreamName(),
+			Action:        PollAction,
+			StreamMessage: nil,
+			Err:           err,
+		}
+	}
+}
+
+// pollUnlessPaused runs a single poll when polling of the stream isn't paused or held back by backpressure
+func pollUnlessPaused(ctx context.Context, conf Config, stream IStream, errChan *chan Error) {
+	if conf.control.isPaused(stream.GetStreamName(), PollAction) {
+		conf.logger().WithField("resource", stream.GetStreamName()).Debug("skipping paused poll")
+		return
+	}
+	if !checkBackpressure(conf, stream) {
+		return
+	}
+	poll(ctx, conf, stream, errChan)
+}
+
+// poll runs a single poll for a stream and publishes the polled messages
+// the poll and the publishing of its messages stop when the context is cancelled
+func poll(ctx context.Context, conf Config, stream IStream, errChan *chan Error) {
+	// The source isn't polled while its circuit is open
+	pollCircuit := getCircuit(conf, stream, PollAction)
+	if !allowCircuit(conf, stream.GetStreamName(), PollAction, pollCircuit, errChan) {
+		conf.logger().WithField("resource", stream.GetStreamName()).Info("skipping poll while circuit breaker is open")
+		count(conf, stream.GetStreamName(), PollAction, "circuit_skipped", 1)
+		return
+	}
 
-			if conf.DeduplicationEnabled {
-				messages = deduplicateIdentifiers(messages)
+	var messages []StreamMessage
+	var customLoad bool
+	err := runStageContext(ctx, conf, stream.GetStreamName(), PollAction, nil, func(ctx context.Context) (err error) {
+		messages, customLoad, err = WithContext(stream).PollContext(ctx)
+		return err
+	})
+	recordCircuit(conf, stream.GetStreamName(), PollAction, pollCircuit, err, errChan)
+	if errors.Is(err, ErrShutdown) || errors.Is(err, ErrCancelled) {
+		conf.logger().WithField("resource", stream.GetStreamName()).WithError(err).Info("poll cancelled")
+		return
+	}
+	if err != nil {
+		if errChan != nil {
+			*errChan <- Error{
+				Event:         stream.GetStreamName(),
+				Action:        PollAction,
+				StreamMessage: nil,
+				Err:           err,
 			}
+		}
+	}
 
-			logrus.WithFields(logrus.Fields{
-				"resource": stream.GetStreamName(),
-				"changes":  len(messages),
-			}).Info("polled")
-
-			for _, message := range messages {
-				logrus.WithFields(logrus.Fields{
-					"id":   message.Identifier,
-					"desc": message.Description,
-					"time": time.Now(),
-				}).Info("polled item")
-
-				messageBytes, err := json.Marshal(&message)
-				if err != nil {
-					logrus.WithError(err).Error("can't marshal message bytes")
-				}
+	if conf.DeduplicationEnabled {
+		messages = deduplicateIdentifiers(messages)
+	}
+	conf.control.polled(stream.GetStreamName(), len(messages))
 
-				prefix := DefaultConsumerPrefix
-				if customLoad {
-					prefix = DefaultConsumerCustomLoadPrefix
-				}
+	conf.logger().WithFields(Fields{
+		"resource": stream.GetStreamName(),
+		"changes":  len(messages),
+	}).Info("polled")
 
-				actionString := GetPublishAction(message.Identifier, stream.GetStreamName(), prefix, PollAction)
-				if err := conf.PubSub.Publish(actionString, messageBytes); err != nil {
-					logrus.WithError(err).Error("can't publish new event")
+	publisher := newPollPublisher(conf, stream.GetStreamName())
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			// The next poll of the new leader or after the restart polls the remaining changes again
+			conf.logger().WithField("resource", stream.GetStreamName()).Info("publishing polled items cancelled")
+			return
+		}
+		if err := ValidateIdentifier(message.Identifier); err != nil {
+			conf.logger().WithError(err).Error("skipping polled item")
+			if errChan != nil {
+				invalidMessage := message
+				*errChan <- Error{
+					Event:         stream.GetStreamName(),
+					Action:        PollAction,
+					StreamMessage: &invalidMessage,
+					Err:           err,
 				}
-				if conf.ThrottleAmount != nil {
-					time.Sleep(time.Second / time.Duration(*conf.ThrottleAmount))
+			}
+			continue
+		}
+
+		var messageID string
+		if conf.DeduplicationEnabled {
+			messageID = GetMessageID(stream.GetStreamName(), message)
+			// Custom loads are explicitly requested and are never skipped
+			if !customLoad && conf.DeduplicationCache != nil && conf.DeduplicationCache.Exists(messageID) {
+				conf.logger().WithFields(Fields{
+					"id":        message.Identifier,
+					"messageId": messageID,
+				}).Debug("skipping duplicate polled item")
+				continue
+			}
+		}
+
+		conf.logger().WithFields(Fields{
+			"id":   message.Identifier,
+			"desc": message.Description,
+			"time": time.Now(),
+		}).Info("polled item")
+
+		prefix := conf.GetConsumerPrefix()
+		if customLoad {
+			prefix = conf.GetCustomLoadPrefix()
+		}
+
+		actionString := GetPublishAction(message.Identifier, stream.GetStreamName(), prefix, PollAction)
+		msg, err := newStreamMsg(conf, stream.GetStreamName(), actionString, message)
+		if err != nil {
+			conf.logger().WithError(err).Error("can't create message")
+			if errChan != nil {
+				failedMessage := message
+				*errChan <- Error{
+					Event:         stream.GetStreamName(),
+					Action:        PollAction,
+					StreamMessage: &failedMessage,
+					Err:           err,
 				}
 			}
+			continue
+		}
+		if messageID != "" {
+			msg.Header.Set(pubsub.MsgIDHeader, messageID)
+		}
+		if err := publisher.publishOrSpool(msg); err != nil {
+			conf.logger().WithError(err).Error("can't publish new event")
+			recordFailed(conf, stream.GetStreamName(), PollAction, message.Identifier, "", err)
+		} else {
+			if messageID != "" && conf.DeduplicationCache != nil {
+				conf.DeduplicationCache.Add(messageID)
+			}
+			recordSucceeded(conf, stream.GetStreamName(), PollAction, message.Identifier, "")
+		}
+		if conf.ThrottleAmount != nil {
+			time.Sleep(time.Second / time.Duration(*conf.ThrottleAmount))
 		}
 	}
 }
@@ -1,72 +1,79 @@
 package fhirhose
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
-	"github.com/sirupsen/logrus"
 )
 
 // Retrievers creates a retrieve subscriber for each stream
 func (c *Register) Retrievers(conf Config, streams []IStream, errChan *chan Error) {
 	for _, stream := range streams {
-		go handleRetrieve(DefaultConsumerPrefix, stream, conf, errChan)
-		go handleRetrieve(DefaultConsumerCustomLoadPrefix, stream, conf, errChan)
+		go handleRetrieve(conf.GetConsumerPrefix(), stream, conf, errChan)
+		go handleRetrieve(conf.GetCustomLoadPrefix(), stream, conf, errChan)
 	}
 }
 
 // handleRetrieve handles the retrieve action
 func handleRetrieve(prefix ConsumerPrefix, stream IStream, conf Config, errChan *chan Error) {
-	// Consume from polled consumer or given resource
-	consumerString := GetConsumeAction(stream.GetStreamName(), prefix, PollAction)
-	logrus.WithFields(logrus.Fields{"consumer": consumerString}).Info("register consumer")
-	err := conf.PubSub.Consume(consumerString, string(DefaultStreamName), func(msg *nats.Msg) {
+	// Consume from polled or debounced consumer or given resource
+	consumerString := conf.GetConsumerName(stream.GetStreamName(), prefix, getRetrieveSourceAction(conf, prefix))
+	contextStream := WithContext(stream)
+	stageCircuit := getCircuit(conf, stream, RetrieveAction)
+	consume(conf, stream.GetStreamName(), RetrieveAction, consumerString, errChan, func(msg *nats.Msg) {
+		conf.control.waitWhilePaused(stream.GetStreamName(), RetrieveAction, conf.PubSub, msg)
+		if redeliverOnShutdown(conf, msg) {
+			return
+		}
+
 		// Retrieve message
-		var message StreamMessage
-		id := GetIdentifierFromActionString(msg.Subject)
-		err := json.Unmarshal(msg.Data, &message)
+		message, claimCheck, err := unmarshalMessage(conf, msg.Data)
 		if err != nil {
-			logrus.WithError(err).Error("can't unmarshal message")
+			// Key provider and claim check store failures are redelivered, unreadable messages dead lettered
+			settleFailure(conf, stream.GetStreamName(), RetrieveAction, msg, &message, err, errChan)
+			return
 		}
+		id := GetIdentifier(msg, message)
 
-		updatedMessage, funcErr := stream.Retrieve(message)
-		if funcErr != nil && errChan != nil {
-			*errChan <- Error{
-				Event:         stream.GetStreamName(),
-				Action:        RetrieveAction,
-				StreamMessage: &updatedMessage,
-				Error:         funcErr,
-			}
+		if !waitForCircuit(conf, stream.GetStreamName(), RetrieveAction, stageCircuit, msg, errChan) {
+			redeliverOnShutdown(conf, msg)
+			return
 		}
-
-		// Acknowledge message received event
-		err = msg.Respond(nil)
-		if err != nil {
-			logrus.WithError(err).Error("can't acknowledge message")
+		var updatedMessage StreamMessage
+		funcErr := runStage(conf, stream.GetStreamName(), RetrieveAction, msg, func(ctx context.Context) (err error) {
+			updatedMessage, err = contextStream.RetrieveContext(ctx, message)
+			return err
+		})
+		recordCircuit(conf, stream.GetStreamName(), RetrieveAction, stageCircuit, funcErr, errChan)
+		if errors.Is(funcErr, ErrShutdown) && redeliverOnShutdown(conf, msg) {
+			// Redelivered message still needs its data
+			return
 		}
-
-		if funcErr == nil {
-			logrus.WithFields(logrus.Fields{
+		if funcErr != nil {
+			if !settleFailure(conf, stream.GetStreamName(), RetrieveAction, msg, &updatedMessage, funcErr, errChan) {
+				// Redelivered or dead lettered message still needs its data
+				return
+			}
+		} else {
+			conf.logger().WithFields(Fields{
 				"id":   id,
 				"desc": updatedMessage.Description,
 				"time": time.Now(),
 			}).Info("retrieved item")
 
-			// Create message bytes
-			messageBytes, err := json.Marshal(&updatedMessage)
-			if err != nil {
-				logrus.WithError(err).Error("can't marshal message bytes")
+			// Publish and acknowledge once the publish is confirmed
+			if !forward(conf, msg, stream.GetStreamName(), RetrieveAction, message.Identifier, updatedMessage, errChan) {
+				// Redelivered message still needs its data
+				return
 			}
+			recordSucceeded(conf, stream.GetStreamName(), RetrieveAction, id, "")
+		}
 
-			// Publish
-			actionString := GetPublishAction(message.Identifier, stream.GetStreamName(), DefaultConsumerPrefix, RetrieveAction)
-			if err := conf.PubSub.Publish(actionString, messageBytes); err != nil {
-				logrus.WithError(err).Error("can't publish new event")
-			}
+		// Data of the consumed message is no longer needed
+		if err := releaseClaimCheck(conf, claimCheck); err != nil {
+			conf.logger().WithError(err).Error("can't release claim check")
 		}
 	})
-	if err != nil {
-		logrus.WithField("consumer", consumerString).WithError(err).Error("can't consume from consumer")
-	}
 }
@@ -0,0 +1,373 @@
+package fhirhose
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxScheduleIterations maximum amount of steps searching for the next poll time
+	maxScheduleIterations = 100000
+	// scheduleRetryInterval time after which a failed search for the next poll time is retried
+	scheduleRetryInterval = time.Minute
+)
+
+// IClock interface containing time functions, used to inject a clock in tests
+type IClock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock clock using the time package
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// TimeWindow time of day window in which polling is allowed, e.g. Start "20:00" End "06:00"
+// windows ending before they start cross midnight
+type TimeWindow struct {
+	Start string
+	End   string
+}
+
+// Schedule poll schedule of a stream
+type Schedule struct {
+	// Interval fixed interval between polls
+	// Default Config.PollInterval
+	Interval time.Duration
+	// Cron standard five field cron expression (minute hour day-of-month month day-of-week)
+	// overrides the interval when set
+	Cron string
+	// Immediate polls at startup instead of waiting for the first scheduled time
+	Immediate bool
+	// Jitter random delay up to the jitter added to every scheduled poll
+	Jitter time.Duration
+	// Windows time of day windows in which polling is allowed, default always
+	Windows []TimeWindow
+	// Location time zone of the cron expression and windows
+	// Default time.Local
+	Location *time.Location
+}
+
+// cronSchedule parsed cron expression
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool
+}
+
+// parsedWindow time window in minutes since midnight
+type parsedWindow struct {
+	start, end int
+}
+
+// Validate validates the schedule, cron expressions must have a poll time within the windows
+func (s Schedule) Validate() error {
+	if s.Cron == "" && s.Interval <= 0 {
+		return fmt.Errorf("%w: schedule needs an interval or cron expression", ErrValidateStream)
+	}
+	windows, err := parseWindows(s.Windows)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrValidateStream, err)
+	}
+	if s.Cron == "" {
+		return nil
+	}
+
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrValidateStream, err)
+	}
+	if !cron.inWindows(windows) {
+		return fmt.Errorf("%w: cron %q has no poll time within the windows", ErrValidateStream, s.Cron)
+	}
+	// Days which never exist, e.g. the 31st of February
+	if _, err := cron.next(s.in(time.Now())); err != nil {
+		return fmt.Errorf("%w: cron %q has no poll time: %v", ErrValidateStream, s.Cron, err)
+	}
+	return nil
+}
+
+// First returns the time of the first poll after startup
+func (s Schedule) First(now time.Time) (time.Time, error) {
+	if s.Immediate {
+		windows, err := parseWindows(s.Windows)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if inWindows(windows, s.in(now)) {
+			return now, nil
+		}
+	}
+	return s.Next(now)
+}
+
+// Next returns the time of the next poll after the given time
+func (s Schedule) Next(after time.Time) (time.Time, error) {
+	windows, err := parseWindows(s.Windows)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	if s.Cron != "" {
+		cron, err := parseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next = s.in(after)
+		for i := 0; ; i++ {
+			if i == maxScheduleIterations {
+				return time.Time{}, fmt.Errorf("no poll time found for cron %q within windows", s.Cron)
+			}
+			next, err = cron.next(next)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if inWindows(windows, next) {
+				break
+			}
+		}
+	} else {
+		next = s.in(after.Add(s.Interval))
+		if !inWindows(windows, next) {
+			next = nextWindowStart(windows, next)
+		}
+	}
+
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next, nil
+}
+
+// in converts the time to the location of the schedule
+func (s Schedule) in(t time.Time) time.Time {
+	if s.Location != nil {
+		return t.In(s.Location)
+	}
+	return t.In(time.Local)
+}
+
+// getSchedule returns the schedule of the stream
+func (c Config) getSchedule(stream StreamName) Schedule {
+	schedule, found := c.Schedules[stream]
+	if !found {
+		schedule = Schedule{}
+	}
+	if schedule.Interval == 0 {
+		schedule.Interval = c.PollInterval
+	}
+	return schedule
+}
+
+// getClock returns the configured clock or the real clock
+func (c Config) getClock() IClock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return realClock{}
+}
+
+// parseWindows parses the time windows
+func parseWindows(windows []TimeWindow) ([]parsedWindow, error) {
+	parsed := make([]parsedWindow, 0, len(windows))
+	for _, window := range windows {
+		start, err := parseTimeOfDay(window.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(window.End)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("time window %s-%s is empty", window.Start, window.End)
+		}
+		parsed = append(parsed, parsedWindow{start: start, end: end})
+	}
+	return parsed, nil
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", value, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inWindows checks if the time is within one of the windows, no windows means always
+func inWindows(windows []parsedWindow, t time.Time) bool {
+	return minuteInWindows(windows, t.Hour()*60+t.Minute())
+}
+
+// minuteInWindows checks if the minute since midnight is within one of the windows, no windows means always
+func minuteInWindows(windows []parsedWindow, minute int) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, window := range windows {
+		if window.start <= window.end && minute >= window.start && minute < window.end {
+			return true
+		}
+		if window.start > window.end && (minute >= window.start || minute < window.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWindowStart returns the first window start after the time
+func nextWindowStart(windows []parsedWindow, t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	var next time.Time
+	for _, window := range windows {
+		start := midnight.Add(time.Duration(window.start) * time.Minute)
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// parseCron parses a five field cron expression
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q must have 5 fields", expression)
+	}
+
+	var err error
+	cron := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	if cron.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cron.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cron.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cron.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cron.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if cron.weekdays[7] {
+		cron.weekdays[0] = true
+	}
+	return cron, nil
+}
+
+// parseCronField parses a cron field with lists, ranges and steps
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid cron step in %q", field)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid cron range in %q", field)
+			}
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid cron range in %q", field)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cron value in %q", field)
+			}
+			start, end = value, value
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("cron value out of range in %q", field)
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// next returns the first matching minute after the time
+func (c *cronSchedule) next(after time.Time) (time.Time, error) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < maxScheduleIterations; i++ {
+		if !c.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("no matching cron time found after %v", after)
+}
+
+// inWindows checks if one of the times of day of the cron expression is within the windows
+func (c *cronSchedule) inWindows(windows []parsedWindow) bool {
+	for hour := range c.hours {
+		for minute := range c.minutes {
+			if minuteInWindows(windows, hour*60+minute) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dayMatches checks the day of month and day of week, when both are restricted either may match
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	day := c.days[t.Day()]
+	weekday := c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
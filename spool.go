@@ -0,0 +1,300 @@
+package fhirhose
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+// DefaultSpoolReplayInterval default interval in which spooled messages are replayed
+const DefaultSpoolReplayInterval = time.Second * 5
+
+// spoolExtension file extension of spooled messages
+const spoolExtension = ".json"
+
+// spoolFailedDir directory within the spool containing messages which can't be replayed
+const spoolFailedDir = "failed"
+
+// ISpool interface containing functions to buffer polled messages while NATS is unavailable
+type ISpool interface {
+	// Append adds the message to the end of the spool
+	Append(msg *nats.Msg) error
+	// Replay publishes the spooled messages in order and removes every published message
+	// messages failing with a permanent error are moved aside, replaying stops at any other failed publish
+	Replay(publish func(msg *nats.Msg) error) (int, error)
+	// Len returns the amount of spooled messages
+	Len() (int, error)
+}
+
+// spooledMsg nats message as written to the spool
+type spooledMsg struct {
+	Subject string
+	Header  http.Header
+	Data    []byte
+}
+
+// FileSpool spool which keeps every message as a numbered file in a directory
+// messages which can't be replayed are moved to the failed directory within the spool
+type FileSpool struct {
+	Dir  string
+	mu   sync.Mutex
+	next uint64
+	size int
+}
+
+// NewFileSpool creates a new file spool and the directory when it doesn't exist
+// messages spooled by a previous run are kept and replayed first
+func NewFileSpool(dir string) (*FileSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool directory failed: %w", err)
+	}
+
+	s := &FileSpool{Dir: dir}
+	sequences, err := s.sequences()
+	if err != nil {
+		return nil, err
+	}
+	if len(sequences) > 0 {
+		s.next = sequences[len(sequences)-1] + 1
+	}
+	s.size = len(sequences)
+	return s, nil
+}
+
+// Append writes the message to the next file of the spool
+func (s *FileSpool) Append(msg *nats.Msg) error {
+	data, err := json.Marshal(spooledMsg{Subject: msg.Subject, Header: http.Header(msg.Header), Data: msg.Data})
+	if err != nil {
+		return fmt.Errorf("marshalling spooled message failed: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Write and rename so a replay never reads a partially written message
+	path := s.path(s.next)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("spooling message failed: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("spooling message failed: %w", err)
+	}
+	s.next++
+	s.size++
+	return nil
+}
+
+// Replay publishes the spooled messages in order and removes every published message
+// unreadable messages and messages failing with a permanent error are moved to the failed directory
+func (s *FileSpool) Replay(publish func(msg *nats.Msg) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sequences, err := s.sequences()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, sequence := range sequences {
+		msg, err := s.read(sequence)
+		if err == nil {
+			err = publish(msg)
+			if err != nil && classify(err) != ErrPermanent {
+				return replayed, err
+			}
+		}
+		if err != nil {
+			if err := s.moveAside(sequence); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+
+		if err := os.Remove(s.path(sequence)); err != nil {
+			return replayed, fmt.Errorf("removing spooled message failed: %w", err)
+		}
+		s.size--
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Len returns the amount of spooled messages, messages moved to the failed directory aren't counted
+func (s *FileSpool) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, nil
+}
+
+// read reads the spooled message of the sequence
+func (s *FileSpool) read(sequence uint64) (*nats.Msg, error) {
+	data, err := ioutil.ReadFile(s.path(sequence))
+	if err != nil {
+		return nil, fmt.Errorf("reading spooled message failed: %w", err)
+	}
+	var spooled spooledMsg
+	if err := json.Unmarshal(data, &spooled); err != nil {
+		return nil, fmt.Errorf("reading spooled message failed: %w", err)
+	}
+
+	msg := nats.NewMsg(spooled.Subject)
+	msg.Data = spooled.Data
+	for key, values := range spooled.Header {
+		msg.Header[key] = values
+	}
+	return msg, nil
+}
+
+// moveAside moves the spooled message of the sequence to the failed directory so replaying continues
+func (s *FileSpool) moveAside(sequence uint64) error {
+	failedDir := filepath.Join(s.Dir, spoolFailedDir)
+	if err := os.MkdirAll(failedDir, 0700); err != nil {
+		return fmt.Errorf("moving failed spooled message failed: %w", err)
+	}
+	if err := os.Rename(s.path(sequence), filepath.Join(failedDir, filepath.Base(s.path(sequence)))); err != nil {
+		return fmt.Errorf("moving failed spooled message failed: %w", err)
+	}
+	s.size--
+	return nil
+}
+
+// sequences returns the sorted sequences of the spooled messages
+func (s *FileSpool) sequences() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool directory failed: %w", err)
+	}
+
+	var sequences []uint64
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), spoolExtension) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), spoolExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences, nil
+}
+
+// path returns the file path of the sequence, zero padded so files sort in order
+func (s *FileSpool) path(sequence uint64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%s", sequence, spoolExtension))
+}
+
+// pollPublisher publishes the messages of a single poll, see publishOrSpool
+type pollPublisher struct {
+	conf   Config
+	stream StreamName
+	// spooling is set once a publish failed with a retryable error, the remaining messages of the poll
+	// are spooled without waiting for the publish timeout of every message
+	spooling bool
+}
+
+// newPollPublisher creates the publisher of a poll of the stream
+func newPollPublisher(conf Config, stream StreamName) *pollPublisher {
+	return &pollPublisher{conf: conf, stream: stream}
+}
+
+// publishOrSpool publishes the polled message, the message is spooled when publishing fails with a retryable error
+// or earlier messages are still spooled, other errors are returned
+func (p *pollPublisher) publishOrSpool(msg *nats.Msg) error {
+	conf := p.conf
+	if conf.Spool == nil {
+		return conf.PubSub.PublishMsg(msg)
+	}
+
+	var err error
+	if !p.spooling {
+		// Keep the order, newer messages wait behind spooled messages
+		var spooled int
+		spooled, err = conf.Spool.Len()
+		if err != nil || spooled > 0 {
+			_, err = replaySpool(conf)
+		}
+		if err == nil {
+			err = conf.PubSub.PublishMsg(msg)
+			if err != nil && !pubsub.IsRetryable(err) {
+				return err
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		p.spooling = true
+		conf.logger().WithError(err).WithField("resource", p.stream).Warn("spooling remaining polled items")
+	}
+
+	count(conf, p.stream, PollAction, "spooled", 1)
+	return conf.Spool.Append(msg)
+}
+
+// replaySpool replays the spooled messages, counted by the stream of every message
+// messages failing with an error which isn't retryable are moved aside by the spool
+func replaySpool(conf Config) (int, error) {
+	replayed, err := conf.Spool.Replay(func(msg *nats.Msg) error {
+		stream := getSubjectStream(conf, msg.Subject)
+		err := conf.PubSub.PublishMsg(msg)
+		if err != nil && !pubsub.IsRetryable(err) {
+			conf.logger().WithError(err).WithField("resource", stream).Error("can't replay spooled item, moved aside")
+			count(conf, stream, PollAction, "spool_failed", 1)
+			return Permanent(err)
+		}
+		if err == nil {
+			count(conf, stream, PollAction, "replayed", 1)
+		}
+		return err
+	})
+	if replayed > 0 {
+		conf.logger().WithField("changes", replayed).Info("replayed spooled items")
+	}
+	return replayed, err
+}
+
+// getSubjectStream returns the stream of a subject created by GetPublishAction with the consumer or custom load prefix
+func getSubjectStream(conf Config, subject string) StreamName {
+	for _, prefix := range []ConsumerPrefix{conf.GetConsumerPrefix(), conf.GetCustomLoadPrefix()} {
+		if strings.HasPrefix(subject, string(prefix)+".") {
+			subject = strings.TrimPrefix(subject, string(prefix)+".")
+			break
+		}
+	}
+	return StreamName(strings.Split(subject, ".")[0])
+}
+
+// replaySpoolOnInterval replays the spooled messages every interval until shutdown
+func replaySpoolOnInterval(conf Config) {
+	interval := conf.SpoolReplayInterval
+	if interval <= 0 {
+		interval = DefaultSpoolReplayInterval
+	}
+
+	clock := conf.getClock()
+	for {
+		select {
+		case <-clock.After(interval):
+		case <-conf.control.context().Done():
+			return
+		}
+		if _, err := replaySpool(conf); err != nil {
+			conf.logger().WithError(err).Debug("can't replay spooled items")
+		}
+	}
+}
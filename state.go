@@ -0,0 +1,67 @@
+package fhirhose
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// IStateStore interface containing functions to keep state per stream and identifier
+type IStateStore interface {
+	Get(key string) (value []byte, found bool, err error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+}
+
+// MemoryStateStore in memory state store
+type MemoryStateStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+// NewMemoryStateStore creates a new in memory state store
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		values: make(map[string][]byte),
+	}
+}
+
+// Get returns the value for the key
+func (s *MemoryStateStore) Get(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, found := s.values[key]
+	return value, found, nil
+}
+
+// Put sets the value for the key
+func (s *MemoryStateStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = value
+	return nil
+}
+
+// Delete removes the key
+func (s *MemoryStateStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+	return nil
+}
+
+// GetStateKey create state key based on stream and identifier
+// the identifier is encoded so the key is a valid key of every state store, see EncodeIdentifier
+func GetStateKey(stream StreamName, identifier string) string {
+	return fmt.Sprintf("%s.%s", stream, EncodeIdentifier(identifier))
+}
+
+// getContentHash creates a hash of the message data
+func getContentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,240 @@
+package fhirhose
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DefaultStatusStream default JetStream stream containing the processing status records
+	DefaultStatusStream = "fhirhose_status"
+	// DefaultStatusTTL default time a status record is kept
+	DefaultStatusTTL = time.Hour * 24 * 30
+)
+
+// StageStatus last outcome of a stage for an identifier
+type StageStatus struct {
+	// LastSucceeded time the stage last succeeded
+	LastSucceeded *time.Time `json:"lastSucceeded,omitempty"`
+	// LastFailed time the stage last failed
+	LastFailed *time.Time `json:"lastFailed,omitempty"`
+	// Error error of the last failure
+	Error string `json:"error,omitempty"`
+	// LastFiltered time the stage last filtered the message
+	LastFiltered *time.Time `json:"lastFiltered,omitempty"`
+	// Reason reason of the last filter
+	Reason string `json:"reason,omitempty"`
+	// BatchID batch of the upload handler which handled the message last
+	BatchID string `json:"batchId,omitempty"`
+}
+
+// ProcessingStatus processing status of an identifier by stage, stages which never handled the identifier are left out
+type ProcessingStatus struct {
+	Stream     StreamName                 `json:"stream"`
+	Identifier string                     `json:"identifier"`
+	Stages     map[ActionName]StageStatus `json:"stages"`
+}
+
+// StatusOutcome outcome of a stage recorded in a StatusRecord
+type StatusOutcome string
+
+const (
+	// StatusSucceeded the stage handled the message
+	StatusSucceeded StatusOutcome = "succeeded"
+	// StatusFailed the stage failed to handle the message
+	StatusFailed StatusOutcome = "failed"
+	// StatusFiltered the stage intentionally filtered the message
+	StatusFiltered StatusOutcome = "filtered"
+)
+
+// StatusRecord outcome of a stage for an identifier, the processing status folds the records of an identifier in order
+type StatusRecord struct {
+	Stream     StreamName    `json:"stream"`
+	Identifier string        `json:"identifier"`
+	Action     ActionName    `json:"action"`
+	Outcome    StatusOutcome `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+	BatchID    string        `json:"batchId,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// IStatusStore interface containing functions to record and read the processing status
+// records are informational, stores may drop them instead of slowing down the stages
+type IStatusStore interface {
+	Record(record StatusRecord) error
+	Get(stream StreamName, identifier string) (ProcessingStatus, error)
+}
+
+// MemoryStatusStore in memory status store
+type MemoryStatusStore struct {
+	mu       sync.RWMutex
+	statuses map[string]ProcessingStatus
+}
+
+// NewMemoryStatusStore creates a new in memory status store
+func NewMemoryStatusStore() *MemoryStatusStore {
+	return &MemoryStatusStore{
+		statuses: make(map[string]ProcessingStatus),
+	}
+}
+
+// Record applies the record to the processing status of its identifier
+func (s *MemoryStatusStore) Record(record StatusRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := GetStateKey(record.Stream, record.Identifier)
+	status, found := s.statuses[key]
+	if !found {
+		status = newProcessingStatus(record.Stream, record.Identifier)
+	}
+	status.apply(record)
+	s.statuses[key] = status
+	return nil
+}
+
+// Get returns the processing status of the identifier
+func (s *MemoryStatusStore) Get(stream StreamName, identifier string) (ProcessingStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status, found := s.statuses[GetStateKey(stream, identifier)]
+	if !found {
+		return newProcessingStatus(stream, identifier), nil
+	}
+	stages := make(map[ActionName]StageStatus, len(status.Stages))
+	for action, stage := range status.Stages {
+		stages[action] = stage
+	}
+	status.Stages = stages
+	return status, nil
+}
+
+// JetStreamStatusStore status store appending the records to a JetStream stream shared between instances
+// records are acknowledged by JetStream, the status of an identifier is read by replaying its records
+type JetStreamStatusStore struct {
+	Log *pubsub.Log
+}
+
+// NewJetStreamStatusStore creates the status stream when it doesn't exist, records expire after the ttl
+func NewJetStreamStatusStore(conn *nats.Conn, stream string, ttl time.Duration) (*JetStreamStatusStore, error) {
+	log, err := pubsub.NewLog(conn, stream, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &JetStreamStatusStore{Log: log}, nil
+}
+
+// LoadJetStreamStatusStore loads the status store of an existing status stream without creating it, used by readers
+func LoadJetStreamStatusStore(conn *nats.Conn, stream string) (*JetStreamStatusStore, error) {
+	log, err := pubsub.LoadLog(conn, stream)
+	if err != nil {
+		return nil, err
+	}
+	return &JetStreamStatusStore{Log: log}, nil
+}
+
+// Record appends the record to the records of its identifier
+func (s *JetStreamStatusStore) Record(record StatusRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.Log.Append(GetStatusSubject(record.Stream, record.Identifier), data)
+}
+
+// Get returns the processing status of the identifier by replaying its records
+func (s *JetStreamStatusStore) Get(stream StreamName, identifier string) (ProcessingStatus, error) {
+	status := newProcessingStatus(stream, identifier)
+	err := s.Log.Read(GetStatusSubject(stream, identifier), func(data []byte) error {
+		var record StatusRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("reading status of %s failed: %w", stream, err)
+		}
+		status.apply(record)
+		return nil
+	})
+	return status, err
+}
+
+// GetStatusSubject create status subject based on stream and identifier, relative to the status stream
+// the identifier is encoded so the subject has a single token per identifier
+func GetStatusSubject(stream StreamName, identifier string) string {
+	return fmt.Sprintf("%s.%s", stream, EncodeIdentifier(identifier))
+}
+
+// GetStatus returns the processing status of the identifier from the status store
+func GetStatus(store IStatusStore, stream StreamName, identifier string) (ProcessingStatus, error) {
+	return store.Get(stream, identifier)
+}
+
+// newProcessingStatus returns the processing status of an identifier without recorded stages
+func newProcessingStatus(stream StreamName, identifier string) ProcessingStatus {
+	return ProcessingStatus{Stream: stream, Identifier: identifier, Stages: make(map[ActionName]StageStatus)}
+}
+
+// apply updates the stage status of the record with its outcome
+func (p *ProcessingStatus) apply(record StatusRecord) {
+	stage := p.Stages[record.Action]
+	recorded := record.Time
+	switch record.Outcome {
+	case StatusSucceeded:
+		stage.LastSucceeded = &recorded
+		stage.BatchID = record.BatchID
+	case StatusFailed:
+		stage.LastFailed = &recorded
+		stage.Error = record.Error
+		stage.BatchID = record.BatchID
+	case StatusFiltered:
+		stage.LastFiltered = &recorded
+		stage.Reason = record.Reason
+	default:
+		return
+	}
+	p.Stages[record.Action] = stage
+}
+
+// recordStatus records the outcome of the stage for the identifier when a status store is configured
+// the status is informational, a failed record is logged and doesn't affect the message
+func recordStatus(conf Config, record StatusRecord) {
+	if conf.StatusStore == nil || record.Identifier == "" {
+		return
+	}
+
+	record.Time = time.Now().UTC()
+	if err := conf.StatusStore.Record(record); err != nil {
+		conf.logger().WithError(err).WithFields(Fields{"resource": record.Stream, "action": record.Action, "id": record.Identifier}).Warn("can't record processing status")
+		count(conf, record.Stream, record.Action, "status_failed", 1)
+	}
+}
+
+// recordSucceeded records the success of the stage, batchID is empty outside the upload handler
+func recordSucceeded(conf Config, stream StreamName, action ActionName, identifier string, batchID string) {
+	recordStatus(conf, StatusRecord{Stream: stream, Identifier: identifier, Action: action, Outcome: StatusSucceeded, BatchID: batchID})
+}
+
+// recordFailed records the failure of the stage with its error
+func recordFailed(conf Config, stream StreamName, action ActionName, identifier string, batchID string, err error) {
+	recordStatus(conf, StatusRecord{Stream: stream, Identifier: identifier, Action: action, Outcome: StatusFailed, Error: err.Error(), BatchID: batchID})
+}
+
+// recordFiltered records the stage intentionally filtered the message
+func recordFiltered(conf Config, stream StreamName, action ActionName, identifier string, reason string) {
+	recordStatus(conf, StatusRecord{Stream: stream, Identifier: identifier, Action: action, Outcome: StatusFiltered, Reason: reason})
+}
+
+// newBatchID generates the id of an upload handler batch
+func newBatchID() string {
+	random := make([]byte, 8)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
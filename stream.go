@@ -1,16 +1,47 @@
 package fhirhose
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
 )
 
+// IdentifierHeader header containing the encoded identifier of a published message
+const IdentifierHeader = "Fhirhose-Identifier"
+
+// maxEncodedIdentifierLength maximum length of an encoded identifier in a subject
+const maxEncodedIdentifierLength = 1024
+
+// ErrInvalidIdentifier err returned when an identifier can't be represented in a subject
+var ErrInvalidIdentifier = errors.New("invalid identifier")
+
 // StreamMessage contains all the information
 // needed to pass data between stream functions
 type StreamMessage struct {
 	Identifier  string
 	Description string
-	Data        []byte
+	// Version optional version of the source record, used to create the deduplication message id
+	Version string
+	Data    []byte
+	// ClaimCheck key of the data in the claim check store when the data exceeded the claim check threshold
+	ClaimCheck string `json:",omitempty"`
+	// Encryption envelope when the data is encrypted on the message bus
+	Encryption *Encryption `json:",omitempty"`
+	// stateKey and contentHash are used to store the content hash after a successful upload
+	stateKey    string
+	contentHash string
+	// stream and identifier of the consumed message, used to publish the event after the upload
+	stream     StreamName
+	identifier string
+	// consumed message of the upload stage and its claim check, settled once the upload batch is handled
+	consumed           *nats.Msg
+	consumedClaimCheck string
+	// batchID batch of the upload handler which handled the message last
+	batchID string
 }
 
 // IStream interface containing stream functions
@@ -23,8 +54,9 @@ type IStream interface {
 }
 
 // GetPublishAction create consumer string based on identifier, prefix stream and action
+// the identifier is encoded so it always forms a single subject token
 func GetPublishAction(identifier string, stream StreamName, prefix ConsumerPrefix, action ActionName) string {
-	return fmt.Sprintf("%s.%s.%s.%s", prefix, stream, action, identifier)
+	return fmt.Sprintf("%s.%s.%s.%s", prefix, stream, action, EncodeIdentifier(identifier))
 }
 
 // GetConsumeAction create consumer string based on prefix stream and action
@@ -32,8 +64,81 @@ func GetConsumeAction(stream StreamName, prefix ConsumerPrefix, action ActionNam
 	return fmt.Sprintf("%s-%s-%s", prefix, stream, action)
 }
 
+// GetConsumeSubject create the subject filter of a consumer based on prefix stream and action
+func GetConsumeSubject(stream StreamName, prefix ConsumerPrefix, action ActionName) string {
+	return fmt.Sprintf("%s.%s.%s.>", prefix, stream, action)
+}
+
 // GetIdentifierFromActionString extract identifier from action string
 func GetIdentifierFromActionString(actionString string) string {
 	parts := strings.Split(actionString, ".")
-	return parts[len(parts)-1:][0]
+	identifier, err := DecodeIdentifier(parts[len(parts)-1:][0])
+	if err != nil {
+		return parts[len(parts)-1:][0]
+	}
+	return identifier
+}
+
+// GetIdentifier returns the identifier of a consumed message
+// read from the message body, the identifier header or the subject in that order
+func GetIdentifier(msg *nats.Msg, message StreamMessage) string {
+	if message.Identifier != "" {
+		return message.Identifier
+	}
+	if encoded := msg.Header.Get(IdentifierHeader); encoded != "" {
+		if identifier, err := DecodeIdentifier(encoded); err == nil {
+			return identifier
+		}
+	}
+	return GetIdentifierFromActionString(msg.Subject)
+}
+
+// ValidateIdentifier validates if the identifier can be represented in a subject
+func ValidateIdentifier(identifier string) error {
+	if identifier == "" {
+		return fmt.Errorf("%w: identifier can't be empty", ErrInvalidIdentifier)
+	}
+	if !utf8.ValidString(identifier) {
+		return fmt.Errorf("%w: identifier is not valid utf-8", ErrInvalidIdentifier)
+	}
+	if len(EncodeIdentifier(identifier)) > maxEncodedIdentifierLength {
+		return fmt.Errorf("%w: identifier exceeds %d encoded characters", ErrInvalidIdentifier, maxEncodedIdentifierLength)
+	}
+	return nil
+}
+
+// EncodeIdentifier encodes an identifier into a single subject token
+// token separators, wildcards, whitespace and non printable bytes are percent encoded
+func EncodeIdentifier(identifier string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(identifier); i++ {
+		b := identifier[i]
+		if b <= ' ' || b >= 0x7f || b == '.' || b == '*' || b == '>' || b == '%' {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+			continue
+		}
+		encoded.WriteByte(b)
+	}
+	return encoded.String()
+}
+
+// DecodeIdentifier decodes a subject token created by EncodeIdentifier
+func DecodeIdentifier(token string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(token); i++ {
+		if token[i] != '%' {
+			decoded.WriteByte(token[i])
+			continue
+		}
+		if i+2 >= len(token) {
+			return "", fmt.Errorf("%w: incomplete escape at %d", ErrInvalidIdentifier, i)
+		}
+		b, err := strconv.ParseUint(token[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid escape at %d", ErrInvalidIdentifier, i)
+		}
+		decoded.WriteByte(byte(b))
+		i += 2
+	}
+	return decoded.String(), nil
 }
@@ -0,0 +1,151 @@
+package fhirhose
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/lumc/fhirhose/packages/pubsub"
+)
+
+const (
+	// DefaultRestartBackoff default wait before the first restart of a failed consumer
+	DefaultRestartBackoff = time.Second
+	// DefaultMaxRestartBackoff default maximum wait between restarts of a failed consumer
+	DefaultMaxRestartBackoff = time.Minute
+)
+
+// ErrConsumerFailed err returned when a consumer can't be established or stopped with an error
+var ErrConsumerFailed = errors.New("consumer failed")
+
+// consume consumes the consumer and restarts it with exponential backoff when it fails
+// every failure is escalated to the error channel, a consumer returning without error stops
+// panics of the callback are recovered, see recoverCallback
+func consume(conf Config, stream StreamName, action ActionName, consumer string, errChan *chan Error, callback func(msg *nats.Msg)) {
+	clock := conf.getClock()
+	backoff := conf.getRestartBackoff()
+	logger := conf.logger().WithFields(Fields{"resource": stream, "consumer": consumer})
+	callback = recoverCallback(conf, stream, action, errChan, callback)
+
+	for {
+		logger.Info("register consumer")
+		conf.control.consumerStarted(stream, consumer)
+		started := clock.Now()
+
+		err := conf.PubSub.Consume(consumer, string(conf.GetStreamName()), callback)
+		if err == nil {
+			logger.Info("consumer stopped")
+			conf.control.consumerStopped(stream, consumer, nil)
+			return
+		}
+
+		err = fmt.Errorf("%w: %s: %v", ErrConsumerFailed, consumer, err)
+		restarts := conf.control.consumerStopped(stream, consumer, err)
+		count(conf, stream, action, "consumer_restarts", 1)
+		if errChan != nil {
+			*errChan <- Error{
+				Event:         stream,
+				Action:        action,
+				StreamMessage: nil,
+				Err:           err,
+			}
+		}
+
+		// A consumer which ran stable for a while starts again with the initial backoff
+		if clock.Now().Sub(started) >= conf.getMaxRestartBackoff() {
+			backoff = conf.getRestartBackoff()
+		}
+		logger.WithError(err).WithFields(Fields{"restarts": restarts, "backoff": backoff}).Error("can't consume from consumer, restarting")
+
+		select {
+		case <-clock.After(backoff):
+		case <-conf.control.context().Done():
+			logger.Info("consumer not restarted on shutdown")
+			return
+		}
+		backoff *= 2
+		if backoff > conf.getMaxRestartBackoff() {
+			backoff = conf.getMaxRestartBackoff()
+		}
+	}
+}
+
+// stageConsumer durable consumer of a stage and the subjects it consumes
+type stageConsumer struct {
+	name    string
+	subject string
+}
+
+// createConsumers creates the consumers of the stages when the pubsub client manages its own consumers
+func (c *Client) createConsumers() error {
+	manager, ok := c.Config.PubSub.(pubsub.IConsumerManager)
+	if !ok || c.Config.WorkerAmount <= 0 {
+		return nil
+	}
+
+	for _, stream := range c.Streams {
+		for _, consumer := range getStageConsumers(*c.Config, stream.GetStreamName()) {
+			if err := manager.AddConsumer(consumer.name, consumer.subject); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrConsumerFailed, consumer.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkConsumers checks that all consumers of the registered stages exist before the stages start
+func (c *Client) checkConsumers() error {
+	if c.Config.PubSub == nil || c.Config.WorkerAmount <= 0 {
+		return nil
+	}
+
+	for _, stream := range c.Streams {
+		for _, consumer := range getStageConsumers(*c.Config, stream.GetStreamName()) {
+			if _, err := c.Config.PubSub.Pending(consumer.name, string(c.Config.GetStreamName())); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrConsumerFailed, consumer.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// getStageConsumers returns the consumers of the retrieve, transform, upload and debounce stages of the stream
+func getStageConsumers(conf Config, stream StreamName) []stageConsumer {
+	newConsumer := func(prefix ConsumerPrefix, action ActionName) stageConsumer {
+		return stageConsumer{
+			name:    conf.GetConsumerName(stream, prefix, action),
+			subject: GetConsumeSubject(stream, prefix, action),
+		}
+	}
+
+	var consumers []stageConsumer
+	for _, prefix := range []ConsumerPrefix{conf.GetConsumerPrefix(), conf.GetCustomLoadPrefix()} {
+		consumers = append(consumers,
+			newConsumer(prefix, getRetrieveSourceAction(conf, prefix)),
+			newConsumer(prefix, RetrieveAction),
+			newConsumer(prefix, TransformAction),
+		)
+	}
+	if conf.DebounceQuietPeriod > 0 {
+		consumers = append(consumers, newConsumer(conf.GetConsumerPrefix(), PollAction))
+	}
+	return consumers
+}
+
+// getRestartBackoff returns the configured restart backoff or the default
+func (c Config) getRestartBackoff() time.Duration {
+	if c.RestartBackoff > 0 {
+		return c.RestartBackoff
+	}
+	return DefaultRestartBackoff
+}
+
+// getMaxRestartBackoff returns the configured maximum restart backoff or the default
+func (c Config) getMaxRestartBackoff() time.Duration {
+	if c.MaxRestartBackoff > 0 {
+		return c.MaxRestartBackoff
+	}
+	return DefaultMaxRestartBackoff
+}
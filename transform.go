@@ -1,74 +1,79 @@
 package fhirhose
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
-	"github.com/sirupsen/logrus"
 )
 
 // Transformers creates a transform subscriber for each stream
 func (c *Register) Transformers(conf Config, streams []IStream, errChan *chan Error) {
 	for _, stream := range streams {
-		go handleTransform(DefaultConsumerPrefix, stream, conf, errChan)
-		go handleTransform(DefaultConsumerCustomLoadPrefix, stream, conf, errChan)
+		go handleTransform(conf.GetConsumerPrefix(), stream, conf, errChan)
+		go handleTransform(conf.GetCustomLoadPrefix(), stream, conf, errChan)
 	}
 }
 
 // handleTransform handles the transform action
 func handleTransform(prefix ConsumerPrefix, stream IStream, conf Config, errChan *chan Error) {
 	// Consume from retrieved consumer or given resource
-	consumerString := GetConsumeAction(stream.GetStreamName(), prefix, RetrieveAction)
-	logrus.WithFields(logrus.Fields{"consumer": consumerString}).Info("register consumer")
-	err := conf.PubSub.Consume(consumerString, string(DefaultStreamName), func(msg *nats.Msg) {
+	consumerString := conf.GetConsumerName(stream.GetStreamName(), prefix, RetrieveAction)
+	contextStream := WithContext(stream)
+	stageCircuit := getCircuit(conf, stream, TransformAction)
+	consume(conf, stream.GetStreamName(), TransformAction, consumerString, errChan, func(msg *nats.Msg) {
+		conf.control.waitWhilePaused(stream.GetStreamName(), TransformAction, conf.PubSub, msg)
+		if redeliverOnShutdown(conf, msg) {
+			return
+		}
+
 		// Transform message
-		var message StreamMessage
-		id := GetIdentifierFromActionString(msg.Subject)
-		err := json.Unmarshal(msg.Data, &message)
+		message, claimCheck, err := unmarshalMessage(conf, msg.Data)
 		if err != nil {
-			logrus.WithError(err).Error("can't unmarshal message")
+			// Key provider and claim check store failures are redelivered, unreadable messages dead lettered
+			settleFailure(conf, stream.GetStreamName(), TransformAction, msg, &message, err, errChan)
+			return
 		}
+		id := GetIdentifier(msg, message)
 
-		updatedMessage, funcErr := stream.Transform(message)
-		if funcErr != nil && errChan != nil {
-			*errChan <- Error{
-				Event:         stream.GetStreamName(),
-				Action:        TransformAction,
-				StreamMessage: &updatedMessage,
-				Error:         funcErr,
-			}
+		if !waitForCircuit(conf, stream.GetStreamName(), TransformAction, stageCircuit, msg, errChan) {
+			redeliverOnShutdown(conf, msg)
+			return
 		}
-
-		// Acknowledge message transformed event
-		err = msg.Respond(nil)
-		if err != nil {
-			logrus.WithError(err).Error("can't acknowledge message")
+		var updatedMessage StreamMessage
+		funcErr := runStage(conf, stream.GetStreamName(), TransformAction, msg, func(ctx context.Context) (err error) {
+			updatedMessage, err = contextStream.TransformContext(ctx, message)
+			return err
+		})
+		recordCircuit(conf, stream.GetStreamName(), TransformAction, stageCircuit, funcErr, errChan)
+		if errors.Is(funcErr, ErrShutdown) && redeliverOnShutdown(conf, msg) {
+			// Redelivered message still needs its data
+			return
 		}
-
-		// Publish message transformed event
-
-		if funcErr == nil {
-			logrus.WithFields(logrus.Fields{
+		if funcErr != nil {
+			if !settleFailure(conf, stream.GetStreamName(), TransformAction, msg, &updatedMessage, funcErr, errChan) {
+				// Redelivered or dead lettered message still needs its data
+				return
+			}
+		} else {
+			conf.logger().WithFields(Fields{
 				"id":   id,
 				"desc": updatedMessage.Description,
 				"time": time.Now(),
 			}).Info("transformed item")
 
-			// Create message bytes
-			messageBytes, err := json.Marshal(&updatedMessage)
-			if err != nil {
-				logrus.WithError(err).Error("can't marshal message bytes")
+			// Publish and acknowledge once the publish is confirmed
+			if !forward(conf, msg, stream.GetStreamName(), TransformAction, message.Identifier, updatedMessage, errChan) {
+				// Redelivered message still needs its data
+				return
 			}
+			recordSucceeded(conf, stream.GetStreamName(), TransformAction, id, "")
+		}
 
-			// Publish
-			actionString := GetPublishAction(message.Identifier, stream.GetStreamName(), DefaultConsumerPrefix, TransformAction)
-			if err := conf.PubSub.Publish(actionString, messageBytes); err != nil {
-				logrus.WithError(err).Error("can't publish new event")
-			}
+		// Data of the consumed message is no longer needed
+		if err := releaseClaimCheck(conf, claimCheck); err != nil {
+			conf.logger().WithError(err).Error("can't release claim check")
 		}
 	})
-	if err != nil {
-		logrus.WithField("consumer", consumerString).WithError(err).Error("can't consume from consumer")
-	}
 }
@@ -1,62 +1,130 @@
 package fhirhose
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
-	"github.com/sirupsen/logrus"
 )
 
 // Uploaders registers retrieve consumers for each stream
 // it also puts processed items into the upload channel when defined
 func (c *Register) Uploaders(conf Config, streams []IStream, errChan *chan Error, uploadChan *chan StreamMessage) {
 	for _, stream := range streams {
-		go handleUpload(DefaultConsumerPrefix, stream, conf, errChan, uploadChan)
-		go handleUpload(DefaultConsumerCustomLoadPrefix, stream, conf, errChan, uploadChan)
+		go handleUpload(conf.GetConsumerPrefix(), stream, conf, errChan, uploadChan)
+		go handleUpload(conf.GetCustomLoadPrefix(), stream, conf, errChan, uploadChan)
 	}
 }
 
 // handleUpload handles the upload action
 func handleUpload(prefix ConsumerPrefix, stream IStream, conf Config, errChan *chan Error, uploadChan *chan StreamMessage) {
 	// Consume from transformed consumer or given resource
-	consumerString := GetConsumeAction(stream.GetStreamName(), prefix, TransformAction)
-	logrus.WithFields(logrus.Fields{"consumer": consumerString}).Info("register consumer")
-	err := conf.PubSub.Consume(consumerString, string(DefaultStreamName), func(msg *nats.Msg) {
+	consumerString := conf.GetConsumerName(stream.GetStreamName(), prefix, TransformAction)
+	contextStream := WithContext(stream)
+	stageCircuit := getCircuit(conf, stream, UploadAction)
+	consume(conf, stream.GetStreamName(), UploadAction, consumerString, errChan, func(msg *nats.Msg) {
+		conf.control.waitWhilePaused(stream.GetStreamName(), UploadAction, conf.PubSub, msg)
+		if redeliverOnShutdown(conf, msg) {
+			return
+		}
+
 		// Retrieve message
-		var message StreamMessage
-		id := GetIdentifierFromActionString(msg.Subject)
-		err := json.Unmarshal(msg.Data, &message)
+		message, claimCheck, err := unmarshalMessage(conf, msg.Data)
 		if err != nil {
-			logrus.WithError(err).Error("can't unmarshal message")
+			// Key provider and claim check store failures are redelivered, unreadable messages dead lettered
+			settleFailure(conf, stream.GetStreamName(), UploadAction, msg, &message, err, errChan)
+			return
 		}
+		id := GetIdentifier(msg, message)
 
-		updatedMessage, shouldUpload, funcErr := stream.Upload(message)
-		if funcErr != nil && errChan != nil {
-			*errChan <- Error{
-				Event:         stream.GetStreamName(),
-				Action:        UploadAction,
-				StreamMessage: &updatedMessage,
-				Error:         funcErr,
+		// Skip messages which are byte identical to the last successful upload
+		if conf.UploadHashStore != nil {
+			message.stateKey = GetStateKey(stream.GetStreamName(), message.Identifier)
+			message.contentHash = getContentHash(message.Data)
+			if !conf.ForceUpload && isUploaded(conf, message) {
+				conf.logger().WithField("id", id).Debug("skipping unchanged item")
+				count(conf, stream.GetStreamName(), UploadAction, "unchanged", 1)
+				acknowledge(conf, msg)
+				recordFiltered(conf, stream.GetStreamName(), UploadAction, id, "unchanged")
+				publishFiltered(conf, stream.GetStreamName(), UploadAction, id, "unchanged")
+				if err := releaseClaimCheck(conf, claimCheck); err != nil {
+					conf.logger().WithError(err).Error("can't release claim check")
+				}
+				return
 			}
 		}
 
-		// Acknowledge message received event
-		err = msg.Respond(nil)
-		if err != nil {
-			logrus.WithError(err).Error("can't acknowledge message")
+		if !waitForCircuit(conf, stream.GetStreamName(), UploadAction, stageCircuit, msg, errChan) {
+			redeliverOnShutdown(conf, msg)
+			return
+		}
+		var updatedMessage StreamMessage
+		var shouldUpload bool
+		funcErr := runStage(conf, stream.GetStreamName(), UploadAction, msg, func(ctx context.Context) (err error) {
+			updatedMessage, shouldUpload, err = contextStream.UploadContext(ctx, message)
+			return err
+		})
+		recordCircuit(conf, stream.GetStreamName(), UploadAction, stageCircuit, funcErr, errChan)
+		if errors.Is(funcErr, ErrShutdown) && redeliverOnShutdown(conf, msg) {
+			// Redelivered message still needs its data
+			return
 		}
+		updatedMessage.stateKey = message.stateKey
+		updatedMessage.contentHash = message.contentHash
+		updatedMessage.stream = stream.GetStreamName()
+		updatedMessage.identifier = id
+		if funcErr != nil {
+			if !settleFailure(conf, stream.GetStreamName(), UploadAction, msg, &updatedMessage, funcErr, errChan) {
+				// Redelivered or dead lettered message still needs its data
+				return
+			}
+		} else if shouldUpload && uploadChan != nil {
+			conf.logger().WithFields(Fields{"id": id, "time": time.Now()}).Info("uploaded item put data into upload channel")
+			// The upload handler acknowledges the message and releases the claim check once the batch is handled
+			updatedMessage.consumed = msg
+			updatedMessage.consumedClaimCheck = claimCheck
+			sendUpload(conf, uploadChan, updatedMessage)
+			return
+		} else {
+			// Acknowledge message received event
+			acknowledge(conf, msg)
 
-		if funcErr == nil && shouldUpload {
-			logrus.WithFields(logrus.Fields{"id": id, "time": time.Now()}).Info("uploaded item put data into upload channel")
-			if uploadChan != nil {
-				*uploadChan <- updatedMessage
+			if shouldUpload {
+				conf.logger().WithField("id", id).Warn("can't put data into the upload channel when channel is nil")
 			} else {
-				logrus.WithField("id", id).Warn("can't put data into the upload channel when channel is nil")
+				// Upload has been done by the stream itself
+				storeUploaded(conf, updatedMessage)
+				recordSucceeded(conf, updatedMessage.stream, UploadAction, updatedMessage.identifier, "")
+				publishUploaded(conf, updatedMessage.stream, updatedMessage.identifier)
 			}
 		}
+
+		// Data has been resolved so the claim check can be garbage collected after upload
+		if err := releaseClaimCheck(conf, claimCheck); err != nil {
+			conf.logger().WithError(err).Error("can't release claim check")
+		}
 	})
+}
+
+// isUploaded checks if the content hash of the message equals the hash of the last successful upload
+func isUploaded(conf Config, message StreamMessage) bool {
+	hash, found, err := conf.UploadHashStore.Get(message.stateKey)
 	if err != nil {
-		logrus.WithField("consumer", consumerString).WithError(err).Error("can't consume from consumer")
+		conf.logger().WithError(err).Error("can't get content hash")
+		return false
+	}
+
+	return found && string(hash) == message.contentHash
+}
+
+// storeUploaded stores the content hash of a successfully uploaded message
+func storeUploaded(conf Config, message StreamMessage) {
+	if conf.UploadHashStore == nil || message.stateKey == "" {
+		return
+	}
+
+	if err := conf.UploadHashStore.Put(message.stateKey, []byte(message.contentHash)); err != nil {
+		conf.logger().WithError(err).Error("can't store content hash")
 	}
 }